@@ -16,5 +16,6 @@ func startClient(client FIDOClient) {
 	ctapServer := ctap.NewCTAPServer(client)
 	u2fServer := u2f.NewU2FServer(client)
 	ctapHIDServer := ctap_hid.NewCTAPHIDServer(ctapServer, u2fServer)
+	ctapHIDServer.SetWinkHandler(winkHandler(client))
 	mac.Start(ctapHIDServer)
 }
@@ -14,6 +14,7 @@ func startClient(client FIDOClient) {
 	ctapServer := ctap.NewCTAPServer(client)
 	u2fServer := u2f.NewU2FServer(client)
 	ctapHIDServer := ctap_hid.NewCTAPHIDServer(ctapServer, u2fServer)
+	ctapHIDServer.SetWinkHandler(winkHandler(client))
 	usbDevice := usb.NewUSBDevice(ctapHIDServer)
 	server := usbip.NewUSBIPServer([]usbip.USBIPDevice{usbDevice})
 	server.Start()
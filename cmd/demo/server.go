@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -13,20 +14,39 @@ import (
 	"github.com/bulwarkid/virtual-fido/fido_client"
 )
 
-func prompt(prompt string) bool {
+var userInput = make(chan string)
+var startReadingInput sync.Once
+
+// Stdin is read in the background, so that a prompt can stop waiting when the request is cancelled
+func readUserInput() {
 	reader := bufio.NewReader(os.Stdin)
+	for {
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Printf("Could not read user input: %s - %s\n", response, err)
+			panic(err)
+		}
+		userInput <- response
+	}
+}
+
+func prompt(ctx context.Context, prompt string) bool {
+	startReadingInput.Do(func() { go readUserInput() })
+	select {
+	case <-userInput:
+		// Answer typed after an earlier prompt was cancelled
+	default:
+	}
 	fmt.Println(prompt)
 	fmt.Print("--> ")
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Printf("Could not read user input: %s - %s\n", response, err)
-		panic(err)
+	select {
+	case response := <-userInput:
+		response = strings.ToLower(strings.TrimSpace(response))
+		return response == "y" || response == "yes"
+	case <-ctx.Done():
+		fmt.Println("Request cancelled")
+		return false
 	}
-	response = strings.ToLower(strings.TrimSpace(response))
-	if response == "y" || response == "yes" {
-		return true
-	}
-	return false
 }
 
 type ClientSupport struct {
@@ -34,16 +54,20 @@ type ClientSupport struct {
 	vaultPassphrase string
 }
 
-func (support *ClientSupport) ApproveClientAction(action fido_client.ClientAction, params fido_client.ClientActionRequestParams) bool {
+func (support *ClientSupport) ApproveClientAction(ctx context.Context, action fido_client.ClientAction, params fido_client.ClientActionRequestParams) bool {
 	switch action {
 	case fido_client.ClientActionFIDOGetAssertion:
-		return prompt(fmt.Sprintf("Approve login for \"%s\" with identity \"%s\" (Y/n)?", params.RelyingParty, params.UserName))
+		return prompt(ctx, fmt.Sprintf("Approve login for \"%s\" with identity \"%s\" (Y/n)?", params.RelyingParty, params.UserName))
 	case fido_client.ClientActionFIDOMakeCredential:
-		return prompt(fmt.Sprintf("Approve account creation for \"%s\" (Y/n)?", params.RelyingParty))
+		return prompt(ctx, fmt.Sprintf("Approve account creation for \"%s\" (Y/n)?", params.RelyingParty))
+	case fido_client.ClientActionFIDOReset:
+		return prompt(ctx, "Approve reset of device, deleting all credentials (Y/n)?")
+	case fido_client.ClientActionFIDOSelection:
+		return prompt(ctx, "Use this device for the current request (Y/n)?")
 	case fido_client.ClientActionU2FAuthenticate:
-		return prompt("Approve registration of U2F device (Y/n)?")
+		return prompt(ctx, "Approve registration of U2F device (Y/n)?")
 	case fido_client.ClientActionU2FRegister:
-		return prompt("Approve use of U2F device (Y/n)?")
+		return prompt(ctx, "Approve use of U2F device (Y/n)?")
 	}
 	fmt.Printf("Unknown client action for approval: %d\n", action)
 	return false
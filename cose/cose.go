@@ -19,18 +19,39 @@ type COSEAlgorithmID int32
 const (
 	COSE_ALGORITHM_ID_ES256         COSEAlgorithmID = -7
 	COSE_ALGORITHM_ID_ECDH_HKDF_256 COSEAlgorithmID = -25
+	COSE_ALGORITHM_ID_ES384         COSEAlgorithmID = -35
 	COSE_ALGORITHM_ID_ES512         COSEAlgorithmID = -36
 	COSE_ALGORITHM_ID_ED25519       COSEAlgorithmID = -8
 	COSE_ALGORITHM_ID_PS256         COSEAlgorithmID = -37
+	COSE_ALGORITHM_ID_RS256         COSEAlgorithmID = -257
 )
 
 type coseCurveID int32
 
 const (
 	COSE_CURVE_ID_P256    coseCurveID = 1
+	COSE_CURVE_ID_P384    coseCurveID = 2
 	COSE_CURVE_ID_ED25519 coseCurveID = 6
 )
 
+// Generates a private key for the given algorithm, or returns nil if the algorithm isn't supported
+func GeneratePrivateKey(algorithm COSEAlgorithmID) *SupportedCOSEPrivateKey {
+	switch algorithm {
+	case COSE_ALGORITHM_ID_ES256:
+		return &SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+	case COSE_ALGORITHM_ID_ES384:
+		return &SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAP384Key()}
+	case COSE_ALGORITHM_ID_ED25519:
+		return &SupportedCOSEPrivateKey{Ed25519: crypto.GenerateEd25519Key()}
+	case COSE_ALGORITHM_ID_PS256:
+		return &SupportedCOSEPrivateKey{RSA: crypto.GenerateRSAKey()}
+	case COSE_ALGORITHM_ID_RS256:
+		return &SupportedCOSEPrivateKey{RSA: crypto.GenerateRSAKey(), RSAPKCS1v15: true}
+	default:
+		return nil
+	}
+}
+
 type coseKeyType int32
 
 const (
@@ -44,6 +65,8 @@ type SupportedCOSEPrivateKey struct {
 	ECDSA   *ecdsa.PrivateKey
 	Ed25519 *ed25519.PrivateKey
 	RSA     *rsa.PrivateKey
+	// RSA keys sign with PSS (PS256) unless this selects PKCS #1 v1.5 (RS256)
+	RSAPKCS1v15 bool
 }
 
 func (key *SupportedCOSEPrivateKey) Equal(otherKey *SupportedCOSEPrivateKey) bool {
@@ -67,11 +90,15 @@ func (key *SupportedCOSEPrivateKey) Equal(otherKey *SupportedCOSEPrivateKey) boo
 	if key.RSA != nil && !key.RSA.Equal(otherKey.RSA) {
 		return false
 	}
-	return true
+	return key.RSAPKCS1v15 == otherKey.RSAPKCS1v15
+}
+
+func (key *SupportedCOSEPrivateKey) Algorithm() COSEAlgorithmID {
+	return key.Public().Algorithm()
 }
 
 func (key *SupportedCOSEPrivateKey) Public() *SupportedCOSEPublicKey {
-	coseKey := SupportedCOSEPublicKey{}
+	coseKey := SupportedCOSEPublicKey{RSAPKCS1v15: key.RSAPKCS1v15}
 	if key.ECDSA != nil {
 		coseKey.ECDSA = &key.ECDSA.PublicKey
 	} else if key.Ed25519 != nil {
@@ -90,6 +117,8 @@ func (key *SupportedCOSEPrivateKey) Sign(data []byte) []byte {
 		return crypto.SignECDSA(key.ECDSA, data)
 	} else if key.Ed25519 != nil {
 		return crypto.SignEd25519(key.Ed25519, data)
+	} else if key.RSA != nil && key.RSAPKCS1v15 {
+		return crypto.SignRSAPKCS1v15(key.RSA, data)
 	} else if key.RSA != nil {
 		return crypto.SignRSA(key.RSA, data)
 	} else {
@@ -98,9 +127,10 @@ func (key *SupportedCOSEPrivateKey) Sign(data []byte) []byte {
 }
 
 type SupportedCOSEPublicKey struct {
-	ECDSA   *ecdsa.PublicKey
-	Ed25519 *ed25519.PublicKey
-	RSA     *rsa.PublicKey
+	ECDSA       *ecdsa.PublicKey
+	Ed25519     *ed25519.PublicKey
+	RSA         *rsa.PublicKey
+	RSAPKCS1v15 bool
 }
 
 func (key *SupportedCOSEPublicKey) Equal(otherKey *SupportedCOSEPublicKey) bool {
@@ -124,7 +154,23 @@ func (key *SupportedCOSEPublicKey) Equal(otherKey *SupportedCOSEPublicKey) bool
 	if key.RSA != nil && !key.RSA.Equal(otherKey.RSA) {
 		return false
 	}
-	return true
+	return key.RSAPKCS1v15 == otherKey.RSAPKCS1v15
+}
+
+func (key *SupportedCOSEPublicKey) Algorithm() COSEAlgorithmID {
+	if key.ECDSA != nil && key.ECDSA.Curve == elliptic.P384() {
+		return COSE_ALGORITHM_ID_ES384
+	} else if key.ECDSA != nil {
+		return COSE_ALGORITHM_ID_ES256
+	} else if key.Ed25519 != nil {
+		return COSE_ALGORITHM_ID_ED25519
+	} else if key.RSA != nil && key.RSAPKCS1v15 {
+		return COSE_ALGORITHM_ID_RS256
+	} else if key.RSA != nil {
+		return COSE_ALGORITHM_ID_PS256
+	} else {
+		panic("No supported public key data!")
+	}
 }
 
 func (key *SupportedCOSEPublicKey) Verify(data []byte, signature []byte) bool {
@@ -132,6 +178,8 @@ func (key *SupportedCOSEPublicKey) Verify(data []byte, signature []byte) bool {
 		return crypto.VerifyECDSA(key.ECDSA, data, signature)
 	} else if key.Ed25519 != nil {
 		return crypto.VerifyEd25519(key.Ed25519, data, signature)
+	} else if key.RSA != nil && key.RSAPKCS1v15 {
+		return crypto.VerifyRSAPKCS1v15(key.RSA, data, signature)
 	} else if key.RSA != nil {
 		return crypto.VerifyRSA(key.RSA, data, signature)
 	} else {
@@ -163,6 +211,9 @@ func encodeECDSAPublicKey(publicKey *ecdsa.PublicKey) []byte {
 	if publicKey.Curve == elliptic.P256() {
 		alg = COSE_ALGORITHM_ID_ES256
 		curve = COSE_CURVE_ID_P256
+	} else if publicKey.Curve == elliptic.P384() {
+		alg = COSE_ALGORITHM_ID_ES384
+		curve = COSE_CURVE_ID_P384
 	} else {
 		panic(fmt.Sprintf("Invalid key to encode with COSE"))
 	}
@@ -183,8 +234,10 @@ func decodeECDSAPublicKey(publicKeyBytes []byte) *ecdsa.PublicKey {
 	publicKey := ecdsa.PublicKey{}
 	if key.Curve == int8(COSE_CURVE_ID_P256) {
 		publicKey.Curve = elliptic.P256()
+	} else if key.Curve == int8(COSE_CURVE_ID_P384) {
+		publicKey.Curve = elliptic.P384()
 	} else {
-		util.CheckErr(fmt.Errorf("Invalid curve"), "Curve is not P256")
+		util.CheckErr(fmt.Errorf("Invalid curve"), "Curve is not P256 or P384")
 	}
 	publicKey.X = &big.Int{}
 	publicKey.X.SetBytes(key.X)
@@ -199,6 +252,9 @@ func encodeECDSAPrivateKey(privateKey *ecdsa.PrivateKey) []byte {
 	if privateKey.Curve == elliptic.P256() {
 		alg = COSE_ALGORITHM_ID_ES256
 		curve = COSE_CURVE_ID_P256
+	} else if privateKey.Curve == elliptic.P384() {
+		alg = COSE_ALGORITHM_ID_ES384
+		curve = COSE_CURVE_ID_P384
 	} else {
 		panic(fmt.Sprintf("Invalid key to encode with COSE"))
 	}
@@ -220,8 +276,10 @@ func decodeECDSAPrivateKey(privateKeyBytes []byte) *ecdsa.PrivateKey {
 	privateKey := ecdsa.PrivateKey{}
 	if key.Curve == int8(COSE_CURVE_ID_P256) {
 		privateKey.Curve = elliptic.P256()
+	} else if key.Curve == int8(COSE_CURVE_ID_P384) {
+		privateKey.Curve = elliptic.P384()
 	} else {
-		util.CheckErr(fmt.Errorf("Invalid curve"), "Curve is not P256")
+		util.CheckErr(fmt.Errorf("Invalid curve"), "Curve is not P256 or P384")
 	}
 	privateKey.X = &big.Int{}
 	privateKey.X.SetBytes(key.X)
@@ -279,7 +337,7 @@ func decodeEd25519PrivateKey(privateKeyBytes []byte) *ed25519.PrivateKey {
 
 type COSERSAKey struct {
 	KeyType   int8   `cbor:"1,keyasint"`
-	Algorithm int8   `cbor:"3,keyasint"`
+	Algorithm int32  `cbor:"3,keyasint"`
 	N         []byte `cbor:"-1,keyasint"`
 	E         []byte `cbor:"-2,keyasint"`
 	D         []byte `cbor:"-3,keyasint,omitempty"`
@@ -290,12 +348,19 @@ type COSERSAKey struct {
 	Qinv      []byte `cbor:"-8,keyasint,omitempty"`
 }
 
-func encodeRSAPublicKey(publicKey *rsa.PublicKey) []byte {
+func rsaAlgorithm(pkcs1v15 bool) COSEAlgorithmID {
+	if pkcs1v15 {
+		return COSE_ALGORITHM_ID_RS256
+	}
+	return COSE_ALGORITHM_ID_PS256
+}
+
+func encodeRSAPublicKey(publicKey *rsa.PublicKey, pkcs1v15 bool) []byte {
 	key := COSERSAKey{
 		KeyType:   int8(COSE_KEY_TYPE_RSA),
-		Algorithm: int8(COSE_ALGORITHM_ID_PS256),
+		Algorithm: int32(rsaAlgorithm(pkcs1v15)),
 		N:         publicKey.N.Bytes(),
-		E:         util.ToBE(publicKey.E),
+		E:         big.NewInt(int64(publicKey.E)).Bytes(),
 	}
 	return util.MarshalCBOR(key)
 }
@@ -305,19 +370,19 @@ func decodeRSAPublicKey(publicKeyBytes []byte) *rsa.PublicKey {
 	err := cbor.Unmarshal(publicKeyBytes, &key)
 	util.CheckErr(err, "Could not unmarshal public key")
 	publicKey := rsa.PublicKey{}
-	publicKey.E = util.FromBE[int](key.E)
+	publicKey.E = int(util.BytesToBigInt(key.E).Int64())
 	publicKey.N = &big.Int{}
 	publicKey.N.SetBytes(key.N)
 	return &publicKey
 }
 
-func encodeRSAPrivateKey(privateKey *rsa.PrivateKey) []byte {
+func encodeRSAPrivateKey(privateKey *rsa.PrivateKey, pkcs1v15 bool) []byte {
 	publicKey := privateKey.PublicKey
 	key := COSERSAKey{
 		KeyType:   int8(COSE_KEY_TYPE_RSA),
-		Algorithm: int8(COSE_ALGORITHM_ID_PS256),
+		Algorithm: int32(rsaAlgorithm(pkcs1v15)),
 		N:         publicKey.N.Bytes(),
-		E:         util.ToBE(int32(publicKey.E)),
+		E:         big.NewInt(int64(publicKey.E)).Bytes(),
 		D:         privateKey.D.Bytes(),
 		P:         privateKey.Primes[0].Bytes(),
 		Q:         privateKey.Primes[1].Bytes(),
@@ -333,7 +398,7 @@ func decodeRSAPrivateKey(privateKeyBytes []byte) *rsa.PrivateKey {
 	err := cbor.Unmarshal(privateKeyBytes, &key)
 	util.CheckErr(err, "Could not unmarshal public key")
 	privateKey := rsa.PrivateKey{}
-	privateKey.E = int(util.FromBE[int32](key.E))
+	privateKey.E = int(util.BytesToBigInt(key.E).Int64())
 	privateKey.N = &big.Int{}
 	privateKey.N.SetBytes(key.N)
 	privateKey.D = &big.Int{}
@@ -353,15 +418,15 @@ func MarshalCOSEPublicKey(publicKey *SupportedCOSEPublicKey) []byte {
 	} else if publicKey.Ed25519 != nil {
 		return encodeEd25519PublicKey(publicKey.Ed25519)
 	} else if publicKey.RSA != nil {
-		return encodeRSAPublicKey(publicKey.RSA)
+		return encodeRSAPublicKey(publicKey.RSA, publicKey.RSAPKCS1v15)
 	} else {
 		panic("No key provided in public key struct!")
 	}
 }
 
 type COSEKeyHeader struct {
-	KeyType   int8 `cbor:"1,keyasint"`
-	Algorithm int8 `cbor:"3,keyasint"`
+	KeyType   int8  `cbor:"1,keyasint"`
+	Algorithm int32 `cbor:"3,keyasint"`
 }
 
 func UnmarshalCOSEPublicKey(publicKeyBytes []byte) (*SupportedCOSEPublicKey, error) {
@@ -370,17 +435,17 @@ func UnmarshalCOSEPublicKey(publicKeyBytes []byte) (*SupportedCOSEPublicKey, err
 	if err != nil {
 		return nil, fmt.Errorf("Could not decode CBOR for public key")
 	}
-	if header.Algorithm == int8(COSE_ALGORITHM_ID_ES256) {
+	if header.Algorithm == int32(COSE_ALGORITHM_ID_ES256) || header.Algorithm == int32(COSE_ALGORITHM_ID_ES384) {
 		publicKey := decodeECDSAPublicKey(publicKeyBytes)
 		coseKey := SupportedCOSEPublicKey{ECDSA: publicKey}
 		return &coseKey, nil
-	} else if header.Algorithm == int8(COSE_ALGORITHM_ID_ED25519) {
+	} else if header.Algorithm == int32(COSE_ALGORITHM_ID_ED25519) {
 		publicKey := decodeEd25519PublicKey(publicKeyBytes)
 		coseKey := SupportedCOSEPublicKey{Ed25519: publicKey}
 		return &coseKey, nil
-	} else if header.Algorithm == int8(COSE_ALGORITHM_ID_PS256) {
+	} else if header.Algorithm == int32(COSE_ALGORITHM_ID_PS256) || header.Algorithm == int32(COSE_ALGORITHM_ID_RS256) {
 		publicKey := decodeRSAPublicKey(publicKeyBytes)
-		coseKey := SupportedCOSEPublicKey{RSA: publicKey}
+		coseKey := SupportedCOSEPublicKey{RSA: publicKey, RSAPKCS1v15: header.Algorithm == int32(COSE_ALGORITHM_ID_RS256)}
 		return &coseKey, nil
 	} else {
 		return nil, fmt.Errorf("Unsupported COSE public key algorithm: %d", header.Algorithm)
@@ -393,7 +458,7 @@ func MarshalCOSEPrivateKey(privateKey *SupportedCOSEPrivateKey) []byte {
 	} else if privateKey.Ed25519 != nil {
 		return encodeEd215519PrivateKey(privateKey.Ed25519)
 	} else if privateKey.RSA != nil {
-		return encodeRSAPrivateKey(privateKey.RSA)
+		return encodeRSAPrivateKey(privateKey.RSA, privateKey.RSAPKCS1v15)
 	} else {
 		panic("No key provided in public key struct!")
 	}
@@ -405,17 +470,17 @@ func UnmarshalCOSEPrivateKey(privateKeyBytes []byte) (*SupportedCOSEPrivateKey,
 	if err != nil {
 		return nil, fmt.Errorf("Could not decode CBOR for private key")
 	}
-	if header.Algorithm == int8(COSE_ALGORITHM_ID_ES256) {
+	if header.Algorithm == int32(COSE_ALGORITHM_ID_ES256) || header.Algorithm == int32(COSE_ALGORITHM_ID_ES384) {
 		privateKey := decodeECDSAPrivateKey(privateKeyBytes)
 		coseKey := SupportedCOSEPrivateKey{ECDSA: privateKey}
 		return &coseKey, nil
-	} else if header.Algorithm == int8(COSE_ALGORITHM_ID_ED25519) {
+	} else if header.Algorithm == int32(COSE_ALGORITHM_ID_ED25519) {
 		privateKey := decodeEd25519PrivateKey(privateKeyBytes)
 		coseKey := SupportedCOSEPrivateKey{Ed25519: privateKey}
 		return &coseKey, nil
-	} else if header.Algorithm == int8(COSE_ALGORITHM_ID_PS256) {
+	} else if header.Algorithm == int32(COSE_ALGORITHM_ID_PS256) || header.Algorithm == int32(COSE_ALGORITHM_ID_RS256) {
 		privateKey := decodeRSAPrivateKey(privateKeyBytes)
-		coseKey := SupportedCOSEPrivateKey{RSA: privateKey}
+		coseKey := SupportedCOSEPrivateKey{RSA: privateKey, RSAPKCS1v15: header.Algorithm == int32(COSE_ALGORITHM_ID_RS256)}
 		return &coseKey, nil
 	} else {
 		return nil, fmt.Errorf("Unsupported COSE private key algorithm: %d", header.Algorithm)
@@ -36,6 +36,16 @@ func TestECDSA(t *testing.T) {
 	testCOSEKey(t, cosePrivateKey)
 }
 
+func TestECDSAP384(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	checkErr(t, err)
+	cosePrivateKey := &SupportedCOSEPrivateKey{ECDSA: privateKey}
+	testCOSEKey(t, cosePrivateKey)
+	if cosePrivateKey.Algorithm() != COSE_ALGORITHM_ID_ES384 {
+		t.Fatalf("Incorrect algorithm for P384 key: %d", cosePrivateKey.Algorithm())
+	}
+}
+
 func TestEd25519(t *testing.T) {
 	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	checkErr(t, err)
@@ -49,3 +59,15 @@ func TestRSA(t *testing.T) {
 	cosePrivateKey := &SupportedCOSEPrivateKey{RSA: privateKey}
 	testCOSEKey(t, cosePrivateKey)
 }
+
+func TestRSAPKCS1v15(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	checkErr(t, err)
+	cosePrivateKey := &SupportedCOSEPrivateKey{RSA: privateKey, RSAPKCS1v15: true}
+	testCOSEKey(t, cosePrivateKey)
+	publicKey, err := UnmarshalCOSEPublicKey(MarshalCOSEPublicKey(cosePrivateKey.Public()))
+	checkErr(t, err)
+	if publicKey.Algorithm() != COSE_ALGORITHM_ID_RS256 {
+		t.Fatalf("Incorrect algorithm for RS256 key: %d", publicKey.Algorithm())
+	}
+}
@@ -10,10 +10,13 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
+	"io"
 	"math/big"
 
 	util "github.com/bulwarkid/virtual-fido/util"
+	"golang.org/x/crypto/hkdf"
 )
 
 const RSA_NUMBER_OF_BITS = 4096
@@ -28,6 +31,12 @@ func GenerateECDSAKey() *ecdsa.PrivateKey {
 	return key
 }
 
+func GenerateECDSAP384Key() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	util.CheckErr(err, "Could not generate ecdsa P384 private key")
+	return key
+}
+
 func GenerateEd25519Key() *ed25519.PrivateKey {
 	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	util.CheckErr(err, "Could not generate Ed25519 private key")
@@ -75,6 +84,9 @@ func Decrypt(key []byte, data []byte, nonce []byte) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Could not create GCM mode: %w", err)
 	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("Invalid nonce length: %d", len(nonce))
+	}
 	decryptedData, err := gcm.Open(nil, nonce, data, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Could not decrypt data: %w", err)
@@ -82,16 +94,26 @@ func Decrypt(key []byte, data []byte, nonce []byte) ([]byte, error) {
 	return decryptedData, nil
 }
 
-func SignECDSA(key *ecdsa.PrivateKey, data []byte) []byte {
+// ES256 signs P256 keys with SHA-256, while ES384 signs P384 keys with SHA-384
+func hashECDSA(curve elliptic.Curve, data []byte) []byte {
+	if curve == elliptic.P384() {
+		hash := sha512.Sum384(data)
+		return hash[:]
+	}
 	hash := sha256.Sum256(data)
-	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	return hash[:]
+}
+
+func SignECDSA(key *ecdsa.PrivateKey, data []byte) []byte {
+	hash := hashECDSA(key.Curve, data)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash)
 	util.CheckErr(err, "Could not sign data")
 	return signature
 }
 
 func VerifyECDSA(key *ecdsa.PublicKey, data []byte, signature []byte) bool {
-	hash := sha256.Sum256(data)
-	return ecdsa.VerifyASN1(key, hash[:], signature)
+	hash := hashECDSA(key.Curve, data)
+	return ecdsa.VerifyASN1(key, hash, signature)
 }
 
 func SignEd25519(key *ed25519.PrivateKey, data []byte) []byte {
@@ -115,6 +137,19 @@ func VerifyRSA(publicKey *rsa.PublicKey, data []byte, signature []byte) bool {
 	return err == nil
 }
 
+func SignRSAPKCS1v15(privateKey *rsa.PrivateKey, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	util.CheckErr(err, "Could not sign data with RSA")
+	return signature
+}
+
+func VerifyRSAPKCS1v15(publicKey *rsa.PublicKey, data []byte, signature []byte) bool {
+	digest := sha256.Sum256(data)
+	err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature)
+	return err == nil
+}
+
 type EncryptedBox struct {
 	Data []byte `cbor:"1,keyasint"`
 	IV   []byte `cbor:"2,keyasint"`
@@ -140,25 +175,39 @@ func HashSHA256(bytes []byte) []byte {
 }
 
 func EncryptAESCBC(key []byte, data []byte) []byte {
+	return EncryptAESCBCWithIV(key, make([]byte, aes.BlockSize), data)
+}
+
+func DecryptAESCBC(key []byte, data []byte) []byte {
+	return DecryptAESCBCWithIV(key, make([]byte, aes.BlockSize), data)
+}
+
+func EncryptAESCBCWithIV(key []byte, iv []byte, data []byte) []byte {
 	aesCipher, err := aes.NewCipher(key)
 	util.CheckErr(err, "Could not create AES cipher")
-	iv := make([]byte, aesCipher.BlockSize())
 	cbc := cipher.NewCBCEncrypter(aesCipher, iv)
 	encryptedData := make([]byte, len(data))
 	cbc.CryptBlocks(encryptedData, data)
 	return encryptedData
 }
 
-func DecryptAESCBC(key []byte, data []byte) []byte {
+func DecryptAESCBCWithIV(key []byte, iv []byte, data []byte) []byte {
 	aesCipher, err := aes.NewCipher(key)
 	util.CheckErr(err, "Could not create AES cipher")
-	iv := make([]byte, aesCipher.BlockSize())
 	cbc := cipher.NewCBCDecrypter(aesCipher, iv)
 	decryptedData := make([]byte, len(data))
 	cbc.CryptBlocks(decryptedData, data)
 	return decryptedData
 }
 
+func HKDFSHA256(secret []byte, salt []byte, info []byte, length int) []byte {
+	reader := hkdf.New(sha256.New, secret, salt, info)
+	key := make([]byte, length)
+	_, err := io.ReadFull(reader, key)
+	util.CheckErr(err, "Could not derive HKDF key")
+	return key
+}
+
 /* Note: This should be replaced once crypto/ecdh gets released (Go 1.20?) */
 type ECDHKey struct {
 	Priv []byte
@@ -173,7 +222,8 @@ func GenerateECDHKey() *ECDHKey {
 
 func (key *ECDHKey) ECDH(remoteX, remoteY *big.Int) []byte {
 	secret, _ := elliptic.P256().Params().ScalarMult(remoteX, remoteY, key.Priv)
-	return secret.Bytes()
+	// Shared secrets are derived from the full 32 byte x coordinate, including leading zeroes
+	return secret.FillBytes(make([]byte, 32))
 }
 
 func (key *ECDHKey) PublicKeyBytes() []byte {
@@ -0,0 +1,131 @@
+package ctap
+
+import (
+	"crypto/elliptic"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+)
+
+// Format identifiers that can be given in attestationFormatsPreference, in the order getInfo lists them
+var supportedAttestationFormats = []string{"packed", "fido-u2f", "none"}
+
+// Platforms may send longer preference lists, but only this many entries are looked at
+const maxAttestationFormatsPreference = 8
+
+// Covers every supported format, which each leave out the fields they don't use
+type attestationStatement struct {
+	Alg cose.COSEAlgorithmID `cbor:"alg,omitempty"`
+	Sig []byte               `cbor:"sig,omitempty"`
+	X5c [][]byte             `cbor:"x5c,omitempty"`
+}
+
+func attestationFormatIdentifier(format identities.AttestationFormat) string {
+	switch format {
+	case identities.AttestationFormatNone, identities.AttestationFormatAnonymized:
+		return "none"
+	case identities.AttestationFormatFIDOU2F:
+		return "fido-u2f"
+	default:
+		return "packed"
+	}
+}
+
+// Unattested credentials leave out the AAGUID, since it says what kind of authenticator made the credential
+func attestationAAGUID(format identities.AttestationFormat) [16]byte {
+	if format == identities.AttestationFormatNone || format == identities.AttestationFormatAnonymized {
+		return [16]byte{}
+	}
+	return aaguid
+}
+
+func isU2FCompatible(key *cose.SupportedCOSEPrivateKey) bool {
+	return key.ECDSA != nil && key.ECDSA.Curve == elliptic.P256()
+}
+
+// Picks the client's format for the relying party, unless the platform prefers one that reveals no more about the authenticator
+func (server *CTAPServer) selectAttestationFormat(rpID string, preference []string, credentialSource *identities.CredentialSource) identities.AttestationFormat {
+	format := server.client.AttestationFormat(rpID)
+	if len(preference) > maxAttestationFormatsPreference {
+		preference = preference[:maxAttestationFormatsPreference]
+	}
+	for _, identifier := range preference {
+		if identifier == attestationFormatIdentifier(format) {
+			break
+		}
+		if identifier == "none" {
+			// Platforms can always ask for less
+			format = identities.AttestationFormatNone
+			break
+		}
+		// Batch attestations can be given in either format, since both show the same certificate
+		if identifier == "fido-u2f" && format == identities.AttestationFormatPackedBatch {
+			format = identities.AttestationFormatFIDOU2F
+			break
+		}
+		if identifier == "packed" && format == identities.AttestationFormatFIDOU2F {
+			format = identities.AttestationFormatPackedBatch
+			break
+		}
+	}
+	if format == identities.AttestationFormatFIDOU2F && !isU2FCompatible(credentialSource.PrivateKey) {
+		// U2F attestations can only describe P-256 keys
+		ctapLogger.Printf("WARNING: Credential can't be given a fido-u2f attestation, using packed\n\n")
+		format = identities.AttestationFormatPackedBatch
+	}
+	return format
+}
+
+// Returns the statement for a new credential in the given format
+func (server *CTAPServer) attestCredential(
+	format identities.AttestationFormat,
+	rpID string,
+	credentialSource *identities.CredentialSource,
+	authenticatorData []byte,
+	clientDataHash []byte,
+	enterpriseAttestation bool) attestationStatement {
+	signedData := util.Concat(authenticatorData, clientDataHash)
+	if enterpriseAttestation {
+		// Enterprise attestations have to identify the authenticator, whatever the relying party's usual format is
+		attestationKey := server.client.AttestationPrivateKey()
+		return attestationStatement{
+			Alg: attestationKey.Algorithm(),
+			Sig: attestationKey.Sign(signedData),
+			X5c: [][]byte{server.client.CreateEnterpriseAttestationCertificate(attestationKey)},
+		}
+	}
+	switch format {
+	case identities.AttestationFormatNone, identities.AttestationFormatAnonymized:
+		return attestationStatement{}
+	case identities.AttestationFormatPackedSelf:
+		return attestationStatement{
+			Alg: credentialSource.PrivateKey.Algorithm(),
+			Sig: credentialSource.PrivateKey.Sign(signedData),
+		}
+	case identities.AttestationFormatFIDOU2F:
+		publicKey := credentialSource.PrivateKey.ECDSA.PublicKey
+		encodedPublicKey := elliptic.Marshal(elliptic.P256(), publicKey.X, publicKey.Y)
+		rpIDHash := crypto.HashSHA256([]byte(rpID))
+		attestationKey := server.client.AttestationPrivateKey()
+		return attestationStatement{
+			Sig: attestationKey.Sign(util.Concat([]byte{0x00}, rpIDHash, clientDataHash, credentialSource.ID, encodedPublicKey)),
+			X5c: [][]byte{server.client.CreateAttestationCertificiate(attestationKey)},
+		}
+	case identities.AttestationFormatPrivacyCA:
+		attestationKey := &cose.SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+		return attestationStatement{
+			Alg: attestationKey.Algorithm(),
+			Sig: attestationKey.Sign(signedData),
+			X5c: [][]byte{server.client.CreateAttestationCertificiate(attestationKey)},
+		}
+	default:
+		attestationKey := server.client.AttestationPrivateKey()
+		return attestationStatement{
+			Alg: attestationKey.Algorithm(),
+			Sig: attestationKey.Sign(signedData),
+			X5c: [][]byte{server.client.CreateAttestationCertificiate(attestationKey)},
+		}
+	}
+}
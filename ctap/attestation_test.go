@@ -0,0 +1,110 @@
+package ctap
+
+import (
+	"context"
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func makeAttestedCredential(t *testing.T, ctap *CTAPServer, rpID string, algorithm cose.COSEAlgorithmID, preference []string) (makeCredentialResponse, *identities.CredentialSource) {
+	args := makeCredentialArgs{
+		ClientDataHash:               crypto.HashSHA256([]byte("client data")),
+		RP:                           &webauthn.PublicKeyCredentialRPEntity{ID: rpID, Name: rpID},
+		User:                         &webauthn.PublicKeyCrendentialUserEntity{ID: []byte(rpID), Name: "Alice"},
+		PubKeyCredParams:             []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: algorithm}},
+		Options:                      &makeCredentialOptions{ResidentKey: true},
+		AttestationFormatsPreference: preference,
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+	var response makeCredentialResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	sources := ctap.client.GetAssertionSources(rpID, nil, false)
+	return response, sources[0]
+}
+
+func TestAttestationFormats(t *testing.T) {
+	client := &dummyCTAPClient{attestationFormats: map[string]identities.AttestationFormat{
+		"self.example":   identities.AttestationFormatPackedSelf,
+		"none.example":   identities.AttestationFormatNone,
+		"u2f.example":    identities.AttestationFormatFIDOU2F,
+		"u2f.ed.example": identities.AttestationFormatFIDOU2F,
+	}}
+	ctap := NewCTAPServer(client)
+	clientDataHash := crypto.HashSHA256([]byte("client data"))
+	batchKey := client.AttestationPrivateKey().Public()
+
+	response, _ := makeAttestedCredential(t, ctap, "batch.example", cose.COSE_ALGORITHM_ID_ES256, nil)
+	statement := response.AttestationStatement
+	test.AssertEqual(t, response.FormatIdentifer, "packed", "Batch attestation has the wrong format")
+	test.AssertEqual(t, statement.Alg, cose.COSE_ALGORITHM_ID_ES256, "Batch attestation has the wrong algorithm")
+	test.AssertArrEqual(t, statement.X5c[0], []byte("batch"), "Batch attestation has the wrong certificate")
+	test.Assert(t, batchKey.Verify(util.Concat(response.AuthData, clientDataHash), statement.Sig), "Batch attestation isn't signed by the batch key")
+
+	response, source := makeAttestedCredential(t, ctap, "self.example", cose.COSE_ALGORITHM_ID_ED25519, nil)
+	statement = response.AttestationStatement
+	test.AssertEqual(t, response.FormatIdentifer, "packed", "Self attestation has the wrong format")
+	test.AssertEqual(t, statement.Alg, cose.COSE_ALGORITHM_ID_ED25519, "Self attestation has the wrong algorithm")
+	test.AssertEqual(t, len(statement.X5c), 0, "Self attestation has a certificate")
+	test.Assert(t, source.PrivateKey.Public().Verify(util.Concat(response.AuthData, clientDataHash), statement.Sig), "Self attestation isn't signed by the credential")
+
+	response, _ = makeAttestedCredential(t, ctap, "none.example", cose.COSE_ALGORITHM_ID_ES256, nil)
+	test.AssertEqual(t, response.FormatIdentifer, "none", "None attestation has the wrong format")
+	test.Assert(t, response.AttestationStatement.Sig == nil && response.AttestationStatement.X5c == nil, "None attestation has a statement")
+	test.AssertArrEqual(t, response.AuthData[37:53], make([]byte, 16), "None attestation has an AAGUID")
+
+	response, source = makeAttestedCredential(t, ctap, "u2f.example", cose.COSE_ALGORITHM_ID_ES256, nil)
+	statement = response.AttestationStatement
+	test.AssertEqual(t, response.FormatIdentifer, "fido-u2f", "U2F attestation has the wrong format")
+	test.AssertEqual(t, statement.Alg, cose.COSEAlgorithmID(0), "U2F attestation has an algorithm")
+	publicKey := source.PrivateKey.ECDSA.PublicKey
+	signedData := util.Concat([]byte{0x00}, crypto.HashSHA256([]byte("u2f.example")), clientDataHash, source.ID, elliptic.Marshal(elliptic.P256(), publicKey.X, publicKey.Y))
+	test.Assert(t, batchKey.Verify(signedData, statement.Sig), "U2F attestation isn't signed by the batch key")
+
+	response, _ = makeAttestedCredential(t, ctap, "u2f.ed.example", cose.COSE_ALGORITHM_ID_ED25519, nil)
+	test.AssertEqual(t, response.FormatIdentifer, "packed", "Ed25519 credential given a U2F attestation")
+}
+
+func TestAttestationAnonymization(t *testing.T) {
+	client := &dummyCTAPClient{attestationFormats: map[string]identities.AttestationFormat{
+		"anonymized.example": identities.AttestationFormatAnonymized,
+		"privacy.example":    identities.AttestationFormatPrivacyCA,
+		"self.example":       identities.AttestationFormatPackedSelf,
+	}}
+	ctap := NewCTAPServer(client)
+	clientDataHash := crypto.HashSHA256([]byte("client data"))
+	// The AAGUID comes after the RP ID hash, flags and signature counter
+	credentialAAGUID := func(response makeCredentialResponse) []byte {
+		return response.AuthData[37:53]
+	}
+
+	response, _ := makeAttestedCredential(t, ctap, "anonymized.example", cose.COSE_ALGORITHM_ID_ES256, nil)
+	test.AssertEqual(t, response.FormatIdentifer, "none", "Anonymized attestation has the wrong format")
+	test.AssertArrEqual(t, credentialAAGUID(response), make([]byte, 16), "Anonymized attestation has an AAGUID")
+	response, _ = makeAttestedCredential(t, ctap, "anonymized.example", cose.COSE_ALGORITHM_ID_ES256, []string{"packed"})
+	test.AssertEqual(t, response.FormatIdentifer, "none", "Platform preference overrode anonymization")
+
+	response, _ = makeAttestedCredential(t, ctap, "privacy.example", cose.COSE_ALGORITHM_ID_ES256, nil)
+	statement := response.AttestationStatement
+	test.AssertEqual(t, response.FormatIdentifer, "packed", "Privacy CA attestation has the wrong format")
+	test.AssertArrEqual(t, credentialAAGUID(response), aaguid[:], "Privacy CA attestation has the wrong AAGUID")
+	test.AssertArrEqual(t, statement.X5c[0], []byte("batch"), "Privacy CA attestation has the wrong certificate")
+	test.Assert(t, !client.AttestationPrivateKey().Public().Verify(util.Concat(response.AuthData, clientDataHash), statement.Sig), "Privacy CA attestation is signed by the batch key")
+
+	response, _ = makeAttestedCredential(t, ctap, "batch.example", cose.COSE_ALGORITHM_ID_ES256, []string{"none"})
+	test.AssertEqual(t, response.FormatIdentifer, "none", "Platform could not ask for no attestation")
+	test.AssertArrEqual(t, credentialAAGUID(response), make([]byte, 16), "None attestation has an AAGUID")
+	response, _ = makeAttestedCredential(t, ctap, "batch.example", cose.COSE_ALGORITHM_ID_ES256, []string{"tpm", "fido-u2f", "packed"})
+	test.AssertEqual(t, response.FormatIdentifer, "fido-u2f", "Preferred format was not used")
+	response, _ = makeAttestedCredential(t, ctap, "self.example", cose.COSE_ALGORITHM_ID_ES256, []string{"fido-u2f"})
+	test.AssertEqual(t, response.FormatIdentifer, "packed", "Platform preference revealed more than self attestation")
+}
@@ -0,0 +1,140 @@
+package ctap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// PINs shorter than this are refused, unless setMinPINLength has raised the minimum
+const defaultMinPINLength = 4
+
+type authenticatorConfigSubcommand uint8
+
+const (
+	authenticatorConfigSubcommandEnableEnterpriseAttestation authenticatorConfigSubcommand = 0x01
+	authenticatorConfigSubcommandToggleAlwaysUV              authenticatorConfigSubcommand = 0x02
+	authenticatorConfigSubcommandSetMinPINLength             authenticatorConfigSubcommand = 0x03
+)
+
+var authenticatorConfigSubcommandDescriptions = map[authenticatorConfigSubcommand]string{
+	authenticatorConfigSubcommandEnableEnterpriseAttestation: "authenticatorConfigSubcommandEnableEnterpriseAttestation",
+	authenticatorConfigSubcommandToggleAlwaysUV:              "authenticatorConfigSubcommandToggleAlwaysUV",
+	authenticatorConfigSubcommandSetMinPINLength:             "authenticatorConfigSubcommandSetMinPINLength",
+}
+
+type authenticatorConfigArgs struct {
+	SubCommand authenticatorConfigSubcommand `cbor:"1,keyasint"`
+	// Kept raw, since the pinUvAuthParam is computed over the exact encoded bytes
+	SubCommandParams  cbor.RawMessage `cbor:"2,keyasint,omitempty"`
+	PINUVAuthProtocol uint32          `cbor:"3,keyasint,omitempty"`
+	PINUVAuthParam    []byte          `cbor:"4,keyasint,omitempty"`
+}
+
+func (args authenticatorConfigArgs) String() string {
+	return fmt.Sprintf("ctapAuthenticatorConfigArgs{SubCommand: %s, SubCommandParams: 0x%s, PinProtocol: %d, PINAuth: 0x%s}",
+		authenticatorConfigSubcommandDescriptions[args.SubCommand],
+		hex.EncodeToString(args.SubCommandParams),
+		args.PINUVAuthProtocol,
+		hex.EncodeToString(args.PINUVAuthParam))
+}
+
+type setMinPINLengthParams struct {
+	NewMinPINLength   uint32   `cbor:"1,keyasint,omitempty"`
+	MinPINLengthRPIDs []string `cbor:"2,keyasint,omitempty"`
+	ForceChangePIN    bool     `cbor:"3,keyasint,omitempty"`
+}
+
+func (server *CTAPServer) minPINLength() uint32 {
+	minPINLength := server.client.AuthenticatorConfig().MinPINLength
+	if minPINLength < defaultMinPINLength {
+		return defaultMinPINLength
+	}
+	return minPINLength
+}
+
+// The minimum PIN length is only given to relying parties that setMinPINLength allowed, or zero for the rest
+func (server *CTAPServer) minPINLengthForRelyingParty(rpID string) uint32 {
+	for _, allowedRPID := range server.client.AuthenticatorConfig().MinPINLengthRPIDs {
+		if allowedRPID == rpID {
+			return server.minPINLength()
+		}
+	}
+	return 0
+}
+
+// With alwaysUv on, every MakeCredential and GetAssertion has to come with a pinUvAuthToken
+func (server *CTAPServer) alwaysUVStatus() ctapStatusCode {
+	if server.client.PINHash() == nil {
+		// There's no way to verify the user until a PIN is set
+		return ctap2ErrNoPINSet
+	}
+	return ctap2ErrPINRequired
+}
+
+func (server *CTAPServer) handleAuthenticatorConfig(data []byte) []byte {
+	if !server.client.SupportsPIN() {
+		return []byte{byte(ctap1ErrInvalidCommand)}
+	}
+	var args authenticatorConfigArgs
+	err := cbor.Unmarshal(data, &args)
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return []byte{byte(ctap2ErrInvalidCBOR)}
+	}
+	ctapLogger.Printf("AUTHENTICATOR_CONFIG: %v\n\n", args)
+
+	config := server.client.AuthenticatorConfig()
+	// Built-in UV protects the config as much as a PIN does
+	if server.client.PINHash() != nil || server.userVerificationConfigured() || config.AlwaysUV {
+		message := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandAuthenticatorConfig), byte(args.SubCommand)}, args.SubCommandParams)
+		status := server.verifyPINUVAuthParam(args.PINUVAuthProtocol, args.PINUVAuthParam, message, pinUVAuthPermissionAuthenticatorConfig)
+		if status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: Authenticator config not authorized: %d\n\n", status)
+			return []byte{byte(status)}
+		}
+	}
+
+	switch args.SubCommand {
+	case authenticatorConfigSubcommandEnableEnterpriseAttestation:
+		config.EnterpriseAttestation = true
+	case authenticatorConfigSubcommandToggleAlwaysUV:
+		config.AlwaysUV = !config.AlwaysUV
+	case authenticatorConfigSubcommandSetMinPINLength:
+		var params setMinPINLengthParams
+		if args.SubCommandParams != nil {
+			err = cbor.Unmarshal(args.SubCommandParams, &params)
+			if err != nil {
+				ctapLogger.Printf("ERROR: %s", err)
+				return []byte{byte(ctap2ErrInvalidCBOR)}
+			}
+		}
+		if params.NewMinPINLength == 0 {
+			// Leaving the length out keeps the current minimum
+			params.NewMinPINLength = server.minPINLength()
+		}
+		if params.NewMinPINLength < server.minPINLength() {
+			// The minimum can only go up, so that a stolen token can't weaken the policy
+			return []byte{byte(ctap2ErrPINPolicyViolation)}
+		}
+		if params.ForceChangePIN && server.client.PINHash() == nil {
+			return []byte{byte(ctap2ErrNoPINSet)}
+		}
+		config.MinPINLength = params.NewMinPINLength
+		if params.MinPINLengthRPIDs != nil {
+			config.MinPINLengthRPIDs = params.MinPINLengthRPIDs
+		}
+		// PINs set before lengths were stored count as too short, since there's no way to check them
+		pinTooShort := server.client.PINHash() != nil && server.client.PINLength() < params.NewMinPINLength
+		config.ForcePINChange = config.ForcePINChange || params.ForceChangePIN || pinTooShort
+	default:
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	server.client.SetAuthenticatorConfig(config)
+	ctapLogger.Printf("AUTHENTICATOR_CONFIG UPDATED: %#v\n\n", config)
+	return []byte{byte(ctap1ErrSuccess)}
+}
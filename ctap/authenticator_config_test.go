@@ -0,0 +1,218 @@
+package ctap
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func authenticatorConfigRequest(ctap *CTAPServer, pinToken []byte, subCommand authenticatorConfigSubcommand, params interface{}) ctapStatusCode {
+	args := authenticatorConfigArgs{SubCommand: subCommand}
+	if params != nil {
+		args.SubCommandParams = util.MarshalCBOR(params)
+	}
+	if pinToken != nil {
+		message := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandAuthenticatorConfig), byte(subCommand)}, args.SubCommandParams)
+		args.PINUVAuthParam = getPINUVAuthProtocol(2).authenticate(pinToken, message)
+		args.PINUVAuthProtocol = 2
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandAuthenticatorConfig)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(responseBytes[0])
+}
+
+// Sets the first PIN through clientPIN, the way a platform would
+func requestSetPIN(t *testing.T, ctap *CTAPServer, pin string) ctapStatusCode {
+	protocol := getPINUVAuthProtocol(2)
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, 2)
+	paddedPIN := make([]byte, 64)
+	copy(paddedPIN, pin)
+	newPINEncoding := protocol.encrypt(sharedSecret, paddedPIN)
+	args := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand:        clientPINSubcommandSetPIN,
+		KeyAgreement:      keyAgreement,
+		NewPINEncoding:    newPINEncoding,
+		PINUVAuthParam:    protocol.authenticate(sharedSecret, newPINEncoding),
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(responseBytes[0])
+}
+
+func requestChangePIN(t *testing.T, ctap *CTAPServer, currentPIN string, newPIN string) ctapStatusCode {
+	protocol := getPINUVAuthProtocol(2)
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, 2)
+	paddedPIN := make([]byte, 64)
+	copy(paddedPIN, newPIN)
+	newPINEncoding := protocol.encrypt(sharedSecret, paddedPIN)
+	pinHashEncoding := protocol.encrypt(sharedSecret, crypto.HashSHA256([]byte(currentPIN))[:16])
+	args := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand:        clientPINSubcommandChangePIN,
+		KeyAgreement:      keyAgreement,
+		NewPINEncoding:    newPINEncoding,
+		PINHashEncoding:   pinHashEncoding,
+		PINUVAuthParam:    protocol.authenticate(sharedSecret, util.Concat(newPINEncoding, pinHashEncoding)),
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	return ctapStatusCode(responseBytes[0])
+}
+
+func getInfo(t *testing.T, ctap *CTAPServer) getInfoResponse {
+	responseBytes := ctap.HandleMessage(context.Background(), 0, []byte{byte(ctapCommandGetInfo)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not get info")
+	var response getInfoResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode info")
+	return response
+}
+
+func TestAuthenticatorConfig(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	test.AssertEqual(t, getInfo(t, ctap).MinPINLength, defaultMinPINLength, "Default minimum PIN length not reported")
+
+	// Without a PIN, there's nothing to authenticate with
+	status := authenticatorConfigRequest(ctap, nil, authenticatorConfigSubcommandSetMinPINLength, setMinPINLengthParams{NewMinPINLength: 8})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not set minimum PIN length")
+	test.AssertEqual(t, getInfo(t, ctap).MinPINLength, 8, "Minimum PIN length not reported")
+	test.AssertEqual(t, requestSetPIN(t, ctap, "123456"), ctap2ErrPINPolicyViolation, "PIN shorter than the minimum was set")
+	test.AssertEqual(t, requestSetPIN(t, ctap, "12345678"), ctap1ErrSuccess, "Could not set PIN")
+
+	status = authenticatorConfigRequest(ctap, nil, authenticatorConfigSubcommandToggleAlwaysUV, nil)
+	test.AssertEqual(t, status, ctap2ErrPINRequired, "Config changed without PIN token")
+	pinToken := getPINToken(t, ctap, 2, "12345678", pinUVAuthPermissionMakeCredential, "")
+	status = authenticatorConfigRequest(ctap, pinToken, authenticatorConfigSubcommandToggleAlwaysUV, nil)
+	test.AssertEqual(t, status, ctap2ErrPINAuthInvalid, "Config changed without the acfg permission")
+
+	pinToken = getPINToken(t, ctap, 2, "12345678", pinUVAuthPermissionAuthenticatorConfig, "")
+	status = authenticatorConfigRequest(ctap, pinToken, authenticatorConfigSubcommandSetMinPINLength, setMinPINLengthParams{NewMinPINLength: 6})
+	test.AssertEqual(t, status, ctap2ErrPINPolicyViolation, "Minimum PIN length was lowered")
+	status = authenticatorConfigRequest(ctap, pinToken, authenticatorConfigSubcommandEnableEnterpriseAttestation, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not enable enterprise attestation")
+	status = authenticatorConfigRequest(ctap, pinToken, authenticatorConfigSubcommandToggleAlwaysUV, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not toggle alwaysUv")
+	info := getInfo(t, ctap)
+	test.Assert(t, *info.Options.EnterpriseAttestation, "Enterprise attestation not reported")
+	test.Assert(t, *info.Options.AlwaysUV, "alwaysUv not reported")
+
+	args := getAssertionArgs{RPID: "rp", ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4})}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrPINRequired, "Assertion allowed without user verification")
+
+	responseBytes = ctap.HandleMessage(context.Background(), 0, []byte{byte(ctapCommandReset)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not reset")
+	info = getInfo(t, ctap)
+	test.Assert(t, !*info.Options.AlwaysUV, "alwaysUv not cleared by reset")
+	test.AssertEqual(t, info.MinPINLength, defaultMinPINLength, "Minimum PIN length not cleared by reset")
+}
+
+func TestAuthenticatorConfigWithBuiltInUV(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true, verifyUser: func(ctx context.Context, relyingPartyID string) bool { return true }}
+	ctap := NewCTAPServer(client)
+	// Built-in UV without a PIN still needs a token, or any host could change the config
+	for _, subCommand := range []authenticatorConfigSubcommand{
+		authenticatorConfigSubcommandEnableEnterpriseAttestation,
+		authenticatorConfigSubcommandToggleAlwaysUV,
+		authenticatorConfigSubcommandSetMinPINLength,
+	} {
+		status := authenticatorConfigRequest(ctap, nil, subCommand, nil)
+		test.AssertEqual(t, status, ctap2ErrPINRequired, "Config changed without a token while built-in UV is set up")
+	}
+	info := getInfo(t, ctap)
+	test.Assert(t, !*info.Options.EnterpriseAttestation, "Enterprise attestation enabled without a token")
+	test.Assert(t, !*info.Options.AlwaysUV, "alwaysUv toggled without a token")
+}
+
+func TestForcePINChange(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	test.AssertEqual(t, requestSetPIN(t, ctap, "1234"), ctap1ErrSuccess, "Could not set PIN")
+	test.AssertEqual(t, client.PINLength(), 4, "PIN length not stored")
+
+	// Raising the minimum past the current PIN's length forces a change
+	pinToken := getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionAuthenticatorConfig, "")
+	status := authenticatorConfigRequest(ctap, pinToken, authenticatorConfigSubcommandSetMinPINLength, setMinPINLengthParams{NewMinPINLength: 6, MinPINLengthRPIDs: []string{"rp"}})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not set minimum PIN length")
+	test.Assert(t, getInfo(t, ctap).ForcePINChange, "forcePINChange not reported")
+	_, status = requestPINToken(t, ctap, 2, "1234", pinUVAuthPermissionMakeCredential, "")
+	test.AssertEqual(t, status, ctap2ErrPINPolicyViolation, "PIN token given out before the PIN was changed")
+	test.AssertEqual(t, requestChangePIN(t, ctap, "1234", "12345"), ctap2ErrPINPolicyViolation, "New PIN shorter than the minimum was accepted")
+	test.AssertEqual(t, requestChangePIN(t, ctap, "1234", "123456"), ctap1ErrSuccess, "Could not change PIN")
+	test.Assert(t, !getInfo(t, ctap).ForcePINChange, "forcePINChange not cleared by changing the PIN")
+
+	pinToken = getPINToken(t, ctap, 2, "123456", pinUVAuthPermissionAuthenticatorConfig, "")
+	status = authenticatorConfigRequest(ctap, pinToken, authenticatorConfigSubcommandSetMinPINLength, setMinPINLengthParams{ForceChangePIN: true})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not force PIN change")
+	test.AssertEqual(t, requestChangePIN(t, ctap, "123456", "123456"), ctap2ErrPINPolicyViolation, "Forced change kept the same PIN")
+	test.AssertEqual(t, requestChangePIN(t, ctap, "123456", "654321"), ctap1ErrSuccess, "Could not change PIN")
+
+	for _, rpID := range []string{"rp", "other"} {
+		pinToken = getPINToken(t, ctap, 2, "654321", pinUVAuthPermissionMakeCredential, "")
+		clientDataHash := crypto.HashSHA256([]byte{0, 1, 2, 3, 4})
+		args := makeCredentialArgs{
+			ClientDataHash:    clientDataHash,
+			RP:                &webauthn.PublicKeyCredentialRPEntity{ID: rpID, Name: rpID},
+			User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			Extensions:        &makeCredentialExtensions{MinPINLength: true},
+			PINUVAuthParam:    getPINUVAuthProtocol(2).authenticate(pinToken, clientDataHash),
+			PINUVAuthProtocol: 2,
+		}
+		responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+		var response makeCredentialResponse
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Could not decode response")
+		hasOutput := bytes.HasSuffix(response.AuthData, util.MarshalCBOR(makeCredentialExtensionOutputs{MinPINLength: 6}))
+		test.AssertEqual(t, hasOutput, rpID == "rp", "minPinLength only goes to allowed relying parties")
+	}
+}
+
+func TestEnterpriseAttestation(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true, enterpriseAttestationRPIDs: []string{"corp"}}
+	ctap := NewCTAPServer(client)
+	makeCredential := func(rpID string, mode enterpriseAttestationMode) (makeCredentialResponse, ctapStatusCode) {
+		args := makeCredentialArgs{
+			ClientDataHash:        crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			RP:                    &webauthn.PublicKeyCredentialRPEntity{ID: rpID, Name: rpID},
+			User:                  &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams:      []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			EnterpriseAttestation: mode,
+		}
+		responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		var response makeCredentialResponse
+		if ctapStatusCode(responseBytes[0]) == ctap1ErrSuccess {
+			err := cbor.Unmarshal(responseBytes[1:], &response)
+			util.CheckErr(err, "Could not decode response")
+		}
+		return response, ctapStatusCode(responseBytes[0])
+	}
+
+	_, status := makeCredential("corp", enterpriseAttestationVendorFacilitated)
+	test.AssertEqual(t, status, ctap1ErrInvalidParameter, "Enterprise attestation given before it was enabled")
+	status = authenticatorConfigRequest(ctap, nil, authenticatorConfigSubcommandEnableEnterpriseAttestation, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not enable enterprise attestation")
+
+	response, status := makeCredential("corp", enterpriseAttestationVendorFacilitated)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not make credential")
+	test.Assert(t, response.EnterpriseAttestation, "epAtt not set for allowed relying party")
+	test.AssertArrEqual(t, response.AttestationStatement.X5c[0], []byte("enterprise"), "Enterprise certificate not used")
+	response, _ = makeCredential("rp", enterpriseAttestationVendorFacilitated)
+	test.Assert(t, !response.EnterpriseAttestation, "Enterprise attestation given to relying party that isn't allowed")
+	test.AssertArrEqual(t, response.AttestationStatement.X5c[0], []byte("batch"), "Enterprise certificate given to relying party that isn't allowed")
+	response, _ = makeCredential("corp", enterpriseAttestationPlatformManaged)
+	test.Assert(t, response.EnterpriseAttestation, "Platform-managed enterprise attestation not given")
+	response, status = makeCredential("rp", enterpriseAttestationPlatformManaged)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not make credential")
+	test.Assert(t, !response.EnterpriseAttestation, "Platform-managed enterprise attestation given to relying party that isn't allowed")
+	test.AssertArrEqual(t, response.AttestationStatement.X5c[0], []byte("batch"), "Enterprise certificate given to relying party that isn't allowed")
+	_, status = makeCredential("rp", 3)
+	test.AssertEqual(t, status, ctap2ErrInvalidOption, "Unknown enterprise attestation mode accepted")
+}
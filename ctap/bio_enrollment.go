@@ -0,0 +1,294 @@
+package ctap
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Good samples needed to enroll a finger
+const bioMaxCaptureSamples = 4
+
+const bioMaxEnrollments = 5
+
+// Longest friendly name, in bytes
+const bioMaxTemplateFriendlyName = 64
+
+const bioModalityFingerprint uint8 = 0x01
+
+const bioFingerprintKindTouch uint8 = 0x01
+
+// getInfo's uvModality bit for a fingerprint sensor
+const uvModalityFingerprint uint32 = 0x02
+
+// How a fingerprint sample went, which is reported to the platform during enrollment
+type BioEnrollmentSampleStatus uint8
+
+const (
+	BioEnrollmentSampleGood                     BioEnrollmentSampleStatus = 0x00
+	BioEnrollmentSampleTooHigh                  BioEnrollmentSampleStatus = 0x01
+	BioEnrollmentSampleTooLow                   BioEnrollmentSampleStatus = 0x02
+	BioEnrollmentSampleTooLeft                  BioEnrollmentSampleStatus = 0x03
+	BioEnrollmentSampleTooRight                 BioEnrollmentSampleStatus = 0x04
+	BioEnrollmentSampleTooFast                  BioEnrollmentSampleStatus = 0x05
+	BioEnrollmentSampleTooSlow                  BioEnrollmentSampleStatus = 0x06
+	BioEnrollmentSamplePoorQuality              BioEnrollmentSampleStatus = 0x07
+	BioEnrollmentSampleTooSkewed                BioEnrollmentSampleStatus = 0x08
+	BioEnrollmentSampleTooShort                 BioEnrollmentSampleStatus = 0x09
+	BioEnrollmentSampleMergeFailure             BioEnrollmentSampleStatus = 0x0A
+	BioEnrollmentSampleExists                   BioEnrollmentSampleStatus = 0x0B
+	BioEnrollmentSampleNoUserActivity           BioEnrollmentSampleStatus = 0x0D
+	BioEnrollmentSampleNoUserPresenceTransition BioEnrollmentSampleStatus = 0x0E
+)
+
+// A fingerprint sensor, where each call stands for a finger touching it
+type BioSensor interface {
+	// Returns how a sample for the enrollment in progress went. Only good samples count towards the enrollment.
+	// Like the other prompts, ctx is cancelled when the platform cancels the request.
+	CaptureEnrollmentSample(ctx context.Context) BioEnrollmentSampleStatus
+	// Returns the template ID of the enrolled finger that touched the sensor, or nil if it didn't match any of them
+	MatchFingerprint(ctx context.Context, enrollments []identities.BioEnrollment) []byte
+}
+
+type bioEnrollmentSubcommand uint8
+
+const (
+	bioEnrollmentSubcommandEnrollBegin              bioEnrollmentSubcommand = 0x01
+	bioEnrollmentSubcommandEnrollCaptureNextSample  bioEnrollmentSubcommand = 0x02
+	bioEnrollmentSubcommandCancelCurrentEnrollment  bioEnrollmentSubcommand = 0x03
+	bioEnrollmentSubcommandEnumerateEnrollments     bioEnrollmentSubcommand = 0x04
+	bioEnrollmentSubcommandSetFriendlyName          bioEnrollmentSubcommand = 0x05
+	bioEnrollmentSubcommandRemoveEnrollment         bioEnrollmentSubcommand = 0x06
+	bioEnrollmentSubcommandGetFingerprintSensorInfo bioEnrollmentSubcommand = 0x07
+)
+
+var bioEnrollmentSubcommandDescriptions = map[bioEnrollmentSubcommand]string{
+	bioEnrollmentSubcommandEnrollBegin:              "bioEnrollmentSubcommandEnrollBegin",
+	bioEnrollmentSubcommandEnrollCaptureNextSample:  "bioEnrollmentSubcommandEnrollCaptureNextSample",
+	bioEnrollmentSubcommandCancelCurrentEnrollment:  "bioEnrollmentSubcommandCancelCurrentEnrollment",
+	bioEnrollmentSubcommandEnumerateEnrollments:     "bioEnrollmentSubcommandEnumerateEnrollments",
+	bioEnrollmentSubcommandSetFriendlyName:          "bioEnrollmentSubcommandSetFriendlyName",
+	bioEnrollmentSubcommandRemoveEnrollment:         "bioEnrollmentSubcommandRemoveEnrollment",
+	bioEnrollmentSubcommandGetFingerprintSensorInfo: "bioEnrollmentSubcommandGetFingerprintSensorInfo",
+}
+
+type bioEnrollmentArgs struct {
+	Modality   uint8                   `cbor:"1,keyasint,omitempty"`
+	SubCommand bioEnrollmentSubcommand `cbor:"2,keyasint,omitempty"`
+	// Kept raw, since the pinUvAuthParam is computed over the exact encoded bytes
+	SubCommandParams  cbor.RawMessage `cbor:"3,keyasint,omitempty"`
+	PINUVAuthProtocol uint32          `cbor:"4,keyasint,omitempty"`
+	PINUVAuthParam    []byte          `cbor:"5,keyasint,omitempty"`
+	GetModality       bool            `cbor:"6,keyasint,omitempty"`
+}
+
+func (args bioEnrollmentArgs) String() string {
+	return fmt.Sprintf("ctapBioEnrollmentArgs{Modality: %d, SubCommand: %s, SubCommandParams: 0x%s, PinProtocol: %d, PINAuth: 0x%s, GetModality: %t}",
+		args.Modality,
+		bioEnrollmentSubcommandDescriptions[args.SubCommand],
+		hex.EncodeToString(args.SubCommandParams),
+		args.PINUVAuthProtocol,
+		hex.EncodeToString(args.PINUVAuthParam),
+		args.GetModality)
+}
+
+type bioEnrollmentParams struct {
+	TemplateID           []byte `cbor:"1,keyasint,omitempty"`
+	TemplateFriendlyName string `cbor:"2,keyasint,omitempty"`
+	// Samples are captured as soon as they're asked for, so there's nothing to time out
+	TimeoutMilliseconds uint32 `cbor:"3,keyasint,omitempty"`
+}
+
+type bioEnrollmentTemplateInfo struct {
+	TemplateID           []byte `cbor:"1,keyasint"`
+	TemplateFriendlyName string `cbor:"2,keyasint,omitempty"`
+}
+
+type bioEnrollmentResponse struct {
+	Modality                           uint8                       `cbor:"1,keyasint,omitempty"`
+	FingerprintKind                    uint8                       `cbor:"2,keyasint,omitempty"`
+	MaxCaptureSamplesRequiredForEnroll uint32                      `cbor:"3,keyasint,omitempty"`
+	TemplateID                         []byte                      `cbor:"4,keyasint,omitempty"`
+	LastEnrollSampleStatus             *BioEnrollmentSampleStatus  `cbor:"5,keyasint,omitempty"`
+	RemainingSamples                   *uint32                     `cbor:"6,keyasint,omitempty"`
+	TemplateInfos                      []bioEnrollmentTemplateInfo `cbor:"7,keyasint,omitempty"`
+	MaxTemplateFriendlyName            uint32                      `cbor:"8,keyasint,omitempty"`
+}
+
+// A finger partway through being enrolled, which only gets stored once it has enough good samples
+type bioEnrollmentInProgress struct {
+	templateID       []byte
+	remainingSamples uint32
+}
+
+func (server *CTAPServer) fingerprintEnrolled() bool {
+	return server.client.BioSensor() != nil && len(server.client.BioEnrollments()) > 0
+}
+
+// Touches the sensor, returning whether the finger matched one of the enrolled ones
+func (server *CTAPServer) matchFingerprint(ctx context.Context) bool {
+	enrollments := server.client.BioEnrollments()
+	templateID := server.client.BioSensor().MatchFingerprint(ctx, enrollments)
+	if templateID == nil {
+		return false
+	}
+	for _, enrollment := range enrollments {
+		if bytes.Equal(enrollment.TemplateID, templateID) {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *CTAPServer) handleBioEnrollment(ctx context.Context, data []byte) []byte {
+	sensor := server.client.BioSensor()
+	if sensor == nil || !server.client.SupportsPIN() {
+		return []byte{byte(ctap1ErrInvalidCommand)}
+	}
+	var args bioEnrollmentArgs
+	err := cbor.Unmarshal(data, &args)
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return []byte{byte(ctap2ErrInvalidCBOR)}
+	}
+	ctapLogger.Printf("BIO_ENROLLMENT: %v\n\n", args)
+
+	if args.GetModality {
+		return bioEnrollmentSuccess(bioEnrollmentResponse{Modality: bioModalityFingerprint})
+	}
+	if args.Modality != bioModalityFingerprint {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	// These don't change any enrollments, so they don't need a pinUvAuthToken
+	switch args.SubCommand {
+	case bioEnrollmentSubcommandGetFingerprintSensorInfo:
+		return bioEnrollmentSuccess(bioEnrollmentResponse{
+			FingerprintKind:                    bioFingerprintKindTouch,
+			MaxCaptureSamplesRequiredForEnroll: bioMaxCaptureSamples,
+			MaxTemplateFriendlyName:            bioMaxTemplateFriendlyName,
+		})
+	case bioEnrollmentSubcommandCancelCurrentEnrollment:
+		server.bioEnrollment = nil
+		return []byte{byte(ctap1ErrSuccess)}
+	}
+
+	message := util.Concat([]byte{args.Modality, byte(args.SubCommand)}, args.SubCommandParams)
+	status := server.verifyPINUVAuthParam(args.PINUVAuthProtocol, args.PINUVAuthParam, message, pinUVAuthPermissionBioEnrollment)
+	if status != ctap1ErrSuccess {
+		ctapLogger.Printf("ERROR: Bio enrollment not authorized: %d\n\n", status)
+		return []byte{byte(status)}
+	}
+	var params bioEnrollmentParams
+	if args.SubCommandParams != nil {
+		err = cbor.Unmarshal(args.SubCommandParams, &params)
+		if err != nil {
+			ctapLogger.Printf("ERROR: %s", err)
+			return []byte{byte(ctap2ErrInvalidCBOR)}
+		}
+	}
+
+	enrollments := server.client.BioEnrollments()
+	switch args.SubCommand {
+	case bioEnrollmentSubcommandEnrollBegin:
+		if len(enrollments) >= bioMaxEnrollments {
+			return []byte{byte(ctap2ErrFPDatabaseFull)}
+		}
+		templateID := crypto.RandomBytes(16)
+		server.bioEnrollment = &bioEnrollmentInProgress{templateID: templateID, remainingSamples: bioMaxCaptureSamples}
+		response, status := server.captureEnrollmentSample(ctx, sensor)
+		if status != ctap1ErrSuccess {
+			return []byte{byte(status)}
+		}
+		response.TemplateID = templateID
+		return bioEnrollmentSuccess(response)
+	case bioEnrollmentSubcommandEnrollCaptureNextSample:
+		if server.bioEnrollment == nil || !bytes.Equal(params.TemplateID, server.bioEnrollment.templateID) {
+			return []byte{byte(ctap1ErrInvalidParameter)}
+		}
+		response, status := server.captureEnrollmentSample(ctx, sensor)
+		if status != ctap1ErrSuccess {
+			return []byte{byte(status)}
+		}
+		return bioEnrollmentSuccess(response)
+	case bioEnrollmentSubcommandEnumerateEnrollments:
+		if len(enrollments) == 0 {
+			return []byte{byte(ctap2ErrInvalidOption)}
+		}
+		templateInfos := make([]bioEnrollmentTemplateInfo, 0, len(enrollments))
+		for _, enrollment := range enrollments {
+			templateInfos = append(templateInfos, bioEnrollmentTemplateInfo{TemplateID: enrollment.TemplateID, TemplateFriendlyName: enrollment.FriendlyName})
+		}
+		return bioEnrollmentSuccess(bioEnrollmentResponse{TemplateInfos: templateInfos})
+	case bioEnrollmentSubcommandSetFriendlyName:
+		if params.TemplateID == nil || params.TemplateFriendlyName == "" {
+			return []byte{byte(ctap2ErrMissingParam)}
+		}
+		if len(params.TemplateFriendlyName) > bioMaxTemplateFriendlyName {
+			return []byte{byte(ctap1ErrInvalidParameter)}
+		}
+		updated := make([]identities.BioEnrollment, len(enrollments))
+		copy(updated, enrollments)
+		for i := range updated {
+			if bytes.Equal(updated[i].TemplateID, params.TemplateID) {
+				updated[i].FriendlyName = params.TemplateFriendlyName
+				server.client.SetBioEnrollments(updated)
+				return []byte{byte(ctap1ErrSuccess)}
+			}
+		}
+		return []byte{byte(ctap2ErrInvalidOption)}
+	case bioEnrollmentSubcommandRemoveEnrollment:
+		if params.TemplateID == nil {
+			return []byte{byte(ctap2ErrMissingParam)}
+		}
+		remaining := make([]identities.BioEnrollment, 0, len(enrollments))
+		for _, enrollment := range enrollments {
+			if !bytes.Equal(enrollment.TemplateID, params.TemplateID) {
+				remaining = append(remaining, enrollment)
+			}
+		}
+		if len(remaining) == len(enrollments) {
+			return []byte{byte(ctap2ErrInvalidOption)}
+		}
+		server.client.SetBioEnrollments(remaining)
+		return []byte{byte(ctap1ErrSuccess)}
+	default:
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+}
+
+// Touches the sensor for the enrollment in progress, storing the finger once it has enough good samples.
+// Cancelling drops the enrollment, since the platform has to start over anyway.
+func (server *CTAPServer) captureEnrollmentSample(ctx context.Context, sensor BioSensor) (bioEnrollmentResponse, ctapStatusCode) {
+	enrollment := server.bioEnrollment
+	status := sensor.CaptureEnrollmentSample(ctx)
+	if ctx.Err() != nil {
+		server.bioEnrollment = nil
+		return bioEnrollmentResponse{}, ctap2ErrKeepaliveCancel
+	}
+	if status == BioEnrollmentSampleGood {
+		enrollment.remainingSamples--
+	}
+	if enrollment.remainingSamples == 0 {
+		server.bioEnrollment = nil
+		enrollments := append([]identities.BioEnrollment{}, server.client.BioEnrollments()...)
+		server.client.SetBioEnrollments(append(enrollments, identities.BioEnrollment{TemplateID: enrollment.templateID}))
+		ctapLogger.Printf("BIO_ENROLLMENT: Enrolled template 0x%s\n\n", hex.EncodeToString(enrollment.templateID))
+	}
+	remainingSamples := enrollment.remainingSamples
+	return bioEnrollmentResponse{
+		LastEnrollSampleStatus: &status,
+		RemainingSamples:       &remainingSamples,
+	}, ctap1ErrSuccess
+}
+
+func bioEnrollmentSuccess(response bioEnrollmentResponse) []byte {
+	ctapLogger.Printf("BIO_ENROLLMENT RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
@@ -0,0 +1,112 @@
+package ctap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type scriptedBioSensor struct {
+	samples []BioEnrollmentSampleStatus
+	touch   []byte
+}
+
+func (sensor *scriptedBioSensor) CaptureEnrollmentSample(ctx context.Context) BioEnrollmentSampleStatus {
+	if len(sensor.samples) == 0 {
+		return BioEnrollmentSampleGood
+	}
+	status := sensor.samples[0]
+	sensor.samples = sensor.samples[1:]
+	return status
+}
+
+func (sensor *scriptedBioSensor) MatchFingerprint(ctx context.Context, enrollments []identities.BioEnrollment) []byte {
+	return sensor.touch
+}
+
+func bioEnrollmentRequest(ctap *CTAPServer, pinToken []byte, subCommand bioEnrollmentSubcommand, params *bioEnrollmentParams) (bioEnrollmentResponse, ctapStatusCode) {
+	args := bioEnrollmentArgs{Modality: bioModalityFingerprint, SubCommand: subCommand}
+	if params != nil {
+		args.SubCommandParams = util.MarshalCBOR(params)
+	}
+	if pinToken != nil {
+		message := util.Concat([]byte{bioModalityFingerprint, byte(subCommand)}, args.SubCommandParams)
+		args.PINUVAuthParam = getPINUVAuthProtocol(2).authenticate(pinToken, message)
+		args.PINUVAuthProtocol = 2
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandBioEnrollment)}, util.MarshalCBOR(args)))
+	var response bioEnrollmentResponse
+	if ctapStatusCode(responseBytes[0]) == ctap1ErrSuccess && len(responseBytes) > 1 {
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Could not decode bio enrollment response")
+	}
+	return response, ctapStatusCode(responseBytes[0])
+}
+
+func TestBioEnrollment(t *testing.T) {
+	sensor := &scriptedBioSensor{samples: []BioEnrollmentSampleStatus{BioEnrollmentSampleTooHigh}}
+	client := &dummyCTAPClient{supportsPIN: true, bioSensor: sensor}
+	client.SetUVRetries(uvMaxRetries)
+	ctap := NewCTAPServer(client)
+	info := getInfo(t, ctap)
+	test.Assert(t, info.Options.HasBioEnrollment != nil && !*info.Options.HasBioEnrollment, "bioEnroll option not false before enrollment")
+	test.Assert(t, info.Options.CanUserVerification != nil && !*info.Options.CanUserVerification, "uv option not false before enrollment")
+	test.AssertEqual(t, info.UVModality, uvModalityFingerprint, "Fingerprint modality not reported")
+
+	response, status := bioEnrollmentRequest(ctap, nil, bioEnrollmentSubcommandGetFingerprintSensorInfo, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not get sensor info")
+	test.AssertEqual(t, response.MaxCaptureSamplesRequiredForEnroll, uint32(bioMaxCaptureSamples), "Wrong number of samples reported")
+	_, status = bioEnrollmentRequest(ctap, nil, bioEnrollmentSubcommandEnrollBegin, nil)
+	test.AssertEqual(t, status, ctap2ErrPINRequired, "Enrollment began without a PIN token")
+
+	setPIN(client, "1234")
+	pinToken := getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionBioEnrollment, "")
+	response, status = bioEnrollmentRequest(ctap, pinToken, bioEnrollmentSubcommandEnrollBegin, &bioEnrollmentParams{})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not begin enrollment")
+	test.AssertEqual(t, *response.LastEnrollSampleStatus, BioEnrollmentSampleTooHigh, "Scripted sample status not reported")
+	test.AssertEqual(t, *response.RemainingSamples, uint32(bioMaxCaptureSamples), "Bad sample counted towards enrollment")
+	templateID := response.TemplateID
+	for remaining := bioMaxCaptureSamples - 1; remaining >= 0; remaining-- {
+		response, status = bioEnrollmentRequest(ctap, pinToken, bioEnrollmentSubcommandEnrollCaptureNextSample, &bioEnrollmentParams{TemplateID: templateID})
+		test.AssertEqual(t, status, ctap1ErrSuccess, "Could not capture sample")
+		test.AssertEqual(t, *response.RemainingSamples, uint32(remaining), "Wrong number of remaining samples")
+	}
+	test.Assert(t, *getInfo(t, ctap).Options.CanUserVerification, "uv option not true after enrollment")
+
+	_, status = bioEnrollmentRequest(ctap, pinToken, bioEnrollmentSubcommandSetFriendlyName, &bioEnrollmentParams{TemplateID: templateID, TemplateFriendlyName: "Thumb"})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not set friendly name")
+	response, status = bioEnrollmentRequest(ctap, pinToken, bioEnrollmentSubcommandEnumerateEnrollments, nil)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not enumerate enrollments")
+	test.AssertEqual(t, len(response.TemplateInfos), 1, "Wrong number of enrollments")
+	test.AssertArrEqual(t, response.TemplateInfos[0].TemplateID, templateID, "Wrong template enrolled")
+	test.AssertEqual(t, response.TemplateInfos[0].TemplateFriendlyName, "Thumb", "Friendly name not stored")
+
+	makeCredential := func() ctapStatusCode {
+		args := makeCredentialArgs{
+			ClientDataHash:   crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+			User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			Options:          &makeCredentialOptions{UserVerification: true},
+		}
+		return ctapStatusCode(ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))[0])
+	}
+	sensor.touch = templateID
+	test.AssertEqual(t, makeCredential(), ctap1ErrSuccess, "Enrolled finger was not accepted")
+	sensor.touch = nil
+	test.AssertEqual(t, makeCredential(), ctap2ErrUVInvalid, "Unknown finger was accepted")
+
+	_, status = bioEnrollmentRequest(ctap, pinToken, bioEnrollmentSubcommandRemoveEnrollment, &bioEnrollmentParams{TemplateID: []byte("unknown")})
+	test.AssertEqual(t, status, ctap2ErrInvalidOption, "Unknown enrollment was removed")
+	_, status = bioEnrollmentRequest(ctap, pinToken, bioEnrollmentSubcommandRemoveEnrollment, &bioEnrollmentParams{TemplateID: templateID})
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not remove enrollment")
+	_, status = bioEnrollmentRequest(ctap, pinToken, bioEnrollmentSubcommandEnumerateEnrollments, nil)
+	test.AssertEqual(t, status, ctap2ErrInvalidOption, "Enrollments listed after removing them all")
+}
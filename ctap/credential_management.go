@@ -0,0 +1,324 @@
+package ctap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// The vault has no fixed capacity, so this is what's reported to platforms as the limit
+const maxResidentCredentials = 256
+
+type credentialManagementSubcommand uint8
+
+const (
+	credentialManagementSubcommandGetCredsMetadata                      credentialManagementSubcommand = 0x01
+	credentialManagementSubcommandEnumerateRPsBegin                     credentialManagementSubcommand = 0x02
+	credentialManagementSubcommandEnumerateRPsGetNextRP                 credentialManagementSubcommand = 0x03
+	credentialManagementSubcommandEnumerateCredentialsBegin             credentialManagementSubcommand = 0x04
+	credentialManagementSubcommandEnumerateCredentialsGetNextCredential credentialManagementSubcommand = 0x05
+	credentialManagementSubcommandDeleteCredential                      credentialManagementSubcommand = 0x06
+	credentialManagementSubcommandUpdateUserInformation                 credentialManagementSubcommand = 0x07
+)
+
+var credentialManagementSubcommandDescriptions = map[credentialManagementSubcommand]string{
+	credentialManagementSubcommandGetCredsMetadata:                      "credentialManagementSubcommandGetCredsMetadata",
+	credentialManagementSubcommandEnumerateRPsBegin:                     "credentialManagementSubcommandEnumerateRPsBegin",
+	credentialManagementSubcommandEnumerateRPsGetNextRP:                 "credentialManagementSubcommandEnumerateRPsGetNextRP",
+	credentialManagementSubcommandEnumerateCredentialsBegin:             "credentialManagementSubcommandEnumerateCredentialsBegin",
+	credentialManagementSubcommandEnumerateCredentialsGetNextCredential: "credentialManagementSubcommandEnumerateCredentialsGetNextCredential",
+	credentialManagementSubcommandDeleteCredential:                      "credentialManagementSubcommandDeleteCredential",
+	credentialManagementSubcommandUpdateUserInformation:                 "credentialManagementSubcommandUpdateUserInformation",
+}
+
+type credentialManagementArgs struct {
+	SubCommand credentialManagementSubcommand `cbor:"1,keyasint"`
+	// Kept raw, since the pinUvAuthParam is computed over the exact encoded bytes
+	SubCommandParams  cbor.RawMessage `cbor:"2,keyasint,omitempty"`
+	PINUVAuthProtocol uint32          `cbor:"3,keyasint,omitempty"`
+	PINUVAuthParam    []byte          `cbor:"4,keyasint,omitempty"`
+}
+
+func (args credentialManagementArgs) String() string {
+	return fmt.Sprintf("ctapCredentialManagementArgs{SubCommand: %s, SubCommandParams: 0x%s, PinProtocol: %d, PINAuth: 0x%s}",
+		credentialManagementSubcommandDescriptions[args.SubCommand],
+		hex.EncodeToString(args.SubCommandParams),
+		args.PINUVAuthProtocol,
+		hex.EncodeToString(args.PINUVAuthParam))
+}
+
+type credentialManagementParams struct {
+	RPIDHash     []byte                                   `cbor:"1,keyasint,omitempty"`
+	CredentialID *webauthn.PublicKeyCredentialDescriptor  `cbor:"2,keyasint,omitempty"`
+	User         *webauthn.PublicKeyCrendentialUserEntity `cbor:"3,keyasint,omitempty"`
+}
+
+type credentialManagementResponse struct {
+	ExistingResidentCredentialsCount             *uint32                                  `cbor:"1,keyasint,omitempty"`
+	MaxPossibleRemainingResidentCredentialsCount *uint32                                  `cbor:"2,keyasint,omitempty"`
+	RP                                           *webauthn.PublicKeyCredentialRPEntity    `cbor:"3,keyasint,omitempty"`
+	RPIDHash                                     []byte                                   `cbor:"4,keyasint,omitempty"`
+	TotalRPs                                     uint32                                   `cbor:"5,keyasint,omitempty"`
+	User                                         *webauthn.PublicKeyCrendentialUserEntity `cbor:"6,keyasint,omitempty"`
+	CredentialID                                 *webauthn.PublicKeyCredentialDescriptor  `cbor:"7,keyasint,omitempty"`
+	PublicKey                                    cbor.RawMessage                          `cbor:"8,keyasint,omitempty"`
+	TotalCredentials                             uint32                                   `cbor:"9,keyasint,omitempty"`
+	CredProtect                                  webauthn.CredentialProtection            `cbor:"10,keyasint,omitempty"`
+	LargeBlobKey                                 []byte                                   `cbor:"11,keyasint,omitempty"`
+}
+
+// Remaining relying parties or credentials from an enumeration, returned one by one through the GetNext subcommands
+type credentialManagementIterator struct {
+	relyingParties []*webauthn.PublicKeyCredentialRPEntity
+	credentials    []identities.CredentialSource
+}
+
+func (server *CTAPServer) setCredentialManagementIterator(channelID uint32, iterator *credentialManagementIterator) {
+	server.iteratorsLock.Lock()
+	defer server.iteratorsLock.Unlock()
+	if iterator == nil {
+		delete(server.credentialManagementIterators, channelID)
+	} else {
+		server.credentialManagementIterators[channelID] = iterator
+	}
+}
+
+func (server *CTAPServer) takeNextRelyingParty(channelID uint32) *webauthn.PublicKeyCredentialRPEntity {
+	server.iteratorsLock.Lock()
+	defer server.iteratorsLock.Unlock()
+	iterator, ok := server.credentialManagementIterators[channelID]
+	if !ok || len(iterator.relyingParties) == 0 {
+		return nil
+	}
+	relyingParty := iterator.relyingParties[0]
+	iterator.relyingParties = iterator.relyingParties[1:]
+	return relyingParty
+}
+
+func (server *CTAPServer) takeNextCredential(channelID uint32) *identities.CredentialSource {
+	server.iteratorsLock.Lock()
+	defer server.iteratorsLock.Unlock()
+	iterator, ok := server.credentialManagementIterators[channelID]
+	if !ok || len(iterator.credentials) == 0 {
+		return nil
+	}
+	credential := iterator.credentials[0]
+	iterator.credentials = iterator.credentials[1:]
+	return &credential
+}
+
+func (server *CTAPServer) handleCredentialManagement(channelID uint32, data []byte) []byte {
+	if !server.client.SupportsPIN() {
+		return []byte{byte(ctap1ErrInvalidCommand)}
+	}
+	var args credentialManagementArgs
+	err := cbor.Unmarshal(data, &args)
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return []byte{byte(ctap2ErrInvalidCBOR)}
+	}
+	var params credentialManagementParams
+	if args.SubCommandParams != nil {
+		err = cbor.Unmarshal(args.SubCommandParams, &params)
+		if err != nil {
+			ctapLogger.Printf("ERROR: %s", err)
+			return []byte{byte(ctap2ErrInvalidCBOR)}
+		}
+	}
+	ctapLogger.Printf("CREDENTIAL_MANAGEMENT: %v\n\n", args)
+
+	// The GetNext subcommands continue an enumeration that was already authorized
+	if args.SubCommand != credentialManagementSubcommandEnumerateRPsGetNextRP &&
+		args.SubCommand != credentialManagementSubcommandEnumerateCredentialsGetNextCredential {
+		message := util.Concat([]byte{byte(args.SubCommand)}, args.SubCommandParams)
+		status := server.verifyPINUVAuthParam(args.PINUVAuthProtocol, args.PINUVAuthParam, message, pinUVAuthPermissionCredentialManagement)
+		if status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: Credential management not authorized: %d\n\n", status)
+			return []byte{byte(status)}
+		}
+	}
+
+	var response []byte
+	switch args.SubCommand {
+	case credentialManagementSubcommandGetCredsMetadata:
+		response = server.handleGetCredsMetadata()
+	case credentialManagementSubcommandEnumerateRPsBegin:
+		response = server.handleEnumerateRPsBegin(channelID)
+	case credentialManagementSubcommandEnumerateRPsGetNextRP:
+		response = server.handleEnumerateRPsGetNextRP(channelID)
+	case credentialManagementSubcommandEnumerateCredentialsBegin:
+		response = server.handleEnumerateCredentialsBegin(channelID, params)
+	case credentialManagementSubcommandEnumerateCredentialsGetNextCredential:
+		response = server.handleEnumerateCredentialsGetNextCredential(channelID)
+	case credentialManagementSubcommandDeleteCredential:
+		response = server.handleDeleteCredential(params)
+	case credentialManagementSubcommandUpdateUserInformation:
+		response = server.handleUpdateUserInformation(params)
+	default:
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	ctapLogger.Printf("CREDENTIAL_MANAGEMENT RESPONSE: %#v\n\n", response)
+	return response
+}
+
+func (server *CTAPServer) handleGetCredsMetadata() []byte {
+	if server.pinToken.rpID != "" {
+		// Tokens bound to a relying party can't see the other relying parties' credentials
+		return []byte{byte(ctap2ErrPINAuthInvalid)}
+	}
+	existing := uint32(len(server.residentCredentials()))
+	var remaining uint32 = 0
+	if existing < maxResidentCredentials {
+		remaining = maxResidentCredentials - existing
+	}
+	response := credentialManagementResponse{
+		ExistingResidentCredentialsCount:             &existing,
+		MaxPossibleRemainingResidentCredentialsCount: &remaining,
+	}
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+func relyingPartyResponse(relyingParty *webauthn.PublicKeyCredentialRPEntity) credentialManagementResponse {
+	relyingPartyIDHash := sha256.Sum256([]byte(relyingParty.ID))
+	return credentialManagementResponse{
+		RP:       relyingParty,
+		RPIDHash: relyingPartyIDHash[:],
+	}
+}
+
+func (server *CTAPServer) handleEnumerateRPsBegin(channelID uint32) []byte {
+	if server.pinToken.rpID != "" {
+		return []byte{byte(ctap2ErrPINAuthInvalid)}
+	}
+	relyingParties := make([]*webauthn.PublicKeyCredentialRPEntity, 0)
+	seen := make(map[string]bool)
+	for _, source := range server.residentCredentials() {
+		if !seen[source.RelyingParty.ID] {
+			seen[source.RelyingParty.ID] = true
+			relyingParties = append(relyingParties, source.RelyingParty)
+		}
+	}
+	if len(relyingParties) == 0 {
+		return []byte{byte(ctap2ErrNoCredentials)}
+	}
+	response := relyingPartyResponse(relyingParties[0])
+	response.TotalRPs = uint32(len(relyingParties))
+	server.setCredentialManagementIterator(channelID, &credentialManagementIterator{relyingParties: relyingParties[1:]})
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+func (server *CTAPServer) handleEnumerateRPsGetNextRP(channelID uint32) []byte {
+	relyingParty := server.takeNextRelyingParty(channelID)
+	if relyingParty == nil {
+		return []byte{byte(ctap2ErrNotAllowed)}
+	}
+	response := relyingPartyResponse(relyingParty)
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+func credentialResponse(credential *identities.CredentialSource) credentialManagementResponse {
+	descriptor := credential.CTAPDescriptor()
+	return credentialManagementResponse{
+		User:         credential.User,
+		CredentialID: &descriptor,
+		PublicKey:    cose.MarshalCOSEPublicKey(credential.PrivateKey.Public()),
+		CredProtect:  credential.Protection,
+		LargeBlobKey: credential.LargeBlobKey,
+	}
+}
+
+func (server *CTAPServer) handleEnumerateCredentialsBegin(channelID uint32, params credentialManagementParams) []byte {
+	if params.RPIDHash == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
+	if server.pinToken.rpID != "" {
+		tokenRPIDHash := sha256.Sum256([]byte(server.pinToken.rpID))
+		if !bytes.Equal(tokenRPIDHash[:], params.RPIDHash) {
+			return []byte{byte(ctap2ErrPINAuthInvalid)}
+		}
+	}
+	credentials := make([]identities.CredentialSource, 0)
+	for _, source := range server.residentCredentials() {
+		relyingPartyIDHash := sha256.Sum256([]byte(source.RelyingParty.ID))
+		if bytes.Equal(relyingPartyIDHash[:], params.RPIDHash) {
+			credentials = append(credentials, source)
+		}
+	}
+	if len(credentials) == 0 {
+		return []byte{byte(ctap2ErrNoCredentials)}
+	}
+	response := credentialResponse(&credentials[0])
+	response.TotalCredentials = uint32(len(credentials))
+	server.setCredentialManagementIterator(channelID, &credentialManagementIterator{credentials: credentials[1:]})
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+func (server *CTAPServer) handleEnumerateCredentialsGetNextCredential(channelID uint32) []byte {
+	credential := server.takeNextCredential(channelID)
+	if credential == nil {
+		return []byte{byte(ctap2ErrNotAllowed)}
+	}
+	response := credentialResponse(credential)
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+func (server *CTAPServer) handleDeleteCredential(params credentialManagementParams) []byte {
+	if params.CredentialID == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
+	source := server.findIdentity(params.CredentialID.ID)
+	if source == nil {
+		return []byte{byte(ctap2ErrNoCredentials)}
+	}
+	if !server.pinToken.permitsRelyingParty(source.RelyingParty.ID) {
+		return []byte{byte(ctap2ErrPINAuthInvalid)}
+	}
+	server.client.DeleteIdentity(source.ID)
+	return []byte{byte(ctap1ErrSuccess)}
+}
+
+func (server *CTAPServer) handleUpdateUserInformation(params credentialManagementParams) []byte {
+	if params.CredentialID == nil || params.User == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
+	source := server.findIdentity(params.CredentialID.ID)
+	if source == nil {
+		return []byte{byte(ctap2ErrNoCredentials)}
+	}
+	if !server.pinToken.permitsRelyingParty(source.RelyingParty.ID) {
+		return []byte{byte(ctap2ErrPINAuthInvalid)}
+	}
+	if !bytes.Equal(source.User.ID, params.User.ID) {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	server.client.UpdateIdentityUser(source.ID, params.User)
+	return []byte{byte(ctap1ErrSuccess)}
+}
+
+// Only resident credentials can be managed, since the rest are only stored because they can't be sealed
+func (server *CTAPServer) residentCredentials() []identities.CredentialSource {
+	credentials := make([]identities.CredentialSource, 0)
+	for _, source := range server.client.Identities() {
+		if !source.NonDiscoverable {
+			credentials = append(credentials, source)
+		}
+	}
+	return credentials
+}
+
+func (server *CTAPServer) findIdentity(id []byte) *identities.CredentialSource {
+	for _, source := range server.residentCredentials() {
+		if bytes.Equal(source.ID, id) {
+			return &source
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package ctap
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func credentialManagementMessage(pinToken []byte, subCommand credentialManagementSubcommand, params *credentialManagementParams) []byte {
+	args := credentialManagementArgs{SubCommand: subCommand}
+	if params != nil {
+		args.SubCommandParams = util.MarshalCBOR(params)
+	}
+	if pinToken != nil {
+		message := util.Concat([]byte{byte(subCommand)}, args.SubCommandParams)
+		args.PINUVAuthProtocol = 2
+		args.PINUVAuthParam = pinUVAuthProtocolTwo{}.authenticate(pinToken, message)
+	}
+	return util.Concat([]byte{byte(ctapCommandCredentialManagement)}, util.MarshalCBOR(args))
+}
+
+func credentialManagementRequest(t *testing.T, ctap *CTAPServer, message []byte) credentialManagementResponse {
+	responseBytes := ctap.HandleMessage(context.Background(), 0, message)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Credential management failed")
+	var response credentialManagementResponse
+	if len(responseBytes) > 1 {
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Invalid credential management response")
+	}
+	return response
+}
+
+func TestCredentialManagement(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	alice := client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256,
+		&webauthn.PublicKeyCredentialRPEntity{ID: "a.example", Name: "A"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice", DisplayName: "Alice"})
+	client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256,
+		&webauthn.PublicKeyCredentialRPEntity{ID: "a.example", Name: "A"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "bob", DisplayName: "Bob"})
+	client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256,
+		&webauthn.PublicKeyCredentialRPEntity{ID: "b.example", Name: "B"},
+		&webauthn.PublicKeyCrendentialUserEntity{ID: []byte{3}, Name: "carol", DisplayName: "Carol"})
+	setPIN(client, "1234")
+	pinToken := getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionCredentialManagement, "")
+
+	metadata := credentialManagementRequest(t, ctap, credentialManagementMessage(pinToken, credentialManagementSubcommandGetCredsMetadata, nil))
+	test.AssertEqual(t, *metadata.ExistingResidentCredentialsCount, uint32(3), "Wrong credential count")
+
+	rps := credentialManagementRequest(t, ctap, credentialManagementMessage(pinToken, credentialManagementSubcommandEnumerateRPsBegin, nil))
+	test.AssertEqual(t, rps.TotalRPs, uint32(2), "Wrong RP count")
+	test.AssertEqual(t, rps.RP.ID, "a.example", "Wrong first RP")
+	nextRP := credentialManagementRequest(t, ctap, credentialManagementMessage(nil, credentialManagementSubcommandEnumerateRPsGetNextRP, nil))
+	test.AssertEqual(t, nextRP.RP.ID, "b.example", "Wrong second RP")
+	responseBytes := ctap.HandleMessage(context.Background(), 0, credentialManagementMessage(nil, credentialManagementSubcommandEnumerateRPsGetNextRP, nil))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNotAllowed, "Enumerated past the last RP")
+
+	params := &credentialManagementParams{RPIDHash: rps.RPIDHash}
+	credentials := credentialManagementRequest(t, ctap, credentialManagementMessage(pinToken, credentialManagementSubcommandEnumerateCredentialsBegin, params))
+	test.AssertEqual(t, credentials.TotalCredentials, uint32(2), "Wrong credential count for RP")
+	test.AssertEqual(t, credentials.User.Name, "alice", "Wrong first credential")
+	test.Assert(t, len(credentials.PublicKey) > 0, "Missing public key")
+	nextCredential := credentialManagementRequest(t, ctap, credentialManagementMessage(nil, credentialManagementSubcommandEnumerateCredentialsGetNextCredential, nil))
+	test.AssertEqual(t, nextCredential.User.Name, "bob", "Wrong second credential")
+
+	descriptor := alice.CTAPDescriptor()
+	params = &credentialManagementParams{
+		CredentialID: &descriptor,
+		User:         &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "alice2", DisplayName: "Alice Two"},
+	}
+	credentialManagementRequest(t, ctap, credentialManagementMessage(pinToken, credentialManagementSubcommandUpdateUserInformation, params))
+	test.AssertEqual(t, client.vault.CredentialSources[0].User.Name, "alice2", "User was not updated")
+
+	params = &credentialManagementParams{CredentialID: &descriptor}
+	credentialManagementRequest(t, ctap, credentialManagementMessage(pinToken, credentialManagementSubcommandDeleteCredential, params))
+	test.AssertEqual(t, len(client.vault.CredentialSources), 2, "Credential was not deleted")
+}
+
+func TestCredentialManagementRequiresPINToken(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	setPIN(client, "1234")
+
+	responseBytes := ctap.HandleMessage(context.Background(), 0, credentialManagementMessage(nil, credentialManagementSubcommandGetCredsMetadata, nil))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrPINRequired, "Missing PIN token was accepted")
+	responseBytes = ctap.HandleMessage(context.Background(), 0, credentialManagementMessage(make([]byte, 32), credentialManagementSubcommandGetCredsMetadata, nil))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrPINAuthInvalid, "Wrong PIN token was accepted")
+}
@@ -2,10 +2,14 @@ package ctap
 
 import (
 	"bytes"
-	"crypto/hmac"
+	"context"
+	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
@@ -24,21 +28,31 @@ var aaguid = [16]byte{117, 108, 90, 245, 236, 166, 1, 163, 47, 198, 211, 12, 226
 type ctapCommand uint8
 
 const (
-	ctapCommandMakeCredential   ctapCommand = 0x01
-	ctapCommandGetAssertion     ctapCommand = 0x02
-	ctapCommandGetInfo          ctapCommand = 0x04
-	ctapCommandClientPIN        ctapCommand = 0x06
-	ctapCommandReset            ctapCommand = 0x07
-	ctapCommandGetNextAssertion ctapCommand = 0x08
+	ctapCommandMakeCredential       ctapCommand = 0x01
+	ctapCommandGetAssertion         ctapCommand = 0x02
+	ctapCommandGetInfo              ctapCommand = 0x04
+	ctapCommandClientPIN            ctapCommand = 0x06
+	ctapCommandReset                ctapCommand = 0x07
+	ctapCommandGetNextAssertion     ctapCommand = 0x08
+	ctapCommandBioEnrollment        ctapCommand = 0x09
+	ctapCommandCredentialManagement ctapCommand = 0x0A
+	ctapCommandSelection            ctapCommand = 0x0B
+	ctapCommandLargeBlobs           ctapCommand = 0x0C
+	ctapCommandAuthenticatorConfig  ctapCommand = 0x0D
 )
 
 var ctapCommandDescriptions = map[ctapCommand]string{
-	ctapCommandMakeCredential:   "ctapCommandMakeCredential",
-	ctapCommandGetAssertion:     "ctapCommandGetAssertion",
-	ctapCommandGetInfo:          "ctapCommandGetInfo",
-	ctapCommandClientPIN:        "ctapCommandClientPIN",
-	ctapCommandReset:            "ctapCommandReset",
-	ctapCommandGetNextAssertion: "ctapCommandGetNextAssertion",
+	ctapCommandMakeCredential:       "ctapCommandMakeCredential",
+	ctapCommandGetAssertion:         "ctapCommandGetAssertion",
+	ctapCommandGetInfo:              "ctapCommandGetInfo",
+	ctapCommandClientPIN:            "ctapCommandClientPIN",
+	ctapCommandReset:                "ctapCommandReset",
+	ctapCommandGetNextAssertion:     "ctapCommandGetNextAssertion",
+	ctapCommandBioEnrollment:        "ctapCommandBioEnrollment",
+	ctapCommandCredentialManagement: "ctapCommandCredentialManagement",
+	ctapCommandSelection:            "ctapCommandSelection",
+	ctapCommandLargeBlobs:           "ctapCommandLargeBlobs",
+	ctapCommandAuthenticatorConfig:  "ctapCommandAuthenticatorConfig",
 }
 
 type ctapStatusCode byte
@@ -52,65 +66,225 @@ const (
 	ctap1ErrTimeout          ctapStatusCode = 0x05
 	ctap1ErrChannelBusy      ctapStatusCode = 0x06
 
-	ctap2ErrUnsupportedAlgorithm ctapStatusCode = 0x26
-	ctap2ErrInvalidCBOR          ctapStatusCode = 0x12
-	ctap2ErrNoCredentials        ctapStatusCode = 0x2E
-	ctap2ErrOperationDenied      ctapStatusCode = 0x27
-	ctap2ErrMissingParam         ctapStatusCode = 0x14
-	ctap2ErrPINInvalid           ctapStatusCode = 0x31
-	ctap2ErrPINBlocked           ctapStatusCode = 0x32
-	ctap2ErrPINAuthInvalid       ctapStatusCode = 0x33
-	ctap2ErrNoPINSet             ctapStatusCode = 0x35
-	ctap2ErrPINRequired          ctapStatusCode = 0x36
-	ctap2ErrPINPolicyViolation   ctapStatusCode = 0x37
-	ctap2ErrPINExpired           ctapStatusCode = 0x38
+	ctap2ErrUnsupportedAlgorithm   ctapStatusCode = 0x26
+	ctap2ErrInvalidCBOR            ctapStatusCode = 0x12
+	ctap2ErrFPDatabaseFull         ctapStatusCode = 0x17
+	ctap2ErrLargeBlobStorageFull   ctapStatusCode = 0x18
+	ctap2ErrCredentialExcluded     ctapStatusCode = 0x19
+	ctap2ErrKeepaliveCancel        ctapStatusCode = 0x2D
+	ctap2ErrNoCredentials          ctapStatusCode = 0x2E
+	ctap2ErrOperationDenied        ctapStatusCode = 0x27
+	ctap2ErrUserActionTimeout      ctapStatusCode = 0x2F
+	ctap2ErrNotAllowed             ctapStatusCode = 0x30
+	ctap2ErrMissingParam           ctapStatusCode = 0x14
+	ctap2ErrUnsupportedOption      ctapStatusCode = 0x2B
+	ctap2ErrInvalidOption          ctapStatusCode = 0x2C
+	ctap2ErrPINInvalid             ctapStatusCode = 0x31
+	ctap2ErrPINBlocked             ctapStatusCode = 0x32
+	ctap2ErrPINAuthInvalid         ctapStatusCode = 0x33
+	ctap2ErrPINAuthBlocked         ctapStatusCode = 0x34
+	ctap2ErrNoPINSet               ctapStatusCode = 0x35
+	ctap2ErrPINRequired            ctapStatusCode = 0x36
+	ctap2ErrPINPolicyViolation     ctapStatusCode = 0x37
+	ctap2ErrPINExpired             ctapStatusCode = 0x38
+	ctap2ErrUVBlocked              ctapStatusCode = 0x3C
+	ctap2ErrIntegrityFailure       ctapStatusCode = 0x3D
+	ctap2ErrUVInvalid              ctapStatusCode = 0x3F
+	ctap2ErrUnauthorizedPermission ctapStatusCode = 0x40
 )
 
+// Built-in user verification, like a passphrase prompt or an OS-level check, which sets the UV flag without a PIN
+type UserVerifier interface {
+	// Whether a verification method is set up, which getInfo reports as the uv option
+	SupportsUserVerification() bool
+	// Asks the user to verify themselves for the relying party, returning whether they did.
+	// ctx is cancelled when the platform cancels the request, so the prompt should be dismissed.
+	VerifyUser(ctx context.Context, relyingPartyID string) bool
+}
+
 type CTAPClient interface {
+	UserVerifier
+
 	SupportsResidentKey() bool
 	SupportsPIN() bool
 
-	NewCredentialSource(
-		PubKeyCredParams []webauthn.PublicKeyCredentialParams,
-		ExcludeList []webauthn.PublicKeyCredentialDescriptor,
-		relyingParty *webauthn.PublicKeyCredentialRPEntity,
-		user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource
-	GetAssertionSource(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource
+	// Stores a new resident credential
+	AddCredentialSource(source *identities.CredentialSource)
+	// Returns the credential sources usable for an assertion, most recently created first.
+	// Credentials that credProtect hides for the user's verification state must be left out.
+	GetAssertionSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor, userVerified bool) []*identities.CredentialSource
+	IncrementSignatureCounter(credentialSource *identities.CredentialSource)
 	CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte
+	// Format of the attestation given to the relying party for new credentials
+	AttestationFormat(relyingPartyID string) identities.AttestationFormat
+	// Key shared by a batch of authenticators, which signs attestations that don't use the credential's own key
+	AttestationPrivateKey() *cose.SupportedCOSEPrivateKey
+	// Relying parties that may get an enterprise attestation, which identifies this specific authenticator
+	EnterpriseAttestationRPIDs() []string
+	CreateEnterpriseAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey) []byte
+
+	// Used to seal non-resident credentials into their credential IDs, which have no stored counter
+	SealingEncryptionKey() []byte
+	NewAuthenticationCounterId() uint32
 
 	PINHash() []byte
 	SetPINHash(pin []byte)
 	PINRetries() int32
+	// Retries have to persist across restarts, so that power cycling doesn't allow more PIN guesses
 	SetPINRetries(retries int32)
-	PINKeyAgreement() *crypto.ECDHKey
-	PINToken() []byte
+	// Like the PIN retries, these have to persist so that failed verifications can't be retried forever
+	UVRetries() int32
+	SetUVRetries(retries int32)
+	// Length of the PIN in code points, or zero if it isn't known
+	PINLength() uint32
+	SetPINLength(length uint32)
+
+	// Used by credential management to list and edit resident credentials
+	Identities() []identities.CredentialSource
+	DeleteIdentity(id []byte) bool
+	UpdateIdentityUser(id []byte, user *webauthn.PublicKeyCrendentialUserEntity) bool
+
+	// The serialized large blob array, or nil if one has never been written
+	LargeBlobs() []byte
+	SetLargeBlobs(data []byte)
+
+	// Approvals wait on the user, so ctx is cancelled if the platform gives up on the request first
+	ApproveAccountCreation(ctx context.Context, relyingParty string) bool
+	ApproveAccountLogin(ctx context.Context, credentialSource *identities.CredentialSource) bool
+	ApproveReset(ctx context.Context) bool
+	// Asks the user to touch this authenticator, when the platform has several to pick from
+	ApproveSelection(ctx context.Context) bool
+
+	// Nil unless the authenticator has a fingerprint sensor
+	BioSensor() BioSensor
+	// Fingerprints enrolled through bioEnrollment, which have to persist across restarts
+	BioEnrollments() []identities.BioEnrollment
+	SetBioEnrollments(enrollments []identities.BioEnrollment)
+
+	// Settings from authenticatorConfig, which have to persist across restarts
+	AuthenticatorConfig() identities.AuthenticatorConfig
+	SetAuthenticatorConfig(config identities.AuthenticatorConfig)
+
+	// Wipes all credentials, large blobs, fingerprints, settings and the PIN
+	Reset()
+}
+
+// Reset is only allowed within this window after the authenticator powers up
+const ctapResetWindow = 10 * time.Second
+
+// Pending credentials from a GetAssertion are discarded if GetNextAssertion isn't called within this window
+const ctapGetNextAssertionTimeout = 30 * time.Second
+
+// Credential algorithms the authenticator can create, in the order they're advertised
+var supportedAlgorithms = []cose.COSEAlgorithmID{
+	cose.COSE_ALGORITHM_ID_ES256,
+	cose.COSE_ALGORITHM_ID_ED25519,
+	cose.COSE_ALGORITHM_ID_ES384,
+	cose.COSE_ALGORITHM_ID_PS256,
+	cose.COSE_ALGORITHM_ID_RS256,
+}
 
-	ApproveAccountCreation(relyingParty string) bool
-	ApproveAccountLogin(credentialSource *identities.CredentialSource) bool
+func isRSAAlgorithm(algorithm cose.COSEAlgorithmID) bool {
+	return algorithm == cose.COSE_ALGORITHM_ID_PS256 || algorithm == cose.COSE_ALGORITHM_ID_RS256
+}
+
+// Picks the first algorithm in the RP's order of preference that the authenticator supports
+func selectAlgorithm(params []webauthn.PublicKeyCredentialParams) (cose.COSEAlgorithmID, bool) {
+	for _, param := range params {
+		if param.Type != "public-key" {
+			continue
+		}
+		for _, algorithm := range supportedAlgorithms {
+			if param.Algorithm == algorithm {
+				return algorithm, true
+			}
+		}
+	}
+	return 0, false
 }
 
 type CTAPServer struct {
-	client CTAPClient
+	client      CTAPClient
+	powerUpTime time.Time
+
+	// Held while a command runs, since channels share the PIN token, PIN policy and pending writes.
+	// Commands on other channels are turned away rather than left waiting on a prompt.
+	busyLock  *sync.Mutex
+	pinToken  *pinUVAuthToken
+	pinPolicy *pinPolicy
+
+	iteratorsLock                 sync.Locker
+	assertionIterators            map[uint32]*assertionIterator
+	credentialManagementIterators map[uint32]*credentialManagementIterator
+
+	// Nil unless a large blob array is partway through being written
+	largeBlobWrite *largeBlobWrite
+	// Nil unless a finger is partway through being enrolled
+	bioEnrollment *bioEnrollmentInProgress
 }
 
+// Creating a server counts as powering up the authenticator, which clears PIN lockouts and pending state
 func NewCTAPServer(client CTAPClient) *CTAPServer {
-	return &CTAPServer{client: client}
+	return &CTAPServer{
+		client:                        client,
+		powerUpTime:                   time.Now(),
+		busyLock:                      &sync.Mutex{},
+		pinToken:                      newPINUVAuthToken(),
+		pinPolicy:                     newPINPolicy(client),
+		iteratorsLock:                 &sync.Mutex{},
+		assertionIterators:            make(map[uint32]*assertionIterator),
+		credentialManagementIterators: make(map[uint32]*credentialManagementIterator),
+	}
 }
 
-func (server *CTAPServer) HandleMessage(data []byte) []byte {
+func (server *CTAPServer) HandleMessage(ctx context.Context, channelID uint32, data []byte) []byte {
+	if len(data) == 0 {
+		ctapLogger.Printf("ERROR: Empty CTAP message\n\n")
+		return []byte{byte(ctap1ErrInvalidLength)}
+	}
 	command := ctapCommand(data[0])
 	ctapLogger.Printf("CTAP COMMAND: %s\n\n", ctapCommandDescriptions[command])
+	if command != ctapCommandSelection {
+		// Selection only asks the user, so it can run alongside a command on another channel
+		if !server.busyLock.TryLock() {
+			ctapLogger.Printf("ERROR: Busy with a command on another channel\n\n")
+			return []byte{byte(ctap1ErrChannelBusy)}
+		}
+		defer server.busyLock.Unlock()
+	}
+	if command != ctapCommandGetNextAssertion {
+		// Any other command ends the pending GetAssertion on this channel
+		server.setAssertionIterator(channelID, nil)
+	}
+	if command != ctapCommandCredentialManagement {
+		server.setCredentialManagementIterator(channelID, nil)
+	}
 	switch command {
 	case ctapCommandMakeCredential:
-		return server.handleMakeCredential(data[1:])
+		return server.handleMakeCredential(ctx, data[1:])
 	case ctapCommandGetInfo:
 		return server.handleGetInfo()
 	case ctapCommandGetAssertion:
-		return server.handleGetAssertion(data[1:])
+		return server.handleGetAssertion(ctx, channelID, data[1:])
+	case ctapCommandGetNextAssertion:
+		return server.handleGetNextAssertion(channelID)
 	case ctapCommandClientPIN:
-		return server.handleClientPIN(data[1:])
+		return server.handleClientPIN(ctx, data[1:])
+	case ctapCommandReset:
+		return server.handleReset(ctx)
+	case ctapCommandBioEnrollment:
+		return server.handleBioEnrollment(ctx, data[1:])
+	case ctapCommandCredentialManagement:
+		return server.handleCredentialManagement(channelID, data[1:])
+	case ctapCommandSelection:
+		return server.handleSelection(ctx)
+	case ctapCommandLargeBlobs:
+		return server.handleLargeBlobs(data[1:])
+	case ctapCommandAuthenticatorConfig:
+		return server.handleAuthenticatorConfig(data[1:])
 	default:
-		panic(fmt.Sprintf("Invalid CTAP Command: %d", command))
+		ctapLogger.Printf("ERROR: Invalid CTAP Command: %d\n\n", command)
+		return []byte{byte(ctap1ErrInvalidCommand)}
 	}
 }
 
@@ -136,30 +310,96 @@ type authData struct {
 	AttestedCredentialData *attestedCredentialData
 }
 
-type selfAttestationStatement struct {
-	Alg cose.COSEAlgorithmID `cbor:"alg"`
-	Sig []byte               `cbor:"sig"`
-}
-
-type basicAttestationStatement struct {
-	Alg cose.COSEAlgorithmID `cbor:"alg"`
-	Sig []byte               `cbor:"sig"`
-	X5c [][]byte             `cbor:"x5c"`
-}
-
-func makeAttestedCredentialData(credentialSource *identities.CredentialSource) []byte {
+func makeAttestedCredentialData(credentialSource *identities.CredentialSource, credentialAAGUID [16]byte) []byte {
 	encodedCredentialPublicKey := cose.MarshalCOSEPublicKey(credentialSource.PrivateKey.Public())
-	return util.Concat(aaguid[:], util.ToBE(uint16(len(credentialSource.ID))), credentialSource.ID, encodedCredentialPublicKey)
+	return util.Concat(credentialAAGUID[:], util.ToBE(uint16(len(credentialSource.ID))), credentialSource.ID, encodedCredentialPublicKey)
 }
 
-func makeAuthData(rpID string, credentialSource *identities.CredentialSource, attestedCredentialData []byte, flags authDataFlags) []byte {
+func makeAuthData(rpID string, credentialSource *identities.CredentialSource, attestedCredentialData []byte, extensions []byte, flags authDataFlags) []byte {
 	if attestedCredentialData != nil {
 		flags = flags | authDataFlagAttestedDataIncluded
 	} else {
 		attestedCredentialData = []byte{}
 	}
+	if extensions != nil {
+		flags = flags | authDataFlagExtensionDataIncluded
+	} else {
+		extensions = []byte{}
+	}
 	rpIdHash := sha256.Sum256([]byte(rpID))
-	return util.Concat(rpIdHash[:], []byte{uint8(flags)}, util.ToBE(credentialSource.SignatureCounter), attestedCredentialData)
+	return util.Concat(rpIdHash[:], []byte{uint8(flags)}, util.ToBE(credentialSource.SignatureCounter), attestedCredentialData, extensions)
+}
+
+// Non-resident credentials aren't stored, so their key is sealed into the credential ID instead
+func (server *CTAPServer) sealCredentialID(relyingPartyID string, credentialSource *identities.CredentialSource) []byte {
+	relyingPartyIDHash := sha256.Sum256([]byte(relyingPartyID))
+	keyHandle := webauthn.KeyHandle{
+		PrivateKey:          cose.MarshalCOSEPrivateKey(credentialSource.PrivateKey),
+		ApplicationID:       relyingPartyIDHash[:],
+		CredRandomWithUV:    credentialSource.CredRandomWithUV,
+		CredRandomWithoutUV: credentialSource.CredRandomWithoutUV,
+		Protection:          credentialSource.Protection,
+		CredBlob:            credentialSource.CredBlob,
+	}
+	box := crypto.Seal(server.client.SealingEncryptionKey(), util.MarshalCBOR(keyHandle))
+	return util.MarshalCBOR(box)
+}
+
+func (server *CTAPServer) openCredentialID(relyingPartyID string, credentialID []byte) *identities.CredentialSource {
+	var box crypto.EncryptedBox
+	err := cbor.Unmarshal(credentialID, &box)
+	if err != nil {
+		return nil
+	}
+	// Credential IDs from other authenticators are expected here, so failing to open one isn't fatal
+	data, err := crypto.Decrypt(server.client.SealingEncryptionKey(), box.Data, box.IV)
+	if err != nil {
+		return nil
+	}
+	var keyHandle webauthn.KeyHandle
+	err = cbor.Unmarshal(data, &keyHandle)
+	if err != nil {
+		return nil
+	}
+	relyingPartyIDHash := sha256.Sum256([]byte(relyingPartyID))
+	if !bytes.Equal(keyHandle.ApplicationID, relyingPartyIDHash[:]) {
+		return nil
+	}
+	privateKey, err := keyHandle.DecodePrivateKey()
+	if err != nil {
+		ctapLogger.Printf("ERROR: Could not decode sealed credential: %s\n\n", err)
+		return nil
+	}
+	return &identities.CredentialSource{
+		Type:                "public-key",
+		ID:                  credentialID,
+		PrivateKey:          privateKey,
+		RelyingParty:        &webauthn.PublicKeyCredentialRPEntity{ID: relyingPartyID, Name: relyingPartyID},
+		User:                &webauthn.PublicKeyCrendentialUserEntity{},
+		CredRandomWithUV:    keyHandle.CredRandomWithUV,
+		CredRandomWithoutUV: keyHandle.CredRandomWithoutUV,
+		Protection:          keyHandle.Protection,
+		CredBlob:            keyHandle.CredBlob,
+	}
+}
+
+func (server *CTAPServer) openAllowedCredentials(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor, userVerified bool) []*identities.CredentialSource {
+	sources := make([]*identities.CredentialSource, 0)
+	for _, descriptor := range allowList {
+		source := server.openCredentialID(relyingPartyID, descriptor.ID)
+		if source != nil && source.Usable(userVerified, true) {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// Credentials hidden by credProtect don't count, so that excludeList can't be used to find them either
+func (server *CTAPServer) hasExcludedCredential(relyingPartyID string, excludeList []webauthn.PublicKeyCredentialDescriptor, userVerified bool) bool {
+	if len(server.client.GetAssertionSources(relyingPartyID, excludeList, userVerified)) > 0 {
+		return true
+	}
+	return len(server.openAllowedCredentials(relyingPartyID, excludeList, userVerified)) > 0
 }
 
 type makeCredentialOptions struct {
@@ -169,19 +409,21 @@ type makeCredentialOptions struct {
 }
 
 type makeCredentialArgs struct {
-	ClientDataHash    []byte                                   `cbor:"1,keyasint,omitempty"`
-	RP                *webauthn.PublicKeyCredentialRPEntity    `cbor:"2,keyasint,omitempty"`
-	User              *webauthn.PublicKeyCrendentialUserEntity `cbor:"3,keyasint,omitempty"`
-	PubKeyCredParams  []webauthn.PublicKeyCredentialParams     `cbor:"4,keyasint,omitempty"`
-	ExcludeList       []webauthn.PublicKeyCredentialDescriptor `cbor:"5,keyasint,omitempty"`
-	Extensions        map[string]interface{}                   `cbor:"6,keyasint,omitempty"`
-	Options           *makeCredentialOptions                   `cbor:"7,keyasint,omitempty"`
-	PINUVAuthParam    []byte                                   `cbor:"8,keyasint,omitempty"`
-	PINUVAuthProtocol uint32                                   `cbor:"9,keyasint,omitempty"`
+	ClientDataHash               []byte                                   `cbor:"1,keyasint,omitempty"`
+	RP                           *webauthn.PublicKeyCredentialRPEntity    `cbor:"2,keyasint,omitempty"`
+	User                         *webauthn.PublicKeyCrendentialUserEntity `cbor:"3,keyasint,omitempty"`
+	PubKeyCredParams             []webauthn.PublicKeyCredentialParams     `cbor:"4,keyasint,omitempty"`
+	ExcludeList                  []webauthn.PublicKeyCredentialDescriptor `cbor:"5,keyasint,omitempty"`
+	Extensions                   *makeCredentialExtensions                `cbor:"6,keyasint,omitempty"`
+	Options                      *makeCredentialOptions                   `cbor:"7,keyasint,omitempty"`
+	PINUVAuthParam               []byte                                   `cbor:"8,keyasint,omitempty"`
+	PINUVAuthProtocol            uint32                                   `cbor:"9,keyasint,omitempty"`
+	EnterpriseAttestation        enterpriseAttestationMode                `cbor:"10,keyasint,omitempty"`
+	AttestationFormatsPreference []string                                 `cbor:"11,keyasint,omitempty"`
 }
 
 func (args makeCredentialArgs) String() string {
-	return fmt.Sprintf("ctapMakeCredentialArgs{ ClientDataHash: 0x%s, Relying Party: %s, User: %s, PublicKeyCredentialParams: %#v, ExcludeList: %#v, Extensions: %#v, Options: %#v, PinAuth: %#v, PinProtocol: %d }",
+	return fmt.Sprintf("ctapMakeCredentialArgs{ ClientDataHash: 0x%s, Relying Party: %s, User: %s, PublicKeyCredentialParams: %#v, ExcludeList: %#v, Extensions: %#v, Options: %#v, PinAuth: %#v, PinProtocol: %d, EnterpriseAttestation: %d, AttestationFormatsPreference: %v }",
 		hex.EncodeToString(args.ClientDataHash),
 		args.RP,
 		args.User,
@@ -191,73 +433,196 @@ func (args makeCredentialArgs) String() string {
 		args.Options,
 		args.PINUVAuthParam,
 		args.PINUVAuthProtocol,
+		args.EnterpriseAttestation,
+		args.AttestationFormatsPreference,
 	)
 }
 
+type enterpriseAttestationMode uint32
+
+const (
+	// The authenticator decides which relying parties get an enterprise attestation
+	enterpriseAttestationVendorFacilitated enterpriseAttestationMode = 1
+	// The platform has already checked that the relying party is allowed one
+	enterpriseAttestationPlatformManaged enterpriseAttestationMode = 2
+)
+
 type makeCredentialResponse struct {
-	FormatIdentifer      string                    `cbor:"1,keyasint"`
-	AuthData             []byte                    `cbor:"2,keyasint"`
-	AttestationStatement basicAttestationStatement `cbor:"3,keyasint"`
+	FormatIdentifer       string               `cbor:"1,keyasint"`
+	AuthData              []byte               `cbor:"2,keyasint"`
+	AttestationStatement  attestationStatement `cbor:"3,keyasint"`
+	EnterpriseAttestation bool                 `cbor:"4,keyasint,omitempty"`
+	LargeBlobKey          []byte               `cbor:"5,keyasint,omitempty"`
 }
 
-func (server *CTAPServer) handleMakeCredential(data []byte) []byte {
+// Returns whether to give an enterprise attestation, or the error if one can't be requested
+func (server *CTAPServer) useEnterpriseAttestation(mode enterpriseAttestationMode, rpID string) (bool, ctapStatusCode) {
+	if mode == 0 {
+		return false, ctap1ErrSuccess
+	}
+	if !server.client.SupportsPIN() || !server.client.AuthenticatorConfig().EnterpriseAttestation {
+		return false, ctap1ErrInvalidParameter
+	}
+	if mode != enterpriseAttestationVendorFacilitated && mode != enterpriseAttestationPlatformManaged {
+		return false, ctap2ErrInvalidOption
+	}
+	// Whichever side vouches for the relying party, uniquely identifying certificates only go to the configured ones
+	for _, allowedRPID := range server.client.EnterpriseAttestationRPIDs() {
+		if allowedRPID == rpID {
+			return true, ctap1ErrSuccess
+		}
+	}
+	// Relying parties that aren't on the list get the usual attestation
+	return false, ctap1ErrSuccess
+}
+
+func (server *CTAPServer) handleMakeCredential(ctx context.Context, data []byte) []byte {
 	var args makeCredentialArgs
 	err := cbor.Unmarshal(data, &args)
-	util.CheckErr(err, fmt.Sprintf("Could not decode CBOR for MAKE_CREDENTIAL: %s %v", err, data))
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return []byte{byte(ctap2ErrInvalidCBOR)}
+	}
 	ctapLogger.Printf("MAKE CREDENTIAL: %s\n\n", args)
+	if args.ClientDataHash == nil || args.RP == nil || args.User == nil || args.PubKeyCredParams == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
 	var flags authDataFlags = 0
 
-	supported := false
-	for _, param := range args.PubKeyCredParams {
-		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
-			supported = true
-		}
-	}
+	residentKey := args.Options != nil && args.Options.ResidentKey
+	algorithm, supported := selectAlgorithm(args.PubKeyCredParams)
 	if !supported {
 		ctapLogger.Printf("ERROR: Unsupported Algorithm\n\n")
 		return []byte{byte(ctap2ErrUnsupportedAlgorithm)}
 	}
+	enterpriseAttestation, status := server.useEnterpriseAttestation(args.EnterpriseAttestation, args.RP.ID)
+	if status != ctap1ErrSuccess {
+		ctapLogger.Printf("ERROR: Enterprise attestation can't be requested: %d\n\n", status)
+		return []byte{byte(status)}
+	}
 
-	if server.client.SupportsPIN() {
-		if args.PINUVAuthProtocol == 1 && args.PINUVAuthParam != nil {
-			pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-			if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
-			}
-			flags = flags | authDataFlagUserVerified
-		} else if args.PINUVAuthParam == nil && server.client.PINHash() != nil {
+	if server.client.SupportsPIN() && args.PINUVAuthParam != nil {
+		status := server.verifyPINUVAuthParam(args.PINUVAuthProtocol, args.PINUVAuthParam, args.ClientDataHash, pinUVAuthPermissionMakeCredential)
+		if status == ctap1ErrSuccess && !server.pinToken.permitsRelyingParty(args.RP.ID) {
+			status = ctap2ErrPINAuthInvalid
+		}
+		if status != ctap1ErrSuccess {
+			return []byte{byte(status)}
+		}
+		server.pinToken.useForRelyingParty(args.RP.ID)
+		flags = flags | authDataFlagUserVerified
+	} else if server.builtInUserVerificationRequested(args.Options != nil && args.Options.UserVerification) {
+		if status := server.verifyUser(ctx, args.RP.ID); status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: User verification failed: %d\n\n", status)
+			return []byte{byte(status)}
+		}
+		flags = flags | authDataFlagUserVerified
+	} else if server.client.SupportsPIN() {
+		if server.client.PINHash() != nil {
 			return []byte{byte(ctap2ErrPINRequired)}
-		} else if args.PINUVAuthParam != nil && args.PINUVAuthProtocol != 1 {
-			return []byte{byte(ctap2ErrPINAuthInvalid)}
+		} else if server.client.AuthenticatorConfig().AlwaysUV {
+			return []byte{byte(server.alwaysUVStatus())}
+		}
+	}
+
+	userVerified := flags&authDataFlagUserVerified != 0
+	if len(args.ExcludeList) > 0 && server.hasExcludedCredential(args.RP.ID, args.ExcludeList, userVerified) {
+		// The user still has to be present, so that the RP can't silently probe for credentials
+		if status := approvalStatus(ctx, server.client.ApproveAccountCreation(ctx, args.RP.Name)); status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: Unapproved action (Create account)")
+			return []byte{byte(status)}
+		}
+		ctapLogger.Printf("ERROR: Credential excluded\n\n")
+		return []byte{byte(ctap2ErrCredentialExcluded)}
+	}
+
+	var hmacSecret *hmacSecretRequest
+	if args.Extensions != nil && args.Extensions.HMACSecret && args.Extensions.HMACSecretMC != nil {
+		var status ctapStatusCode
+		hmacSecret, status = server.decodeHMACSecretInput(args.Extensions.HMACSecretMC)
+		if status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: Invalid hmac-secret-mc input: %d\n\n", status)
+			return []byte{byte(status)}
+		}
+	}
+
+	if residentKey && !server.client.SupportsResidentKey() {
+		ctapLogger.Printf("ERROR: Resident keys not supported\n\n")
+		return []byte{byte(ctap2ErrUnsupportedOption)}
+	}
+	if args.Extensions != nil && args.Extensions.LargeBlobKey != nil {
+		if !*args.Extensions.LargeBlobKey || !residentKey {
+			ctapLogger.Printf("ERROR: largeBlobKey requested without a resident key\n\n")
+			return []byte{byte(ctap2ErrInvalidOption)}
 		}
 	}
 
-	if !server.client.ApproveAccountCreation(args.RP.Name) {
+	if status := approvalStatus(ctx, server.client.ApproveAccountCreation(ctx, args.RP.Name)); status != ctap1ErrSuccess {
 		ctapLogger.Printf("ERROR: Unapproved action (Create account)")
-		return []byte{byte(ctap2ErrOperationDenied)}
+		return []byte{byte(status)}
 	}
 	flags = flags | authDataFlagUserPresent
 
-	credentialSource := server.client.NewCredentialSource(args.PubKeyCredParams, args.ExcludeList, args.RP, args.User)
+	credentialSource := identities.NewCredentialSource(algorithm, args.RP, args.User)
 	if credentialSource == nil {
 		ctapLogger.Printf("ERROR: Unsupported Algorithm\n\n")
 		return []byte{byte(ctap2ErrUnsupportedAlgorithm)}
 	}
-	attestedCredentialData := makeAttestedCredentialData(credentialSource)
-	authenticatorData := makeAuthData(args.RP.ID, credentialSource, attestedCredentialData, flags)
-
-	attestationCert := server.client.CreateAttestationCertificiate(credentialSource.PrivateKey)
-	attestationSignature := credentialSource.PrivateKey.Sign(append(authenticatorData, args.ClientDataHash...))
-	attestationStatement := basicAttestationStatement{
-		Alg: cose.COSE_ALGORITHM_ID_ES256,
-		Sig: attestationSignature,
-		X5c: [][]byte{attestationCert},
+	var extensionOutputs makeCredentialExtensionOutputs
+	if args.Extensions != nil {
+		if args.Extensions.HMACSecret {
+			// Only credentials made with hmac-secret get secrets, so the rest never produce outputs
+			credentialSource.CredRandomWithUV = crypto.RandomBytes(32)
+			credentialSource.CredRandomWithoutUV = crypto.RandomBytes(32)
+			extensionOutputs.HMACSecret = true
+		}
+		switch args.Extensions.CredProtect {
+		case webauthn.CredentialProtectionUserVerificationOptional,
+			webauthn.CredentialProtectionUserVerificationOptionalWithCredentialIDList,
+			webauthn.CredentialProtectionUserVerificationRequired:
+			credentialSource.Protection = args.Extensions.CredProtect
+			extensionOutputs.CredProtect = args.Extensions.CredProtect
+		}
+		if args.Extensions.CredBlob != nil {
+			stored := len(args.Extensions.CredBlob) <= maxCredBlobLength
+			if stored {
+				credentialSource.CredBlob = args.Extensions.CredBlob
+			}
+			extensionOutputs.CredBlob = &stored
+		}
+		if args.Extensions.LargeBlobKey != nil {
+			credentialSource.LargeBlobKey = crypto.RandomBytes(32)
+		}
+		if args.Extensions.MinPINLength && server.client.SupportsPIN() {
+			extensionOutputs.MinPINLength = server.minPINLengthForRelyingParty(args.RP.ID)
+		}
 	}
+	// The credential has to be complete before it's stored or sealed
+	if residentKey || isRSAAlgorithm(algorithm) {
+		// RSA keys are too large to seal into a credential ID, so non-resident ones are stored but can't be discovered
+		credentialSource.NonDiscoverable = !residentKey
+		server.client.AddCredentialSource(credentialSource)
+	} else {
+		credentialSource.ID = server.sealCredentialID(args.RP.ID, credentialSource)
+	}
+	if hmacSecret != nil {
+		extensionOutputs.HMACSecretMC = hmacSecret.output(credentialSource, userVerified)
+	}
+	// The format has to be picked before the authenticator data, since unattested credentials leave out the AAGUID
+	format := identities.AttestationFormatPackedBatch
+	if !enterpriseAttestation {
+		format = server.selectAttestationFormat(args.RP.ID, args.AttestationFormatsPreference, credentialSource)
+	}
+	attestedCredentialData := makeAttestedCredentialData(credentialSource, attestationAAGUID(format))
+	authenticatorData := makeAuthData(args.RP.ID, credentialSource, attestedCredentialData, encodeExtensionOutputs(extensionOutputs), flags)
+	attestationStatement := server.attestCredential(format, args.RP.ID, credentialSource, authenticatorData, args.ClientDataHash, enterpriseAttestation)
 
 	response := makeCredentialResponse{
-		AuthData:             authenticatorData,
-		FormatIdentifer:      "packed",
-		AttestationStatement: attestationStatement,
+		AuthData:              authenticatorData,
+		FormatIdentifer:       attestationFormatIdentifier(format),
+		AttestationStatement:  attestationStatement,
+		EnterpriseAttestation: enterpriseAttestation,
+		LargeBlobKey:          credentialSource.LargeBlobKey,
 	}
 	ctapLogger.Printf("MAKE CREDENTIAL RESPONSE: %#v\n\n", response)
 	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
@@ -268,34 +633,81 @@ type getInfoOptions struct {
 	CanResidentKey  bool  `cbor:"rk"`
 	HasClientPIN    *bool `cbor:"clientPin,omitempty"`
 	CanUserPresence bool  `cbor:"up"`
-	// CanUserVerification bool  `cbor:"uv"`
+	// Present only if there's built-in user verification, and true once it's set up
+	CanUserVerification  *bool `cbor:"uv,omitempty"`
+	CanManageCredentials bool  `cbor:"credMgmt,omitempty"`
+	HasPINUVAuthToken    bool  `cbor:"pinUvAuthToken,omitempty"`
+	HasLargeBlobs        bool  `cbor:"largeBlobs,omitempty"`
+	// Present only if enterprise attestation is supported, and true once it's enabled
+	EnterpriseAttestation *bool `cbor:"ep,omitempty"`
+	AlwaysUV              *bool `cbor:"alwaysUv,omitempty"`
+	CanConfigure          bool  `cbor:"authnrCfg,omitempty"`
+	CanSetMinPINLength    bool  `cbor:"setMinPINLength,omitempty"`
+	// Present only if there's a fingerprint sensor, and true once a finger is enrolled
+	HasBioEnrollment *bool `cbor:"bioEnroll,omitempty"`
 }
 
 type getInfoResponse struct {
-	Versions []string `cbor:"1,keyasint,omitempty"`
-	//Extensions []string `cbor:"2,keyasint,omitempty"`
-	AAGUID  [16]byte       `cbor:"3,keyasint,omitempty"`
-	Options getInfoOptions `cbor:"4,keyasint,omitempty"`
+	Versions   []string       `cbor:"1,keyasint,omitempty"`
+	Extensions []string       `cbor:"2,keyasint,omitempty"`
+	AAGUID     [16]byte       `cbor:"3,keyasint,omitempty"`
+	Options    getInfoOptions `cbor:"4,keyasint,omitempty"`
 	//MaxMessageSize uint32   `cbor:"5,keyasint,omitempty"`
-	PINUVAuthProtocols []uint32 `cbor:"6,keyasint,omitempty"`
+	PINUVAuthProtocols          []uint32                             `cbor:"6,keyasint,omitempty"`
+	Algorithms                  []webauthn.PublicKeyCredentialParams `cbor:"10,keyasint,omitempty"`
+	MaxSerializedLargeBlobArray uint32                               `cbor:"11,keyasint,omitempty"`
+	ForcePINChange              bool                                 `cbor:"12,keyasint,omitempty"`
+	MinPINLength                uint32                               `cbor:"13,keyasint,omitempty"`
+	MaxCredBlobLength           uint32                               `cbor:"15,keyasint,omitempty"`
+	UVModality                  uint32                               `cbor:"18,keyasint,omitempty"`
+	AttestationFormats          []string                             `cbor:"22,keyasint,omitempty"`
 }
 
 func (server *CTAPServer) handleGetInfo() []byte {
 	response := getInfoResponse{
-		Versions: []string{"FIDO_2_0", "U2F_V2"},
-		AAGUID:   aaguid,
+		Versions:   []string{"FIDO_2_0", "FIDO_2_1", "U2F_V2"},
+		Extensions: supportedExtensions,
+		AAGUID:     aaguid,
 		Options: getInfoOptions{
 			IsPlatform:      false,
 			CanResidentKey:  server.client.SupportsResidentKey(),
 			CanUserPresence: true,
-			// CanUserVerification: true,
 		},
+		Algorithms:         make([]webauthn.PublicKeyCredentialParams, 0),
+		MaxCredBlobLength:  maxCredBlobLength,
+		AttestationFormats: supportedAttestationFormats,
+	}
+	for _, algorithm := range supportedAlgorithms {
+		response.Algorithms = append(response.Algorithms, webauthn.PublicKeyCredentialParams{
+			Type:      "public-key",
+			Algorithm: algorithm,
+		})
 	}
 	if server.client.SupportsPIN() {
 		var clientPIN bool = server.client.PINHash() != nil
 		response.Options.HasClientPIN = &clientPIN
-		response.PINUVAuthProtocols = []uint32{1}
+		response.PINUVAuthProtocols = supportedPINUVAuthProtocols
+		response.Options.CanManageCredentials = true
+		response.Options.HasPINUVAuthToken = true
+		config := server.client.AuthenticatorConfig()
+		response.Options.EnterpriseAttestation = &config.EnterpriseAttestation
+		response.Options.AlwaysUV = &config.AlwaysUV
+		response.Options.CanConfigure = true
+		response.Options.CanSetMinPINLength = true
+		response.MinPINLength = server.minPINLength()
+		response.ForcePINChange = config.ForcePINChange
+	}
+	if server.hasBuiltInUserVerification() {
+		configured := server.userVerificationConfigured()
+		response.Options.CanUserVerification = &configured
 	}
+	if server.client.BioSensor() != nil && server.client.SupportsPIN() {
+		enrolled := server.fingerprintEnrolled()
+		response.Options.HasBioEnrollment = &enrolled
+		response.UVModality = uvModalityFingerprint
+	}
+	response.Options.HasLargeBlobs = true
+	response.MaxSerializedLargeBlobArray = maxSerializedLargeBlobArray
 	ctapLogger.Printf("GET_INFO RESPONSE: %#v\n\n", response)
 	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
 }
@@ -309,20 +721,96 @@ type getAssertionArgs struct {
 	RPID              string                                   `cbor:"1,keyasint"`
 	ClientDataHash    []byte                                   `cbor:"2,keyasint"`
 	AllowList         []webauthn.PublicKeyCredentialDescriptor `cbor:"3,keyasint"`
+	Extensions        *getAssertionExtensions                  `cbor:"4,keyasint,omitempty"`
 	Options           getAssertionOptions                      `cbor:"5,keyasint"`
 	PINUVAuthParam    []byte                                   `cbor:"6,keyasint,omitempty"`
 	PINUVAuthProtocol uint32                                   `cbor:"7,keyasint,omitempty"`
 }
 
 type getAssertionResponse struct {
-	Credential        *webauthn.PublicKeyCredentialDescriptor `cbor:"1,keyasint,omitempty"`
-	AuthenticatorData []byte                                  `cbor:"2,keyasint"`
-	Signature         []byte                                  `cbor:"3,keyasint"`
-	//User                *PublicKeyCrendentialUserEntity `cbor:"4,keyasint,omitempty"`
-	//NumberOfCredentials int32 `cbor:"5,keyasint"`
+	Credential          *webauthn.PublicKeyCredentialDescriptor  `cbor:"1,keyasint,omitempty"`
+	AuthenticatorData   []byte                                   `cbor:"2,keyasint"`
+	Signature           []byte                                   `cbor:"3,keyasint"`
+	User                *webauthn.PublicKeyCrendentialUserEntity `cbor:"4,keyasint,omitempty"`
+	NumberOfCredentials int32                                    `cbor:"5,keyasint,omitempty"`
+	LargeBlobKey        []byte                                   `cbor:"7,keyasint,omitempty"`
+}
+
+// Remaining credentials from a GetAssertion, returned one by one through GetNextAssertion
+type assertionIterator struct {
+	args              getAssertionArgs
+	flags             authDataFlags
+	credentialSources []*identities.CredentialSource
+	hmacSecret        *hmacSecretRequest
+	expiration        time.Time
+}
+
+func (server *CTAPServer) setAssertionIterator(channelID uint32, iterator *assertionIterator) {
+	server.iteratorsLock.Lock()
+	defer server.iteratorsLock.Unlock()
+	if iterator == nil {
+		delete(server.assertionIterators, channelID)
+	} else {
+		server.assertionIterators[channelID] = iterator
+	}
+}
+
+func (server *CTAPServer) takeNextAssertionSource(channelID uint32) (*assertionIterator, *identities.CredentialSource) {
+	server.iteratorsLock.Lock()
+	defer server.iteratorsLock.Unlock()
+	iterator, ok := server.assertionIterators[channelID]
+	if !ok {
+		return nil, nil
+	}
+	if len(iterator.credentialSources) == 0 || time.Now().After(iterator.expiration) {
+		delete(server.assertionIterators, channelID)
+		return nil, nil
+	}
+	credentialSource := iterator.credentialSources[0]
+	iterator.credentialSources = iterator.credentialSources[1:]
+	iterator.expiration = time.Now().Add(ctapGetNextAssertionTimeout)
+	return iterator, credentialSource
 }
 
-func (server *CTAPServer) handleGetAssertion(data []byte) []byte {
+func (server *CTAPServer) makeAssertion(args getAssertionArgs, credentialSource *identities.CredentialSource, flags authDataFlags, hmacSecret *hmacSecretRequest) getAssertionResponse {
+	var extensionOutputs getAssertionExtensionOutputs
+	if hmacSecret != nil {
+		extensionOutputs.HMACSecret = hmacSecret.output(credentialSource, flags&authDataFlagUserVerified != 0)
+	}
+	if args.Extensions != nil && args.Extensions.CredBlob {
+		credBlob := credentialSource.CredBlob
+		if credBlob == nil {
+			credBlob = []byte{}
+		}
+		extensionOutputs.CredBlob = &credBlob
+	}
+	authData := makeAuthData(args.RPID, credentialSource, nil, encodeExtensionOutputs(extensionOutputs), flags)
+	signature := credentialSource.PrivateKey.Sign(util.Concat(authData, args.ClientDataHash))
+	credentialDescriptor := credentialSource.CTAPDescriptor()
+	response := getAssertionResponse{
+		Credential:        &credentialDescriptor,
+		AuthenticatorData: authData,
+		Signature:         signature,
+	}
+	if len(args.AllowList) == 0 && credentialSource.User != nil {
+		// Discoverable credential, so the RP needs the user to know who signed in
+		response.User = assertionUserEntity(credentialSource.User, flags&authDataFlagUserVerified != 0)
+	}
+	if args.Extensions != nil && args.Extensions.LargeBlobKey {
+		response.LargeBlobKey = credentialSource.LargeBlobKey
+	}
+	return response
+}
+
+// Identifying user information (name, display name) is only returned once the user is verified
+func assertionUserEntity(user *webauthn.PublicKeyCrendentialUserEntity, userVerified bool) *webauthn.PublicKeyCrendentialUserEntity {
+	if userVerified {
+		return user
+	}
+	return &webauthn.PublicKeyCrendentialUserEntity{ID: user.ID}
+}
+
+func (server *CTAPServer) handleGetAssertion(ctx context.Context, channelID uint32, data []byte) []byte {
 	var flags authDataFlags = 0
 	var args getAssertionArgs
 	err := cbor.Unmarshal(data, &args)
@@ -331,45 +819,81 @@ func (server *CTAPServer) handleGetAssertion(data []byte) []byte {
 		return []byte{byte(ctap2ErrInvalidCBOR)}
 	}
 	ctapLogger.Printf("GET ASSERTION: %#v\n\n", args)
+	if args.RPID == "" || args.ClientDataHash == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
 
-	if server.client.SupportsPIN() {
-		if args.PINUVAuthParam != nil {
-			if args.PINUVAuthProtocol != 1 {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
-			}
-			pinAuth := server.derivePINAuth(server.client.PINToken(), args.ClientDataHash)
-			if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
-				return []byte{byte(ctap2ErrPINAuthInvalid)}
-			}
-			flags = flags | authDataFlagUserVerified
+	if server.client.SupportsPIN() && args.PINUVAuthParam != nil {
+		status := server.verifyPINUVAuthParam(args.PINUVAuthProtocol, args.PINUVAuthParam, args.ClientDataHash, pinUVAuthPermissionGetAssertion)
+		if status == ctap1ErrSuccess && !server.pinToken.permitsRelyingParty(args.RPID) {
+			status = ctap2ErrPINAuthInvalid
+		}
+		if status != ctap1ErrSuccess {
+			return []byte{byte(status)}
+		}
+		server.pinToken.useForRelyingParty(args.RPID)
+		flags = flags | authDataFlagUserVerified
+	} else if server.builtInUserVerificationRequested(args.Options.UserVerification) {
+		if status := server.verifyUser(ctx, args.RPID); status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: User verification failed: %d\n\n", status)
+			return []byte{byte(status)}
 		}
+		flags = flags | authDataFlagUserVerified
+	} else if server.client.SupportsPIN() && server.client.AuthenticatorConfig().AlwaysUV {
+		return []byte{byte(server.alwaysUVStatus())}
 	}
 
-	credentialSource := server.client.GetAssertionSource(args.RPID, args.AllowList)
-	unsafeCtapLogger.Printf("CREDENTIAL SOURCE: %#v\n\n", credentialSource)
-	if credentialSource == nil {
+	userVerified := flags&authDataFlagUserVerified != 0
+	credentialSources := server.client.GetAssertionSources(args.RPID, args.AllowList, userVerified)
+	residentKey := len(credentialSources) > 0
+	if !residentKey {
+		credentialSources = server.openAllowedCredentials(args.RPID, args.AllowList, userVerified)
+	}
+	if len(credentialSources) == 0 {
 		ctapLogger.Printf("ERROR: No Credentials\n\n")
 		return []byte{byte(ctap2ErrNoCredentials)}
 	}
+	if len(args.AllowList) > 0 {
+		// The RP already chose the credentials, so there is no account to pick between
+		credentialSources = credentialSources[:1]
+	}
+	credentialSource := credentialSources[0]
+	unsafeCtapLogger.Printf("CREDENTIAL SOURCE: %#v\n\n", credentialSource)
+
+	var hmacSecret *hmacSecretRequest
+	if args.Extensions != nil && args.Extensions.HMACSecret != nil {
+		var status ctapStatusCode
+		hmacSecret, status = server.decodeHMACSecretInput(args.Extensions.HMACSecret)
+		if status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: Invalid hmac-secret input: %d\n\n", status)
+			return []byte{byte(status)}
+		}
+	}
 
 	if args.Options.UserPresence == nil || *args.Options.UserPresence {
-		if !server.client.ApproveAccountLogin(credentialSource) {
+		if status := approvalStatus(ctx, server.client.ApproveAccountLogin(ctx, credentialSource)); status != ctap1ErrSuccess {
 			ctapLogger.Printf("ERROR: Unapproved action (Account login)")
-			return []byte{byte(ctap2ErrOperationDenied)}
+			return []byte{byte(status)}
 		}
 		flags = flags | authDataFlagUserPresent
 	}
 
-	authData := makeAuthData(args.RPID, credentialSource, nil, flags)
-	signature := credentialSource.PrivateKey.Sign(util.Concat(authData, args.ClientDataHash))
-
-	credentialDescriptor := credentialSource.CTAPDescriptor()
-	response := getAssertionResponse{
-		Credential:        &credentialDescriptor,
-		AuthenticatorData: authData,
-		Signature:         signature,
-		//User:                credentialSource.User,
-		//NumberOfCredentials: 1,
+	if residentKey {
+		server.client.IncrementSignatureCounter(credentialSource)
+	} else {
+		// Non-resident credentials share the device-wide counter
+		credentialSource.SignatureCounter = int32(server.client.NewAuthenticationCounterId())
+	}
+	response := server.makeAssertion(args, credentialSource, flags, hmacSecret)
+	if len(credentialSources) > 1 {
+		response.NumberOfCredentials = int32(len(credentialSources))
+		server.setAssertionIterator(channelID, &assertionIterator{
+			args:              args,
+			flags:             flags,
+			credentialSources: credentialSources[1:],
+			hmacSecret:        hmacSecret,
+			expiration:        time.Now().Add(ctapGetNextAssertionTimeout),
+		})
 	}
 
 	ctapLogger.Printf("GET ASSERTION RESPONSE: %#v\n\n", response)
@@ -377,6 +901,19 @@ func (server *CTAPServer) handleGetAssertion(data []byte) []byte {
 	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
 }
 
+func (server *CTAPServer) handleGetNextAssertion(channelID uint32) []byte {
+	iterator, credentialSource := server.takeNextAssertionSource(channelID)
+	if credentialSource == nil {
+		ctapLogger.Printf("ERROR: No pending assertion for channel %d\n\n", channelID)
+		return []byte{byte(ctap2ErrNotAllowed)}
+	}
+	unsafeCtapLogger.Printf("CREDENTIAL SOURCE: %#v\n\n", credentialSource)
+	server.client.IncrementSignatureCounter(credentialSource)
+	response := server.makeAssertion(iterator.args, credentialSource, iterator.flags, iterator.hmacSecret)
+	ctapLogger.Printf("GET NEXT ASSERTION RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
 type clientPINSubcommand uint32
 
 const (
@@ -385,6 +922,10 @@ const (
 	clientPINSubcommandSetPIN          clientPINSubcommand = 3
 	clientPINSubcommandChangePIN       clientPINSubcommand = 4
 	clientPinSubcommandGetPINToken     clientPINSubcommand = 5
+
+	clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions  clientPINSubcommand = 6
+	clientPINSubcommandGetUVRetries                             clientPINSubcommand = 7
+	clientPINSubcommandGetPINUVAuthTokenUsingPINWithPermissions clientPINSubcommand = 9
 )
 
 var clientPINSubcommandDescriptions = map[clientPINSubcommand]string{
@@ -393,6 +934,10 @@ var clientPINSubcommandDescriptions = map[clientPINSubcommand]string{
 	clientPINSubcommandSetPIN:          "clientPINSubcommandSetPIN",
 	clientPINSubcommandChangePIN:       "clientPINSubcommandChangePIN",
 	clientPinSubcommandGetPINToken:     "clientPinSubcommandGetPINToken",
+
+	clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions:  "clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions",
+	clientPINSubcommandGetUVRetries:                             "clientPINSubcommandGetUVRetries",
+	clientPINSubcommandGetPINUVAuthTokenUsingPINWithPermissions: "clientPINSubcommandGetPINUVAuthTokenUsingPINWithPermissions",
 }
 
 type clientPINArgs struct {
@@ -402,48 +947,73 @@ type clientPINArgs struct {
 	PINUVAuthParam    []byte              `cbor:"4,keyasint,omitempty"`
 	NewPINEncoding    []byte              `cbor:"5,keyasint,omitempty"`
 	PINHashEncoding   []byte              `cbor:"6,keyasint,omitempty"`
+	Permissions       pinUVAuthPermission `cbor:"9,keyasint,omitempty"`
+	RPID              string              `cbor:"10,keyasint,omitempty"`
 }
 
 func (args clientPINArgs) String() string {
-	return fmt.Sprintf("ctapClientPINArgs{PinProtocol: %d, SubCommand: %s, KeyAgreement: %v, PINAuth: 0x%s, NewPINEncoding: 0x%s, PINHashEncoding: 0x%s}",
+	return fmt.Sprintf("ctapClientPINArgs{PinProtocol: %d, SubCommand: %s, KeyAgreement: %v, PINAuth: 0x%s, NewPINEncoding: 0x%s, PINHashEncoding: 0x%s, Permissions: 0x%x, RPID: %s}",
 		args.PINUVAuthProtocol,
 		clientPINSubcommandDescriptions[args.SubCommand],
 		args.KeyAgreement,
 		hex.EncodeToString(args.PINUVAuthParam),
 		hex.EncodeToString(args.NewPINEncoding),
-		hex.EncodeToString(args.PINHashEncoding))
+		hex.EncodeToString(args.PINHashEncoding),
+		args.Permissions,
+		args.RPID)
 }
 
 type clientPINResponse struct {
 	KeyAgreement *cose.COSEEC2Key `cbor:"1,keyasint,omitempty"`
 	PinToken     []byte           `cbor:"2,keyasint,omitempty"`
 	Retries      *uint8           `cbor:"3,keyasint,omitempty"`
+	UVRetries    *uint8           `cbor:"5,keyasint,omitempty"`
 }
 
 func (args clientPINResponse) String() string {
-	return fmt.Sprintf("ctapClientPINResponse{KeyAgreement: %s, PinToken: %s, Retries: %#v}",
+	return fmt.Sprintf("ctapClientPINResponse{KeyAgreement: %s, PinToken: %s, Retries: %#v, UVRetries: %#v}",
 		args.KeyAgreement,
 		hex.EncodeToString(args.PinToken),
-		args.Retries)
+		args.Retries,
+		args.UVRetries)
 }
 
-func (server *CTAPServer) getPINSharedSecret(remoteKey cose.COSEEC2Key) []byte {
-	pinKey := server.client.PINKeyAgreement()
-	return crypto.HashSHA256(pinKey.ECDH(util.BytesToBigInt(remoteKey.X), util.BytesToBigInt(remoteKey.Y)))
-}
-
-func (server *CTAPServer) derivePINAuth(sharedSecret []byte, data []byte) []byte {
-	hash := hmac.New(sha256.New, sharedSecret)
-	hash.Write(data)
-	return hash.Sum(nil)[:16]
+// The platform's key has to be checked first, since ECDH can't be computed with a point that isn't on P-256
+func (server *CTAPServer) getPINSharedSecret(protocol pinUVAuthProtocol, remoteKey cose.COSEEC2Key) ([]byte, ctapStatusCode) {
+	x, y := util.BytesToBigInt(remoteKey.X), util.BytesToBigInt(remoteKey.Y)
+	if !elliptic.P256().IsOnCurve(x, y) {
+		ctapLogger.Printf("ERROR: Key agreement point is not on P-256\n\n")
+		return nil, ctap1ErrInvalidParameter
+	}
+	pinKey := server.pinPolicy.keyAgreement
+	return protocol.kdf(pinKey.ECDH(x, y)), ctap1ErrSuccess
 }
 
-func (server *CTAPServer) decryptPINHash(sharedSecret []byte, pinHashEncoding []byte) []byte {
-	return crypto.DecryptAESCBC(sharedSecret, pinHashEncoding)
+// Checks a pinUvAuthParam over message, which must come from a PIN token with the given permission
+func (server *CTAPServer) verifyPINUVAuthParam(protocolVersion uint32, pinUVAuthParam []byte, message []byte, permission pinUVAuthPermission) ctapStatusCode {
+	if pinUVAuthParam == nil {
+		return ctap2ErrPINRequired
+	}
+	protocol := getPINUVAuthProtocol(protocolVersion)
+	if protocol == nil {
+		return ctap1ErrInvalidParameter
+	}
+	if !verifyPINUVAuth(protocol, server.pinToken.value, message, pinUVAuthParam) {
+		return ctap2ErrPINAuthInvalid
+	}
+	if !server.pinToken.hasPermission(permission) {
+		return ctap2ErrPINAuthInvalid
+	}
+	server.pinToken.used = true
+	return ctap1ErrSuccess
 }
 
-func (server *CTAPServer) decryptPIN(sharedSecret []byte, pinEncoding []byte) []byte {
-	decryptedPINPadded := crypto.DecryptAESCBC(sharedSecret, pinEncoding)
+func (server *CTAPServer) decryptPIN(protocol pinUVAuthProtocol, sharedSecret []byte, pinEncoding []byte) []byte {
+	decryptedPINPadded, err := protocol.decrypt(sharedSecret, pinEncoding)
+	if err != nil {
+		ctapLogger.Printf("ERROR: Could not decrypt PIN: %s\n\n", err)
+		return nil
+	}
 	var decryptedPIN []byte = nil
 	for i := range decryptedPINPadded {
 		if decryptedPINPadded[i] == 0 {
@@ -454,7 +1024,7 @@ func (server *CTAPServer) decryptPIN(sharedSecret []byte, pinEncoding []byte) []
 	return decryptedPIN
 }
 
-func (server *CTAPServer) handleClientPIN(data []byte) []byte {
+func (server *CTAPServer) handleClientPIN(ctx context.Context, data []byte) []byte {
 	if !server.client.SupportsPIN() {
 		return []byte{byte(ctap1ErrInvalidCommand)}
 	}
@@ -464,7 +1034,10 @@ func (server *CTAPServer) handleClientPIN(data []byte) []byte {
 		ctapLogger.Printf("ERROR: %s", err)
 		return []byte{byte(ctap2ErrInvalidCBOR)}
 	}
-	if args.PINUVAuthProtocol != 1 {
+	protocol := getPINUVAuthProtocol(args.PINUVAuthProtocol)
+	// Retry counts don't depend on the protocol, so platforms leave it out when asking for them
+	retriesRequested := args.SubCommand == clientPINSubcommandGetRetries || args.SubCommand == clientPINSubcommandGetUVRetries
+	if protocol == nil && !retriesRequested {
 		return []byte{byte(ctap1ErrInvalidParameter)}
 	}
 	ctapLogger.Printf("CLIENT_PIN: %v\n\n", args)
@@ -475,11 +1048,17 @@ func (server *CTAPServer) handleClientPIN(data []byte) []byte {
 	case clientPinSubcommandGetKeyAgreement:
 		response = server.handleGetKeyAgreement()
 	case clientPINSubcommandSetPIN:
-		response = server.handleSetPIN(args)
+		response = server.handleSetPIN(protocol, args)
 	case clientPINSubcommandChangePIN:
-		response = server.handleChangePIN(args)
+		response = server.handleChangePIN(protocol, args)
 	case clientPinSubcommandGetPINToken:
-		response = server.handleGetPINToken(args)
+		response = server.handleGetPINToken(protocol, args)
+	case clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions:
+		response = server.handleGetPINUVAuthTokenUsingUVWithPermissions(ctx, protocol, args)
+	case clientPINSubcommandGetUVRetries:
+		response = server.handleGetUVRetries()
+	case clientPINSubcommandGetPINUVAuthTokenUsingPINWithPermissions:
+		response = server.handleGetPINUVAuthTokenUsingPINWithPermissions(protocol, args)
 	default:
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
@@ -496,8 +1075,20 @@ func (server *CTAPServer) handleGetRetries() []byte {
 	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
 }
 
+func (server *CTAPServer) handleGetUVRetries() []byte {
+	if !server.hasBuiltInUserVerification() {
+		return []byte{byte(ctap2ErrNotAllowed)}
+	}
+	retries := uint8(server.client.UVRetries())
+	response := clientPINResponse{
+		UVRetries: &retries,
+	}
+	ctapLogger.Printf("CLIENT_PIN_GET_UV_RETRIES: %v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
 func (server *CTAPServer) handleGetKeyAgreement() []byte {
-	key := server.client.PINKeyAgreement()
+	key := server.pinPolicy.keyAgreement
 	response := clientPINResponse{
 		KeyAgreement: &cose.COSEEC2Key{
 			KeyType:   int8(cose.COSE_KEY_TYPE_EC2),
@@ -510,77 +1101,262 @@ func (server *CTAPServer) handleGetKeyAgreement() []byte {
 	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
 }
 
-func (server *CTAPServer) handleSetPIN(args clientPINArgs) []byte {
+func (server *CTAPServer) handleSetPIN(protocol pinUVAuthProtocol, args clientPINArgs) []byte {
 	if server.client.PINHash() != nil {
 		return []byte{byte(ctap2ErrPINAuthInvalid)}
 	}
 	if args.KeyAgreement == nil || args.PINUVAuthParam == nil || args.NewPINEncoding == nil {
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
-	pinAuth := server.derivePINAuth(sharedSecret, args.NewPINEncoding)
-	if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
+	sharedSecret, status := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	if !verifyPINUVAuth(protocol, sharedSecret, args.NewPINEncoding, args.PINUVAuthParam) {
 		return []byte{byte(ctap2ErrPINAuthInvalid)}
 	}
-	decryptedPIN := server.decryptPIN(sharedSecret, args.NewPINEncoding)
-	if len(decryptedPIN) < 4 {
+	decryptedPIN := server.decryptPIN(protocol, sharedSecret, args.NewPINEncoding)
+	if uint32(utf8.RuneCount(decryptedPIN)) < server.minPINLength() {
 		return []byte{byte(ctap2ErrPINPolicyViolation)}
 	}
-	pinHash := crypto.HashSHA256(decryptedPIN)[:16]
-	server.client.SetPINRetries(8)
+	server.pinPolicy.recordSuccess()
+	server.storePIN(decryptedPIN)
+	return []byte{byte(ctap1ErrSuccess)}
+}
+
+// Stores a new PIN that meets the policy, which satisfies any pending forcePINChange
+func (server *CTAPServer) storePIN(pin []byte) {
+	pinHash := crypto.HashSHA256(pin)[:16]
 	server.client.SetPINHash(pinHash)
+	server.client.SetPINLength(uint32(utf8.RuneCount(pin)))
+	config := server.client.AuthenticatorConfig()
+	if config.ForcePINChange {
+		config.ForcePINChange = false
+		server.client.SetAuthenticatorConfig(config)
+	}
 	ctapLogger.Printf("SETTING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
-	return []byte{byte(ctap1ErrSuccess)}
 }
 
-func (server *CTAPServer) handleChangePIN(args clientPINArgs) []byte {
+func (server *CTAPServer) handleChangePIN(protocol pinUVAuthProtocol, args clientPINArgs) []byte {
 	if args.KeyAgreement == nil || args.PINUVAuthParam == nil {
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
-	if server.client.PINRetries() == 0 {
-		return []byte{byte(ctap2ErrPINBlocked)}
+	if server.client.PINHash() == nil {
+		return []byte{byte(ctap2ErrNoPINSet)}
+	}
+	if status := server.pinPolicy.checkAllowed(); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	sharedSecret, status := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return []byte{byte(status)}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
-	pinAuth := server.derivePINAuth(sharedSecret, append(args.NewPINEncoding, args.PINHashEncoding...))
-	if !bytes.Equal(pinAuth, args.PINUVAuthParam) {
+	if !verifyPINUVAuth(protocol, sharedSecret, util.Concat(args.NewPINEncoding, args.PINHashEncoding), args.PINUVAuthParam) {
 		return []byte{byte(ctap2ErrPINAuthInvalid)}
 	}
-	server.client.SetPINRetries(server.client.PINRetries() - 1)
-	decryptedPINHash := crypto.DecryptAESCBC(sharedSecret, args.PINHashEncoding)
-	if !bytes.Equal(server.client.PINHash(), decryptedPINHash) {
-		// TODO: Mismatch detected, handle it
-		return []byte{byte(ctap2ErrPINInvalid)}
+	server.pinPolicy.beginAttempt()
+	decryptedPINHash, err := protocol.decrypt(sharedSecret, args.PINHashEncoding)
+	if err != nil || !bytes.Equal(server.client.PINHash(), decryptedPINHash) {
+		ctapLogger.Printf("ERROR: Current PIN doesn't match\n\n")
+		return []byte{byte(server.pinPolicy.recordFailure())}
 	}
-	server.client.SetPINRetries(8)
-	newPIN := server.decryptPIN(sharedSecret, args.NewPINEncoding)
-	if len(newPIN) < 4 {
+	server.pinPolicy.recordSuccess()
+	newPIN := server.decryptPIN(protocol, sharedSecret, args.NewPINEncoding)
+	if uint32(utf8.RuneCount(newPIN)) < server.minPINLength() {
 		return []byte{byte(ctap2ErrPINPolicyViolation)}
 	}
-	pinHash := crypto.HashSHA256(newPIN)[:16]
-	server.client.SetPINHash(pinHash)
+	if server.client.AuthenticatorConfig().ForcePINChange && bytes.Equal(crypto.HashSHA256(newPIN)[:16], server.client.PINHash()) {
+		// A forced change has to actually change the PIN
+		return []byte{byte(ctap2ErrPINPolicyViolation)}
+	}
+	server.storePIN(newPIN)
+	server.pinToken.reset()
 	return []byte{byte(ctap1ErrSuccess)}
 }
 
-func (server *CTAPServer) handleGetPINToken(args clientPINArgs) []byte {
-	if args.PINHashEncoding == nil || args.KeyAgreement.X == nil {
+func (server *CTAPServer) handleGetPINToken(protocol pinUVAuthProtocol, args clientPINArgs) []byte {
+	return server.getPINTokenUsingPIN(protocol, args, legacyPINTokenPermissions, "")
+}
+
+// Permissions the authenticator has the features for
+func (server *CTAPServer) supportedPINUVAuthPermissions() pinUVAuthPermission {
+	permissions := pinUVAuthPermissionMakeCredential |
+		pinUVAuthPermissionGetAssertion |
+		pinUVAuthPermissionCredentialManagement |
+		pinUVAuthPermissionLargeBlobWrite |
+		pinUVAuthPermissionAuthenticatorConfig
+	if server.client.BioSensor() != nil {
+		permissions |= pinUVAuthPermissionBioEnrollment
+	}
+	return permissions
+}
+
+func (server *CTAPServer) checkRequestedPermissions(permissions pinUVAuthPermission) ctapStatusCode {
+	if permissions == 0 {
+		return ctap1ErrInvalidParameter
+	}
+	if permissions&^server.supportedPINUVAuthPermissions() != 0 {
+		ctapLogger.Printf("ERROR: Unsupported permissions requested: 0x%x\n\n", permissions)
+		return ctap2ErrUnauthorizedPermission
+	}
+	return ctap1ErrSuccess
+}
+
+func (server *CTAPServer) handleGetPINUVAuthTokenUsingPINWithPermissions(protocol pinUVAuthProtocol, args clientPINArgs) []byte {
+	if status := server.checkRequestedPermissions(args.Permissions); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	return server.getPINTokenUsingPIN(protocol, args, args.Permissions, args.RPID)
+}
+
+func (server *CTAPServer) handleGetPINUVAuthTokenUsingUVWithPermissions(ctx context.Context, protocol pinUVAuthProtocol, args clientPINArgs) []byte {
+	if args.KeyAgreement == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
+	if status := server.checkRequestedPermissions(args.Permissions); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	if !server.userVerificationConfigured() {
+		return []byte{byte(ctap2ErrNotAllowed)}
+	}
+	// A bad key agreement has to be rejected before the user is asked, so that it can't use up UV retries
+	sharedSecret, status := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	if status := server.verifyUser(ctx, args.RPID); status != ctap1ErrSuccess {
+		ctapLogger.Printf("ERROR: User verification failed: %d\n\n", status)
+		return []byte{byte(status)}
+	}
+	server.pinToken.reset()
+	server.pinToken.beginUsing(args.Permissions, args.RPID)
+	response := clientPINResponse{
+		PinToken: protocol.encrypt(sharedSecret, server.pinToken.value),
+	}
+	ctapLogger.Printf("GET_PIN_UV_AUTH_TOKEN_USING_UV RESPONSE: %#v\n\n", response)
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+// Built-in verification is used when the platform asks for it, or when alwaysUv needs it and there's no pinUvAuthParam
+func (server *CTAPServer) builtInUserVerificationRequested(uvOption bool) bool {
+	if uvOption {
+		return true
+	}
+	return server.userVerificationConfigured() && server.client.SupportsPIN() && server.client.AuthenticatorConfig().AlwaysUV
+}
+
+// Whether there's a way to verify the user other than a PIN, even if it isn't set up yet
+func (server *CTAPServer) hasBuiltInUserVerification() bool {
+	return server.client.SupportsUserVerification() || (server.client.BioSensor() != nil && server.client.SupportsPIN())
+}
+
+func (server *CTAPServer) userVerificationConfigured() bool {
+	return server.client.SupportsUserVerification() || server.fingerprintEnrolled()
+}
+
+// Runs the built-in user verification, which uses up a UV retry when it fails.
+// Enrolled fingerprints are used in place of the client's verifier.
+func (server *CTAPServer) verifyUser(ctx context.Context, rpID string) ctapStatusCode {
+	if !server.userVerificationConfigured() {
+		return ctap2ErrInvalidOption
+	}
+	if status := server.pinPolicy.checkUVAllowed(); status != ctap1ErrSuccess {
+		return status
+	}
+	var verified bool
+	if server.fingerprintEnrolled() {
+		verified = server.matchFingerprint(ctx)
+	} else {
+		verified = server.client.VerifyUser(ctx, rpID)
+	}
+	if ctx.Err() != nil {
+		// A cancelled prompt says nothing about the user, so it doesn't use up a retry
+		return ctap2ErrKeepaliveCancel
+	}
+	if !verified {
+		return server.pinPolicy.recordUVFailure()
+	}
+	server.pinPolicy.recordUVSuccess()
+	return ctap1ErrSuccess
+}
+
+func (server *CTAPServer) getPINTokenUsingPIN(protocol pinUVAuthProtocol, args clientPINArgs, permissions pinUVAuthPermission, rpID string) []byte {
+	if args.PINHashEncoding == nil || args.KeyAgreement == nil {
 		return []byte{byte(ctap2ErrMissingParam)}
 	}
-	if server.client.PINRetries() <= 0 {
-		return []byte{byte(ctap2ErrPINBlocked)}
+	if server.client.PINHash() == nil {
+		return []byte{byte(ctap2ErrNoPINSet)}
+	}
+	if status := server.pinPolicy.checkAllowed(); status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	sharedSecret, status := server.getPINSharedSecret(protocol, *args.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return []byte{byte(status)}
+	}
+	server.pinPolicy.beginAttempt()
+	pinHash, err := protocol.decrypt(sharedSecret, args.PINHashEncoding)
+	if err != nil {
+		ctapLogger.Printf("ERROR: Could not decrypt PIN hash: %s\n\n", err)
+		return []byte{byte(server.pinPolicy.recordFailure())}
 	}
-	sharedSecret := server.getPINSharedSecret(*args.KeyAgreement)
-	server.client.SetPINRetries(server.client.PINRetries() - 1)
-	pinHash := server.decryptPINHash(sharedSecret, args.PINHashEncoding)
 	ctapLogger.Printf("TRYING PIN HASH: %v\n\n", hex.EncodeToString(pinHash))
 	if !bytes.Equal(pinHash, server.client.PINHash()) {
-		// TODO: Handle mismatch here by regening the key agreement key
 		ctapLogger.Printf("MISMATCH: Provided PIN %v doesn't match stored PIN %v\n\n", hex.EncodeToString(pinHash), hex.EncodeToString(server.client.PINHash()))
-		return []byte{byte(ctap2ErrPINInvalid)}
+		return []byte{byte(server.pinPolicy.recordFailure())}
 	}
-	server.client.SetPINRetries(8)
+	server.pinPolicy.recordSuccess()
+	if server.client.AuthenticatorConfig().ForcePINChange {
+		// The PIN was right, but it has to be changed before it can be used
+		ctapLogger.Printf("ERROR: PIN has to be changed before getting a token\n\n")
+		return []byte{byte(ctap2ErrPINPolicyViolation)}
+	}
+	server.pinToken.reset()
+	server.pinToken.beginUsing(permissions, rpID)
 	response := clientPINResponse{
-		PinToken: crypto.EncryptAESCBC(sharedSecret, server.client.PINToken()),
+		PinToken: protocol.encrypt(sharedSecret, server.pinToken.value),
 	}
 	ctapLogger.Printf("GET_PIN_TOKEN RESPONSE: %#v\n\n", response)
 	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
 }
+
+func (server *CTAPServer) handleReset(ctx context.Context) []byte {
+	if time.Since(server.powerUpTime) > ctapResetWindow {
+		ctapLogger.Printf("ERROR: Reset requested more than %s after power up\n\n", ctapResetWindow)
+		return []byte{byte(ctap2ErrNotAllowed)}
+	}
+	if status := approvalStatus(ctx, server.client.ApproveReset(ctx)); status != ctap1ErrSuccess {
+		ctapLogger.Printf("ERROR: Unapproved action (Reset)")
+		return []byte{byte(status)}
+	}
+	server.client.Reset()
+	server.iteratorsLock.Lock()
+	server.assertionIterators = make(map[uint32]*assertionIterator)
+	server.credentialManagementIterators = make(map[uint32]*credentialManagementIterator)
+	server.iteratorsLock.Unlock()
+	server.largeBlobWrite = nil
+	server.bioEnrollment = nil
+	server.pinToken.reset()
+	server.pinPolicy.reset()
+	ctapLogger.Printf("RESET COMPLETE\n\n")
+	return []byte{byte(ctap1ErrSuccess)}
+}
+
+func (server *CTAPServer) handleSelection(ctx context.Context) []byte {
+	if status := approvalStatus(ctx, server.client.ApproveSelection(ctx)); status != ctap1ErrSuccess {
+		ctapLogger.Printf("ERROR: Unapproved action (Selection)\n\n")
+		return []byte{byte(status)}
+	}
+	return []byte{byte(ctap1ErrSuccess)}
+}
+
+// Requests cancelled while waiting on the user are answered as cancelled, even if the approver went on to approve them
+func approvalStatus(ctx context.Context, approved bool) ctapStatusCode {
+	if ctx.Err() != nil {
+		return ctap2ErrKeepaliveCancel
+	}
+	if !approved {
+		return ctap2ErrOperationDenied
+	}
+	return ctap1ErrSuccess
+}
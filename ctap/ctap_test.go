@@ -2,7 +2,11 @@ package ctap
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
@@ -15,63 +19,224 @@ import (
 
 type dummyCTAPClient struct {
 	vault identities.IdentityVault
+	pinHash []byte
+	pinRetries int32
+	uvRetries int32
+	verifyUser func(ctx context.Context, relyingPartyID string) bool
+	bioSensor BioSensor
+	bioEnrollments []identities.BioEnrollment
+	pinLength uint32
+	largeBlobs []byte
+	config identities.AuthenticatorConfig
+	enterpriseAttestationRPIDs []string
+	attestationKey *cose.SupportedCOSEPrivateKey
+	attestationFormats map[string]identities.AttestationFormat
+	denySelection bool
+	// Off by default, like the authenticators the baseline tests were written against
+	supportsPIN bool
 }
 func (client *dummyCTAPClient) SupportsResidentKey() bool {
 	return true
 }
 func (client *dummyCTAPClient) SupportsPIN() bool {
-	return false
+	return client.supportsPIN
 }
 
-func (client *dummyCTAPClient) NewCredentialSource(
-	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
-	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
-	relyingParty *webauthn.PublicKeyCredentialRPEntity,
-	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
-	return client.vault.NewIdentity(relyingParty, user)
+func (client *dummyCTAPClient) AddCredentialSource(source *identities.CredentialSource) {
+	client.vault.AddIdentity(source)
 }
-func (client *dummyCTAPClient) GetAssertionSource(
+func (client *dummyCTAPClient) GetAssertionSources(
 	relyingPartyID string, 
-	allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource {
-	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList)
-	if len(sources) > 0 {
-		return sources[0]
-	} else {
-		return nil
-	}
+	allowList []webauthn.PublicKeyCredentialDescriptor,
+	userVerified bool) []*identities.CredentialSource {
+	return client.vault.GetMatchingCredentialSources(relyingPartyID, allowList, userVerified)
+}
+func (client *dummyCTAPClient) IncrementSignatureCounter(credentialSource *identities.CredentialSource) {
+	credentialSource.SignatureCounter++
+}
+func (client *dummyCTAPClient) SealingEncryptionKey() []byte {
+	return crypto.HashSHA256([]byte("test"))
+}
+func (client *dummyCTAPClient) NewAuthenticationCounterId() uint32 {
+	return 1
 }
 func (client *dummyCTAPClient) CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte {
-	return nil
+	return []byte("batch")
+}
+func (client *dummyCTAPClient) AttestationFormat(relyingPartyID string) identities.AttestationFormat {
+	return client.attestationFormats[relyingPartyID]
+}
+func (client *dummyCTAPClient) AttestationPrivateKey() *cose.SupportedCOSEPrivateKey {
+	if client.attestationKey == nil {
+		client.attestationKey = &cose.SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+	}
+	return client.attestationKey
+}
+func (client *dummyCTAPClient) EnterpriseAttestationRPIDs() []string {
+	return client.enterpriseAttestationRPIDs
+}
+func (client *dummyCTAPClient) CreateEnterpriseAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey) []byte {
+	return []byte("enterprise")
 }
 
 func (client *dummyCTAPClient) PINHash() []byte {
-	return nil
+	return client.pinHash
+}
+func (client *dummyCTAPClient) SetPINHash(pin []byte) {
+	client.pinHash = pin
 }
-func (client *dummyCTAPClient) SetPINHash(pin []byte) {}
 func (client *dummyCTAPClient) PINRetries() int32 {
-	return 0
+	return client.pinRetries
+}
+func (client *dummyCTAPClient) SetPINRetries(retries int32) {
+	client.pinRetries = retries
+}
+func (client *dummyCTAPClient) UVRetries() int32 {
+	return client.uvRetries
+}
+func (client *dummyCTAPClient) SetUVRetries(retries int32) {
+	client.uvRetries = retries
+}
+func (client *dummyCTAPClient) SupportsUserVerification() bool {
+	return client.verifyUser != nil
+}
+func (client *dummyCTAPClient) VerifyUser(ctx context.Context, relyingPartyID string) bool {
+	return client.verifyUser(ctx, relyingPartyID)
+}
+func (client *dummyCTAPClient) PINLength() uint32 {
+	return client.pinLength
+}
+func (client *dummyCTAPClient) SetPINLength(length uint32) {
+	client.pinLength = length
+}
+
+func (client *dummyCTAPClient) Identities() []identities.CredentialSource {
+	sources := make([]identities.CredentialSource, 0)
+	for _, source := range client.vault.CredentialSources {
+		sources = append(sources, *source)
+	}
+	return sources
+}
+func (client *dummyCTAPClient) DeleteIdentity(id []byte) bool {
+	return client.vault.DeleteIdentity(id)
+}
+func (client *dummyCTAPClient) UpdateIdentityUser(id []byte, user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	return client.vault.UpdateUser(id, user)
+}
+
+func (client *dummyCTAPClient) LargeBlobs() []byte {
+	return client.largeBlobs
+}
+func (client *dummyCTAPClient) SetLargeBlobs(data []byte) {
+	client.largeBlobs = data
+}
+
+func (client *dummyCTAPClient) BioSensor() BioSensor {
+	return client.bioSensor
+}
+func (client *dummyCTAPClient) BioEnrollments() []identities.BioEnrollment {
+	return client.bioEnrollments
+}
+func (client *dummyCTAPClient) SetBioEnrollments(enrollments []identities.BioEnrollment) {
+	client.bioEnrollments = enrollments
 }
-func (client *dummyCTAPClient) SetPINRetries(retries int32) {}
-func (client *dummyCTAPClient) PINKeyAgreement() *crypto.ECDHKey {
-	return nil
+func (client *dummyCTAPClient) AuthenticatorConfig() identities.AuthenticatorConfig {
+	return client.config
 }
-func (client *dummyCTAPClient) PINToken() []byte {
-	return nil
+func (client *dummyCTAPClient) SetAuthenticatorConfig(config identities.AuthenticatorConfig) {
+	client.config = config
 }
 
-func (client *dummyCTAPClient) ApproveAccountCreation(relyingParty string) bool {
+func (client *dummyCTAPClient) ApproveAccountCreation(ctx context.Context, relyingParty string) bool {
 	return true
 }
-func (client *dummyCTAPClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
+func (client *dummyCTAPClient) ApproveAccountLogin(ctx context.Context, credentialSource *identities.CredentialSource) bool {
 	return true
 }
+func (client *dummyCTAPClient) ApproveReset(ctx context.Context) bool {
+	return true
+}
+func (client *dummyCTAPClient) ApproveSelection(ctx context.Context) bool {
+	return !client.denySelection
+}
+func (client *dummyCTAPClient) Reset() {
+	client.vault = identities.IdentityVault{}
+	client.pinHash = nil
+	client.largeBlobs = nil
+	client.bioEnrollments = nil
+	client.config = identities.AuthenticatorConfig{}
+}
+
+func setPIN(client *dummyCTAPClient, pin string) {
+	client.SetPINHash(crypto.HashSHA256([]byte(pin))[:16])
+	client.SetPINLength(uint32(len(pin)))
+	client.SetPINRetries(8)
+}
+
+// Runs the PIN protocol the way a platform would, returning the decrypted PIN token.
+// Without permissions, the token comes from the CTAP 2.0 getPINToken subcommand.
+func getPINToken(t *testing.T, ctap *CTAPServer, protocolVersion uint32, pin string, permissions pinUVAuthPermission, rpID string) []byte {
+	pinToken, status := requestPINToken(t, ctap, protocolVersion, pin, permissions, rpID)
+	test.AssertEqual(t, status, ctap1ErrSuccess, "Could not get PIN token")
+	return pinToken
+}
+
+// Agrees on a shared secret with the authenticator, returning the platform's half of the key agreement
+func platformKeyAgreement(t *testing.T, ctap *CTAPServer, protocolVersion uint32) (*cose.COSEEC2Key, []byte) {
+	protocol := getPINUVAuthProtocol(protocolVersion)
+	platformKey := crypto.GenerateECDHKey()
+	keyAgreementArgs := clientPINArgs{
+		PINUVAuthProtocol: protocolVersion,
+		SubCommand: clientPinSubcommandGetKeyAgreement,
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(keyAgreementArgs)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not get key agreement")
+	var keyAgreementResponse clientPINResponse
+	err := cbor.Unmarshal(responseBytes[1:], &keyAgreementResponse)
+	util.CheckErr(err, "Invalid key agreement response")
+	sharedSecret := protocol.kdf(platformKey.ECDH(
+		util.BytesToBigInt(keyAgreementResponse.KeyAgreement.X),
+		util.BytesToBigInt(keyAgreementResponse.KeyAgreement.Y)))
+	return &cose.COSEEC2Key{
+		KeyType: int8(cose.COSE_KEY_TYPE_EC2),
+		Algorithm: int8(cose.COSE_ALGORITHM_ID_ECDH_HKDF_256),
+		X: platformKey.X.Bytes(),
+		Y: platformKey.Y.Bytes(),
+	}, sharedSecret
+}
+
+func requestPINToken(t *testing.T, ctap *CTAPServer, protocolVersion uint32, pin string, permissions pinUVAuthPermission, rpID string) ([]byte, ctapStatusCode) {
+	protocol := getPINUVAuthProtocol(protocolVersion)
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, protocolVersion)
+	pinTokenArgs := clientPINArgs{
+		PINUVAuthProtocol: protocolVersion,
+		SubCommand: clientPinSubcommandGetPINToken,
+		KeyAgreement: keyAgreement,
+		PINHashEncoding: protocol.encrypt(sharedSecret, crypto.HashSHA256([]byte(pin))[:16]),
+		Permissions: permissions,
+		RPID: rpID,
+	}
+	if permissions != 0 {
+		pinTokenArgs.SubCommand = clientPINSubcommandGetPINUVAuthTokenUsingPINWithPermissions
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(pinTokenArgs)))
+	if ctapStatusCode(responseBytes[0]) != ctap1ErrSuccess {
+		return nil, ctapStatusCode(responseBytes[0])
+	}
+	var pinTokenResponse clientPINResponse
+	err := cbor.Unmarshal(responseBytes[1:], &pinTokenResponse)
+	util.CheckErr(err, "Invalid PIN token response")
+	pinToken, err := protocol.decrypt(sharedSecret, pinTokenResponse.PinToken)
+	util.CheckErr(err, "Could not decrypt PIN token")
+	return pinToken, ctap1ErrSuccess
+}
 
 func TestMakeCredential(t *testing.T) {
 	client := &dummyCTAPClient{}
 	ctap := NewCTAPServer(client)
 
 	args := makeCredentialArgs{
-		ClientDataHash: []byte{},
+		ClientDataHash: crypto.HashSHA256([]byte("clientData")),
 		RP: &webauthn.PublicKeyCredentialRPEntity{
 			ID: "example.com",
 			Name: "Example",
@@ -88,7 +253,7 @@ func TestMakeCredential(t *testing.T) {
 			},
 		},
 		ExcludeList: []webauthn.PublicKeyCredentialDescriptor{},
-		Extensions: map[string]interface{}{},
+		Extensions: &makeCredentialExtensions{},
 		Options: &makeCredentialOptions{
 			ResidentKey: true,
 		},
@@ -99,7 +264,7 @@ func TestMakeCredential(t *testing.T) {
 	util.CheckErr(err, "Cant create makeCredentialArgs")
 	message := util.Concat([]byte{byte(ctapCommandMakeCredential)}, argBytes)
 
-	responseBytes := ctap.HandleMessage(message)
+	responseBytes := ctap.HandleMessage(context.Background(), 0, message)
 	test.AssertNotNil(t, responseBytes, "Response is nil")
 	code := ctapStatusCode(responseBytes[0])
 	test.AssertEqual(t, code, ctap1ErrSuccess, "Response code is not success")
@@ -115,7 +280,7 @@ func TestMakeCredential(t *testing.T) {
 func TestGetAssertion(t *testing.T) {
 	client := &dummyCTAPClient{}
 	ctap := NewCTAPServer(client)
-	identity := client.vault.NewIdentity(&webauthn.PublicKeyCredentialRPEntity{
+	identity := client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256, &webauthn.PublicKeyCredentialRPEntity{
 		ID: "rp",
 		Name: "rp",
 	}, &webauthn.PublicKeyCrendentialUserEntity{
@@ -140,20 +305,21 @@ func TestGetAssertion(t *testing.T) {
 		PINUVAuthProtocol: 0,
 	}
 	argBytes := util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args))
-	responseBytes := ctap.HandleMessage(argBytes)
+	responseBytes := ctap.HandleMessage(context.Background(), 0, argBytes)
 	test.AssertNotNil(t, responseBytes, "Response is nil")
 	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
 	var response getAssertionResponse
 	err := cbor.Unmarshal(responseBytes[1:], &response)
 	util.CheckErr(err, "Could not decode response")
 	test.Assert(t, bytes.Equal(response.Credential.ID, identity.ID), "Did not return correct identity")
+	test.Assert(t, response.User == nil, "Returned user for non-discoverable assertion")
 }
 
 func TestGetInfo(t *testing.T) {
 	client := &dummyCTAPClient{}
 	ctap := NewCTAPServer(client)
 	argBytes := util.Concat([]byte{byte(ctapCommandGetInfo)})
-	responseBytes := ctap.HandleMessage(argBytes)
+	responseBytes := ctap.HandleMessage(context.Background(), 0, argBytes)
 	test.AssertNotNil(t, responseBytes, "Response is nil")
 	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
 	var response getInfoResponse
@@ -161,7 +327,568 @@ func TestGetInfo(t *testing.T) {
 	util.CheckErr(err, "Could not decode response")
 	test.AssertContains(t, response.Versions, "U2F_V2", "U2F not supported")
 	test.AssertContains(t, response.Versions, "FIDO_2_0", "FIDO2.0 not supported")
+	test.AssertContains(t, response.Versions, "FIDO_2_1", "FIDO2.1 not supported")
 	test.Assert(t, !bytes.Equal(make([]byte,16), response.AAGUID[:]), "AAGUID is empty")
 	test.Assert(t, response.Options.CanResidentKey, "Cant use resident keys")
 	test.Assert(t, !response.Options.IsPlatform, "Is not marked a non-platform auth")
-}
\ No newline at end of file
+	test.AssertEqual(t, response.Algorithms[0].Algorithm, cose.COSE_ALGORITHM_ID_ES256, "ES256 is not the preferred algorithm")
+}
+
+func TestReset(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256, &webauthn.PublicKeyCredentialRPEntity{
+		ID:   "rp",
+		Name: "rp",
+	}, &webauthn.PublicKeyCrendentialUserEntity{
+		ID:          []byte{0, 1, 2, 3, 4},
+		DisplayName: "Alice",
+		Name:        "Alice",
+	})
+	responseBytes := ctap.HandleMessage(context.Background(), 0, []byte{byte(ctapCommandReset)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 0, "Credentials were not wiped")
+
+	ctap.powerUpTime = time.Now().Add(-2 * ctapResetWindow)
+	responseBytes = ctap.HandleMessage(context.Background(), 0, []byte{byte(ctapCommandReset)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNotAllowed, "Reset allowed after power up window")
+}
+
+func TestGetNextAssertion(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"}
+	first := client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256, rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	second := client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256, rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{2}, Name: "Bob"})
+
+	args := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 1, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
+	var response getAssertionResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	test.AssertEqual(t, response.NumberOfCredentials, 2, "Incorrect number of credentials")
+	test.Assert(t, bytes.Equal(response.Credential.ID, second.ID), "Most recent credential was not returned first")
+	test.Assert(t, bytes.Equal(response.User.ID, second.User.ID), "Did not return user of credential")
+	test.AssertEqual(t, response.User.Name, "", "Returned user name without user verification")
+
+	responseBytes = ctap.HandleMessage(context.Background(), 2, []byte{byte(ctapCommandGetNextAssertion)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNotAllowed, "Next assertion returned on another channel")
+
+	responseBytes = ctap.HandleMessage(context.Background(), 1, []byte{byte(ctapCommandGetNextAssertion)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
+	response = getAssertionResponse{}
+	err = cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	test.Assert(t, bytes.Equal(response.Credential.ID, first.ID), "Did not return next credential")
+	test.AssertEqual(t, response.NumberOfCredentials, 0, "Number of credentials returned on next assertion")
+
+	responseBytes = ctap.HandleMessage(context.Background(), 1, []byte{byte(ctapCommandGetNextAssertion)})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNotAllowed, "Returned more credentials than exist")
+}
+
+func TestNonResidentCredential(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	args := makeCredentialArgs{
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		RP:             &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		User:           &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{
+			{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256},
+		},
+		Options: &makeCredentialOptions{ResidentKey: false},
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 0, "Non-resident credential was stored")
+	var response makeCredentialResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	// authData: rpIdHash (32) | flags (1) | counter (4) | AAGUID (16) | credential ID length (2) | credential ID
+	credentialIDLength := util.FromBE[uint16](response.AuthData[53:55])
+	credentialID := response.AuthData[55 : 55+int(credentialIDLength)]
+
+	assertionArgs := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		AllowList: []webauthn.PublicKeyCredentialDescriptor{
+			{Type: "public-key", ID: crypto.RandomBytes(16)},
+			{Type: "public-key", ID: credentialID},
+		},
+	}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
+	var assertionResponse getAssertionResponse
+	err = cbor.Unmarshal(responseBytes[1:], &assertionResponse)
+	util.CheckErr(err, "Could not decode response")
+	test.Assert(t, bytes.Equal(assertionResponse.Credential.ID, credentialID), "Did not return sealed credential")
+
+	assertionArgs.RPID = "other-rp"
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNoCredentials, "Sealed credential used for another RP")
+}
+
+func TestExcludeList(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"}
+	identity := client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256, rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"})
+	args := makeCredentialArgs{
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		RP:             rp,
+		User:           &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{
+			{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256},
+		},
+		ExcludeList: []webauthn.PublicKeyCredentialDescriptor{
+			{Type: "public-key", ID: identity.ID},
+		},
+		Options: &makeCredentialOptions{ResidentKey: true},
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrCredentialExcluded, "Excluded credential was not detected")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 1, "Credential was created despite exclusion")
+
+	args.ExcludeList = []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: crypto.RandomBytes(16)}}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Unknown excluded credential blocked creation")
+}
+
+func TestAlgorithmNegotiation(t *testing.T) {
+	// Self attestations are signed with the credential's key, so they show which algorithm was picked
+	client := &dummyCTAPClient{attestationFormats: map[string]identities.AttestationFormat{"rp": identities.AttestationFormatPackedSelf}}
+	ctap := NewCTAPServer(client)
+	args := makeCredentialArgs{
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		RP:             &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		User:           &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{
+			{Type: "public-key", Algorithm: -65535},
+			{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ED25519},
+			{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256},
+		},
+		Options: &makeCredentialOptions{ResidentKey: true},
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Response is not success")
+	var response makeCredentialResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	test.AssertEqual(t, response.AttestationStatement.Alg, cose.COSE_ALGORITHM_ID_ED25519, "Attestation algorithm does not match")
+	test.Assert(t, client.vault.CredentialSources[0].PrivateKey.Ed25519 != nil, "Did not create an Ed25519 key")
+
+	args.PubKeyCredParams = []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: -65535}}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrUnsupportedAlgorithm, "Unsupported algorithm was accepted")
+
+	// RSA keys can't be sealed into a credential ID, so non-resident ones are stored without being discoverable
+	client = &dummyCTAPClient{attestationFormats: map[string]identities.AttestationFormat{"rp": identities.AttestationFormatPackedSelf}}
+	ctap = NewCTAPServer(client)
+	args.Options = &makeCredentialOptions{ResidentKey: false}
+	args.PubKeyCredParams = []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_RS256}}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Non-resident RSA credential was not made")
+	response = makeCredentialResponse{}
+	err = cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	test.AssertEqual(t, response.AttestationStatement.Alg, cose.COSE_ALGORITHM_ID_RS256, "RS256 was not used for a non-resident credential")
+	test.AssertEqual(t, len(client.vault.CredentialSources), 1, "Non-resident RSA credential was not stored")
+	test.Assert(t, client.vault.CredentialSources[0].NonDiscoverable, "Non-resident RSA credential was stored as discoverable")
+	credentialIDLength := util.FromBE[uint16](response.AuthData[53:55])
+	credentialID := response.AuthData[55 : 55+int(credentialIDLength)]
+	assertionArgs := getAssertionArgs{RPID: "rp", ClientDataHash: crypto.HashSHA256([]byte("assertion"))}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNoCredentials, "Non-resident credential was discoverable")
+	assertionArgs.AllowList = []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: credentialID}}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Non-resident RSA credential could not be used from the allow list")
+}
+
+func TestPINUVAuthProtocols(t *testing.T) {
+	for _, version := range []uint32{1, 2} {
+		client := &dummyCTAPClient{supportsPIN: true}
+		ctap := NewCTAPServer(client)
+		setPIN(client, "1234")
+		pinToken := getPINToken(t, ctap, version, "1234", 0, "")
+		test.AssertArrEqual(t, pinToken, ctap.pinToken.value, "Decrypted PIN token does not match")
+
+		protocol := getPINUVAuthProtocol(version)
+		clientDataHash := crypto.HashSHA256([]byte{0, 1, 2, 3, 4})
+		args := makeCredentialArgs{
+			ClientDataHash:    clientDataHash,
+			RP:                &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+			User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			PINUVAuthParam:    protocol.authenticate(pinToken, clientDataHash),
+			PINUVAuthProtocol: version,
+		}
+		responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "PIN token was not accepted")
+		var response makeCredentialResponse
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Could not decode response")
+		test.Assert(t, authDataFlags(response.AuthData[32])&authDataFlagUserVerified != 0, "User verified flag not set")
+
+		args.PINUVAuthParam = protocol.authenticate(make([]byte, 32), clientDataHash)
+		responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrPINAuthInvalid, "Wrong PIN token was accepted")
+	}
+
+	protocol := pinUVAuthProtocolTwo{}
+	key := protocol.kdf(crypto.RandomBytes(32))
+	plaintext := crypto.RandomBytes(32)
+	ciphertext := protocol.encrypt(key, plaintext)
+	test.Assert(t, !bytes.Equal(ciphertext, protocol.encrypt(key, plaintext)), "Protocol 2 encryption is not randomized")
+	decrypted, err := protocol.decrypt(key, ciphertext)
+	util.CheckErr(err, "Could not decrypt")
+	test.AssertArrEqual(t, decrypted, plaintext, "Decrypted data does not match")
+	test.AssertEqual(t, len(protocol.authenticate(key, plaintext)), 32, "Protocol 2 pinUvAuthParam is not 32 bytes")
+}
+
+func TestPINUVAuthTokenPermissions(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	setPIN(client, "1234")
+	protocol := pinUVAuthProtocolTwo{}
+	clientDataHash := crypto.HashSHA256([]byte{0, 1, 2, 3, 4})
+	makeCredential := func(pinToken []byte, rpID string) ctapStatusCode {
+		args := makeCredentialArgs{
+			ClientDataHash:    clientDataHash,
+			RP:                &webauthn.PublicKeyCredentialRPEntity{ID: rpID, Name: rpID},
+			User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			PINUVAuthParam:    protocol.authenticate(pinToken, clientDataHash),
+			PINUVAuthProtocol: 2,
+		}
+		responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		return ctapStatusCode(responseBytes[0])
+	}
+
+	pinToken := getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionGetAssertion, "")
+	test.AssertEqual(t, makeCredential(pinToken, "rp"), ctap2ErrPINAuthInvalid, "Token without mc permission was accepted")
+
+	pinToken = getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionMakeCredential, "rp")
+	test.AssertEqual(t, makeCredential(pinToken, "other"), ctap2ErrPINAuthInvalid, "Token was accepted for another RP")
+	test.AssertEqual(t, makeCredential(pinToken, "rp"), ctap1ErrSuccess, "Token was not accepted")
+	test.AssertEqual(t, makeCredential(pinToken, "rp"), ctap2ErrPINAuthInvalid, "Token was accepted twice")
+
+	oldPINToken := pinToken
+	pinToken = getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionMakeCredential, "")
+	test.AssertEqual(t, makeCredential(oldPINToken, "rp"), ctap2ErrPINAuthInvalid, "Old token was accepted after rotation")
+	ctap.pinToken.issuedAt = time.Now().Add(-pinUVAuthTokenInitialUsageWindow - time.Second)
+	test.AssertEqual(t, makeCredential(pinToken, "rp"), ctap2ErrPINAuthInvalid, "Expired token was accepted")
+
+	args := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand:        clientPINSubcommandGetPINUVAuthTokenUsingPINWithPermissions,
+		KeyAgreement:      &cose.COSEEC2Key{},
+		PINHashEncoding:   make([]byte, 32),
+		Permissions:       pinUVAuthPermissionBioEnrollment,
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrUnauthorizedPermission, "Unsupported permission was granted")
+}
+
+func TestPINLockout(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	setPIN(client, "1234")
+
+	keyAgreement := ctap.pinPolicy.keyAgreement
+	_, status := requestPINToken(t, ctap, 2, "0000", 0, "")
+	test.AssertEqual(t, status, ctap2ErrPINInvalid, "Wrong PIN was accepted")
+	test.Assert(t, ctap.pinPolicy.keyAgreement != keyAgreement, "Key agreement key was not regenerated")
+	requestPINToken(t, ctap, 2, "0000", 0, "")
+	_, status = requestPINToken(t, ctap, 2, "0000", 0, "")
+	test.AssertEqual(t, status, ctap2ErrPINAuthBlocked, "PIN was not blocked after consecutive failures")
+	_, status = requestPINToken(t, ctap, 2, "1234", 0, "")
+	test.AssertEqual(t, status, ctap2ErrPINAuthBlocked, "PIN was accepted before a power cycle")
+	test.AssertEqual(t, client.PINRetries(), int32(pinMaxRetries-3), "Blocked attempt used up a retry")
+
+	// A new server is a power cycle, but the retries are kept by the client
+	ctap = NewCTAPServer(client)
+	getPINToken(t, ctap, 2, "1234", 0, "")
+	test.AssertEqual(t, client.PINRetries(), int32(pinMaxRetries), "Retries were not restored after the right PIN")
+
+	client.SetPINRetries(1)
+	_, status = requestPINToken(t, ctap, 2, "0000", 0, "")
+	test.AssertEqual(t, status, ctap2ErrPINBlocked, "PIN was not blocked after the last retry")
+	_, status = requestPINToken(t, NewCTAPServer(client), 2, "1234", 0, "")
+	test.AssertEqual(t, status, ctap2ErrPINBlocked, "Power cycle unblocked the PIN")
+}
+
+func TestBuiltInUserVerification(t *testing.T) {
+	verified := true
+	client := &dummyCTAPClient{supportsPIN: true, verifyUser: func(ctx context.Context, relyingPartyID string) bool { return verified }}
+	client.SetUVRetries(uvMaxRetries)
+	ctap := NewCTAPServer(client)
+	test.Assert(t, getInfo(t, ctap).Options.CanUserVerification != nil, "uv option not reported")
+	makeCredential := func() ctapStatusCode {
+		args := makeCredentialArgs{
+			ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			RP: &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+			User: &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			Options: &makeCredentialOptions{ResidentKey: true, UserVerification: true},
+		}
+		responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+		if ctapStatusCode(responseBytes[0]) == ctap1ErrSuccess {
+			var response makeCredentialResponse
+			err := cbor.Unmarshal(responseBytes[1:], &response)
+			util.CheckErr(err, "Could not decode response")
+			test.Assert(t, authDataFlags(response.AuthData[32])&authDataFlagUserVerified != 0, "UV flag not set")
+		}
+		return ctapStatusCode(responseBytes[0])
+	}
+	getUVRetries := func() uint8 {
+		args := clientPINArgs{PINUVAuthProtocol: 2, SubCommand: clientPINSubcommandGetUVRetries}
+		responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not get UV retries")
+		var response clientPINResponse
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Could not decode response")
+		return *response.UVRetries
+	}
+
+	test.AssertEqual(t, makeCredential(), ctap1ErrSuccess, "Could not make credential with built-in UV")
+	verified = false
+	test.AssertEqual(t, makeCredential(), ctap2ErrUVInvalid, "Failed verification was accepted")
+	test.AssertEqual(t, getUVRetries(), uint8(uvMaxRetries-1), "Failed verification didn't use up a retry")
+
+	// Bad key agreements are rejected before the user is asked, so they can't use up retries
+	badTokenArgs := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand: clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions,
+		KeyAgreement: &cose.COSEEC2Key{KeyType: 2, Algorithm: -25, Curve: 1, X: []byte{1}, Y: []byte{2}},
+		Permissions: pinUVAuthPermissionGetAssertion,
+		RPID: "rp",
+	}
+	status := ctapStatusCode(ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(badTokenArgs)))[0])
+	test.AssertEqual(t, status, ctap1ErrInvalidParameter, "Bad key agreement was accepted")
+	test.AssertEqual(t, getUVRetries(), uint8(uvMaxRetries-1), "Bad key agreement used up a retry")
+	// Platforms like libfido2 leave the protocol out when asking for retries
+	for _, subCommand := range []clientPINSubcommand{clientPINSubcommandGetRetries, clientPINSubcommandGetUVRetries} {
+		args := clientPINArgs{SubCommand: subCommand}
+		status = ctapStatusCode(ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))[0])
+		test.AssertEqual(t, status, ctap1ErrSuccess, "Retries were not returned without a protocol")
+	}
+
+	verified = true
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, 2)
+	tokenArgs := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand: clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions,
+		KeyAgreement: keyAgreement,
+		Permissions: pinUVAuthPermissionGetAssertion,
+		RPID: "rp",
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(tokenArgs)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not get token with built-in UV")
+	var tokenResponse clientPINResponse
+	err := cbor.Unmarshal(responseBytes[1:], &tokenResponse)
+	util.CheckErr(err, "Could not decode response")
+	protocol := getPINUVAuthProtocol(2)
+	pinToken, err := protocol.decrypt(sharedSecret, tokenResponse.PinToken)
+	util.CheckErr(err, "Could not decrypt token")
+	test.AssertEqual(t, getUVRetries(), uint8(uvMaxRetries), "Retries were not restored after verification")
+	clientDataHash := crypto.HashSHA256([]byte("assertion"))
+	assertionArgs := getAssertionArgs{
+		RPID: "rp",
+		ClientDataHash: clientDataHash,
+		PINUVAuthParam: protocol.authenticate(pinToken, clientDataHash),
+		PINUVAuthProtocol: 2,
+	}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Token from built-in UV was rejected")
+
+	client.SetUVRetries(1)
+	verified = false
+	test.AssertEqual(t, makeCredential(), ctap2ErrUVBlocked, "Last failed verification didn't block UV")
+	verified = true
+	test.AssertEqual(t, makeCredential(), ctap2ErrUVBlocked, "Blocked UV was used")
+
+	ctap = NewCTAPServer(&dummyCTAPClient{})
+	test.Assert(t, getInfo(t, ctap).Options.CanUserVerification == nil, "uv option reported without a verifier")
+	test.AssertEqual(t, makeCredential(), ctap2ErrInvalidOption, "uv option accepted without a verifier")
+}
+
+func TestCancelUserVerification(t *testing.T) {
+	prompted := make(chan struct{})
+	client := &dummyCTAPClient{supportsPIN: true, verifyUser: func(ctx context.Context, relyingPartyID string) bool {
+		close(prompted)
+		// The user never answers, so only a cancel can end the prompt
+		<-ctx.Done()
+		return true
+	}}
+	client.SetUVRetries(uvMaxRetries)
+	ctap := NewCTAPServer(client)
+	keyAgreement, _ := platformKeyAgreement(t, ctap, 2)
+	args := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand: clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions,
+		KeyAgreement: keyAgreement,
+		Permissions: pinUVAuthPermissionGetAssertion,
+		RPID: "rp",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	responses := make(chan []byte)
+	go func() {
+		responses <- ctap.HandleMessage(ctx, 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	}()
+	<-prompted
+	cancel()
+	test.AssertArrEqual(t, <-responses, []byte{byte(ctap2ErrKeepaliveCancel)}, "Cancelled verification was not reported as cancelled")
+	test.AssertEqual(t, client.UVRetries(), int32(uvMaxRetries), "Cancelled verification used up a retry")
+}
+
+func TestSelection(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	response := ctap.HandleMessage(context.Background(), 0, []byte{byte(ctapCommandSelection)})
+	test.AssertArrEqual(t, response, []byte{byte(ctap1ErrSuccess)}, "Selection was not approved")
+	client.denySelection = true
+	response = ctap.HandleMessage(context.Background(), 0, []byte{byte(ctapCommandSelection)})
+	test.AssertArrEqual(t, response, []byte{byte(ctap2ErrOperationDenied)}, "Denied selection succeeded")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	response = ctap.HandleMessage(ctx, 0, []byte{byte(ctapCommandSelection)})
+	test.AssertArrEqual(t, response, []byte{byte(ctap2ErrKeepaliveCancel)}, "Cancelled selection was not reported as cancelled")
+}
+
+// Run with -race: each channel takes PIN tokens and writes large blobs, which share the server's state
+func TestConcurrentChannels(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	setPIN(client, "1234")
+	ctap := NewCTAPServer(client)
+	protocol := getPINUVAuthProtocol(2)
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, 2)
+	tokenArgs := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand: clientPINSubcommandGetPINUVAuthTokenUsingPINWithPermissions,
+		KeyAgreement: keyAgreement,
+		PINHashEncoding: protocol.encrypt(sharedSecret, crypto.HashSHA256([]byte("1234"))[:16]),
+		Permissions: pinUVAuthPermissionLargeBlobWrite,
+	}
+	tokenMessage := util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(tokenArgs))
+	array := serializeLargeBlobArray([]map[int][]byte{{1: []byte("ciphertext"), 2: []byte("nonce"), 3: {10}}})
+	setHash := sha256.Sum256(array)
+	writeMessage := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandLargeBlobs), 0x00}, util.ToLE(uint32(0)), setHash[:])
+
+	statuses := make([][]ctapStatusCode, 2)
+	var wait sync.WaitGroup
+	for i := range statuses {
+		wait.Add(1)
+		go func(channelID uint32) {
+			defer wait.Done()
+			for j := 0; j < 100; j++ {
+				responseBytes := ctap.HandleMessage(context.Background(), channelID, tokenMessage)
+				statuses[channelID-1] = append(statuses[channelID-1], ctapStatusCode(responseBytes[0]))
+				if ctapStatusCode(responseBytes[0]) != ctap1ErrSuccess {
+					continue
+				}
+				var response clientPINResponse
+				util.CheckErr(cbor.Unmarshal(responseBytes[1:], &response), "Could not decode response")
+				pinToken, err := protocol.decrypt(sharedSecret, response.PinToken)
+				util.CheckErr(err, "Could not decrypt PIN token")
+				var offset uint32 = 0
+				length := uint32(len(array))
+				args := largeBlobsArgs{
+					Set: array,
+					Offset: &offset,
+					Length: &length,
+					PINUVAuthParam: protocol.authenticate(pinToken, writeMessage),
+					PINUVAuthProtocol: 2,
+				}
+				// The other channel may have replaced the token in between, or still be running a command
+				status := ctapStatusCode(ctap.HandleMessage(context.Background(), channelID, util.Concat([]byte{byte(ctapCommandLargeBlobs)}, util.MarshalCBOR(args)))[0])
+				statuses[channelID-1] = append(statuses[channelID-1], status)
+			}
+		}(uint32(i + 1))
+	}
+	wait.Wait()
+	for _, channelStatuses := range statuses {
+		for _, status := range channelStatuses {
+			test.Assert(t, status == ctap1ErrSuccess || status == ctap2ErrPINAuthInvalid || status == ctap1ErrChannelBusy, "Unexpected status from concurrent channels")
+		}
+	}
+	pinToken := getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionLargeBlobWrite, "")
+	test.AssertEqual(t, writeLargeBlobArray(ctap, array, pinToken), ctap1ErrSuccess, "Could not write large blobs after concurrent writes")
+	test.AssertArrEqual(t, readLargeBlobArray(t, ctap), array, "Large blob array was corrupted")
+}
+
+func TestPromptDoesNotBlockOtherChannels(t *testing.T) {
+	prompted := make(chan struct{})
+	client := &dummyCTAPClient{supportsPIN: true, verifyUser: func(ctx context.Context, relyingPartyID string) bool {
+		close(prompted)
+		<-ctx.Done()
+		return false
+	}}
+	client.SetUVRetries(uvMaxRetries)
+	ctap := NewCTAPServer(client)
+	keyAgreement, _ := platformKeyAgreement(t, ctap, 2)
+	args := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand: clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions,
+		KeyAgreement: keyAgreement,
+		Permissions: pinUVAuthPermissionGetAssertion,
+		RPID: "rp",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	responses := make(chan []byte)
+	go func() {
+		responses <- ctap.HandleMessage(ctx, 1, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	}()
+	<-prompted
+	// Other channels are answered straight away instead of waiting for the user
+	response := ctap.HandleMessage(context.Background(), 2, []byte{byte(ctapCommandGetInfo)})
+	test.AssertArrEqual(t, response, []byte{byte(ctap1ErrChannelBusy)}, "Command on another channel was not turned away during a prompt")
+	response = ctap.HandleMessage(context.Background(), 2, []byte{byte(ctapCommandSelection)})
+	test.AssertArrEqual(t, response, []byte{byte(ctap1ErrSuccess)}, "Selection was blocked by a prompt on another channel")
+	cancel()
+	test.AssertArrEqual(t, <-responses, []byte{byte(ctap2ErrKeepaliveCancel)}, "Cancelled verification was not reported as cancelled")
+	response = ctap.HandleMessage(context.Background(), 2, []byte{byte(ctapCommandGetInfo)})
+	test.AssertEqual(t, ctapStatusCode(response[0]), ctap1ErrSuccess, "Channel still busy after the prompt ended")
+}
+
+func TestMalformedMessages(t *testing.T) {
+	ctap := NewCTAPServer(&dummyCTAPClient{supportsPIN: true, bioSensor: &scriptedBioSensor{}})
+	expectStatus := func(message []byte, expected ctapStatusCode, description string) {
+		response := ctap.HandleMessage(context.Background(), 0, message)
+		test.AssertArrEqual(t, response, []byte{byte(expected)}, description)
+	}
+	expectStatus([]byte{}, ctap1ErrInvalidLength, "Empty message was accepted")
+	expectStatus([]byte{0x42}, ctap1ErrInvalidCommand, "Unknown command was accepted")
+	for _, command := range []ctapCommand{
+		ctapCommandMakeCredential,
+		ctapCommandGetAssertion,
+		ctapCommandClientPIN,
+		ctapCommandBioEnrollment,
+		ctapCommandCredentialManagement,
+		ctapCommandLargeBlobs,
+		ctapCommandAuthenticatorConfig,
+	} {
+		expectStatus([]byte{byte(command), 0xA1, 0x01}, ctap2ErrInvalidCBOR, "Truncated CBOR was accepted for " + ctapCommandDescriptions[command])
+		expectStatus([]byte{byte(command), 0x01}, ctap2ErrInvalidCBOR, "CBOR that isn't a map was accepted for " + ctapCommandDescriptions[command])
+	}
+	expectStatus(util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(makeCredentialArgs{})), ctap2ErrMissingParam, "Credential made without required parameters")
+	expectStatus(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(getAssertionArgs{})), ctap2ErrMissingParam, "Assertion made without required parameters")
+	pinArgs := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand: clientPINSubcommandSetPIN,
+		KeyAgreement: &cose.COSEEC2Key{KeyType: 2, Algorithm: -25, Curve: 1, X: []byte{1}, Y: []byte{2}},
+		PINUVAuthParam: make([]byte, 32),
+		NewPINEncoding: make([]byte, 80),
+	}
+	expectStatus(util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(pinArgs)), ctap1ErrInvalidParameter, "Key agreement point off the curve was accepted")
+	// Credential IDs come from the RP, so one that decodes as a sealed box with a bad nonce must not be opened
+	assertionArgs := getAssertionArgs{
+		RPID: "example.com",
+		ClientDataHash: crypto.HashSHA256([]byte("clientData")),
+		AllowList: []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: util.MarshalCBOR(crypto.EncryptedBox{Data: make([]byte, 16)})}},
+	}
+	expectStatus(util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs)), ctap2ErrNoCredentials, "Credential ID with an empty nonce was accepted")
+}
@@ -0,0 +1,119 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+)
+
+// Extensions advertised in GetInfo
+var supportedExtensions = []string{"hmac-secret", "hmac-secret-mc", "credProtect", "credBlob", "largeBlobKey", "minPinLength"}
+
+// Larger credBlobs are refused, and sealed into credential IDs for non-resident credentials, so they have to stay small
+const maxCredBlobLength = 32
+
+type makeCredentialExtensions struct {
+	HMACSecret bool `cbor:"hmac-secret,omitempty"`
+	// Evaluates hmac-secret as soon as the credential is created, so that WebAuthn PRF outputs are available at registration
+	HMACSecretMC *hmacSecretInput              `cbor:"hmac-secret-mc,omitempty"`
+	CredProtect  webauthn.CredentialProtection `cbor:"credProtect,omitempty"`
+	CredBlob     []byte                        `cbor:"credBlob,omitempty"`
+	// Only valid for resident credentials, and only true may be requested
+	LargeBlobKey *bool `cbor:"largeBlobKey,omitempty"`
+	MinPINLength bool  `cbor:"minPinLength,omitempty"`
+}
+
+type makeCredentialExtensionOutputs struct {
+	HMACSecret   bool                          `cbor:"hmac-secret,omitempty"`
+	HMACSecretMC []byte                        `cbor:"hmac-secret-mc,omitempty"`
+	CredProtect  webauthn.CredentialProtection `cbor:"credProtect,omitempty"`
+	// Whether the credBlob was stored, since it's left out if it's too long
+	CredBlob *bool `cbor:"credBlob,omitempty"`
+	// Left out for relying parties that aren't allowed to see it
+	MinPINLength uint32 `cbor:"minPinLength,omitempty"`
+}
+
+type getAssertionExtensions struct {
+	HMACSecret   *hmacSecretInput `cbor:"hmac-secret,omitempty"`
+	CredBlob     bool             `cbor:"credBlob,omitempty"`
+	LargeBlobKey bool             `cbor:"largeBlobKey,omitempty"`
+}
+
+type getAssertionExtensionOutputs struct {
+	HMACSecret []byte `cbor:"hmac-secret,omitempty"`
+	// Set whenever credBlob was requested, since a credential without one still gets an empty byte string
+	CredBlob *[]byte `cbor:"credBlob,omitempty"`
+}
+
+// Extension outputs are only included in the authData if there are any
+func encodeExtensionOutputs(outputs interface{}) []byte {
+	encoded := util.MarshalCBOR(outputs)
+	if len(encoded) == 1 {
+		// Empty map
+		return nil
+	}
+	return encoded
+}
+
+type hmacSecretInput struct {
+	KeyAgreement      *cose.COSEEC2Key `cbor:"1,keyasint,omitempty"`
+	SaltEnc           []byte           `cbor:"2,keyasint,omitempty"`
+	SaltAuth          []byte           `cbor:"3,keyasint,omitempty"`
+	PINUVAuthProtocol uint32           `cbor:"4,keyasint,omitempty"`
+}
+
+// A decrypted hmac-secret request, applied to each credential it's used with
+type hmacSecretRequest struct {
+	protocol     pinUVAuthProtocol
+	sharedSecret []byte
+	salts        [][]byte
+}
+
+func (server *CTAPServer) decodeHMACSecretInput(input *hmacSecretInput) (*hmacSecretRequest, ctapStatusCode) {
+	if input.KeyAgreement == nil || input.SaltEnc == nil || input.SaltAuth == nil {
+		return nil, ctap2ErrMissingParam
+	}
+	protocolVersion := input.PINUVAuthProtocol
+	if protocolVersion == 0 {
+		// Platforms that predate protocol 2 leave the protocol out
+		protocolVersion = 1
+	}
+	protocol := getPINUVAuthProtocol(protocolVersion)
+	if protocol == nil {
+		return nil, ctap1ErrInvalidParameter
+	}
+	sharedSecret, status := server.getPINSharedSecret(protocol, *input.KeyAgreement)
+	if status != ctap1ErrSuccess {
+		return nil, status
+	}
+	if !verifyPINUVAuth(protocol, sharedSecret, input.SaltEnc, input.SaltAuth) {
+		return nil, ctap2ErrPINAuthInvalid
+	}
+	salts, err := protocol.decrypt(sharedSecret, input.SaltEnc)
+	if err != nil || (len(salts) != 32 && len(salts) != 64) {
+		return nil, ctap1ErrInvalidLength
+	}
+	request := &hmacSecretRequest{
+		protocol:     protocol,
+		sharedSecret: sharedSecret,
+		salts:        [][]byte{salts[:32]},
+	}
+	if len(salts) == 64 {
+		request.salts = append(request.salts, salts[32:])
+	}
+	return request, ctap1ErrSuccess
+}
+
+// Returns the encrypted HMACs of the salts, or nil if the credential has no secret
+func (request *hmacSecretRequest) output(credentialSource *identities.CredentialSource, userVerified bool) []byte {
+	outputs := make([]byte, 0)
+	for _, salt := range request.salts {
+		output := credentialSource.HMACSecret(salt, userVerified)
+		if output == nil {
+			return nil
+		}
+		outputs = append(outputs, output...)
+	}
+	return request.protocol.encrypt(request.sharedSecret, outputs)
+}
@@ -0,0 +1,318 @@
+package ctap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/cose"
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/bulwarkid/virtual-fido/webauthn"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Assertions carry no attested credential data, so extensions start right after the counter
+func assertionExtensionOutputs(t *testing.T, responseBytes []byte) getAssertionExtensionOutputs {
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Assertion failed")
+	var response getAssertionResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode assertion")
+	var outputs getAssertionExtensionOutputs
+	if authDataFlags(response.AuthenticatorData[32])&authDataFlagExtensionDataIncluded != 0 {
+		err = cbor.Unmarshal(response.AuthenticatorData[37:], &outputs)
+		util.CheckErr(err, "Could not decode extension outputs")
+	}
+	return outputs
+}
+
+func TestHMACSecret(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:       &makeCredentialExtensions{HMACSecret: true},
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+	var response makeCredentialResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	test.Assert(t, authDataFlags(response.AuthData[32])&authDataFlagExtensionDataIncluded != 0, "Extension data flag not set")
+	test.Assert(t, bytes.HasSuffix(response.AuthData, util.MarshalCBOR(makeCredentialExtensionOutputs{HMACSecret: true})), "hmac-secret output missing")
+	credentialIDLength := util.FromBE[uint16](response.AuthData[53:55])
+	credentialID := response.AuthData[55 : 55+int(credentialIDLength)]
+
+	for _, version := range []uint32{1, 2} {
+		protocol := getPINUVAuthProtocol(version)
+		keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, version)
+		salt := crypto.RandomBytes(32)
+		saltEnc := protocol.encrypt(sharedSecret, salt)
+		noUserPresence := false
+		assertionArgs := getAssertionArgs{
+			RPID:           "rp",
+			ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: credentialID}},
+			Extensions: &getAssertionExtensions{HMACSecret: &hmacSecretInput{
+				KeyAgreement:      keyAgreement,
+				SaltEnc:           saltEnc,
+				SaltAuth:          protocol.authenticate(sharedSecret, saltEnc),
+				PINUVAuthProtocol: version,
+			}},
+			Options: getAssertionOptions{UserPresence: &noUserPresence},
+		}
+		message := util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs))
+		outputs := assertionExtensionOutputs(t, ctap.HandleMessage(context.Background(), 0, message))
+		decrypted, err := protocol.decrypt(sharedSecret, outputs.HMACSecret)
+		util.CheckErr(err, "Could not decrypt hmac-secret output")
+
+		credentialSource := ctap.openCredentialID("rp", credentialID)
+		mac := hmac.New(sha256.New, credentialSource.CredRandomWithoutUV)
+		mac.Write(salt)
+		test.AssertArrEqual(t, decrypted, mac.Sum(nil), "hmac-secret output does not match")
+		repeated, err := protocol.decrypt(sharedSecret, assertionExtensionOutputs(t, ctap.HandleMessage(context.Background(), 0, message)).HMACSecret)
+		util.CheckErr(err, "Could not decrypt hmac-secret output")
+		test.AssertArrEqual(t, repeated, decrypted, "hmac-secret output is not stable")
+
+		assertionArgs.Extensions.HMACSecret.SaltAuth = make([]byte, len(assertionArgs.Extensions.HMACSecret.SaltAuth))
+		responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrPINAuthInvalid, "Invalid saltAuth was accepted")
+	}
+
+	// Credentials made without the extension have no secrets, so asking for one gives no output
+	args.Extensions = nil
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+	response = makeCredentialResponse{}
+	err = cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	test.Assert(t, authDataFlags(response.AuthData[32])&authDataFlagExtensionDataIncluded == 0, "Extension data included without extensions")
+	credentialIDLength = util.FromBE[uint16](response.AuthData[53:55])
+	credentialID = response.AuthData[55 : 55+int(credentialIDLength)]
+	credentialSource := ctap.openCredentialID("rp", credentialID)
+	test.Assert(t, credentialSource.CredRandomWithUV == nil && credentialSource.CredRandomWithoutUV == nil, "Secrets generated without hmac-secret")
+
+	protocol := getPINUVAuthProtocol(2)
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, 2)
+	saltEnc := protocol.encrypt(sharedSecret, crypto.RandomBytes(32))
+	noUserPresence := false
+	assertionArgs := getAssertionArgs{
+		RPID:           "rp",
+		ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: credentialID}},
+		Extensions: &getAssertionExtensions{HMACSecret: &hmacSecretInput{
+			KeyAgreement:      keyAgreement,
+			SaltEnc:           saltEnc,
+			SaltAuth:          protocol.authenticate(sharedSecret, saltEnc),
+			PINUVAuthProtocol: 2,
+		}},
+		Options: getAssertionOptions{UserPresence: &noUserPresence},
+	}
+	outputs := assertionExtensionOutputs(t, ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(assertionArgs))))
+	test.Assert(t, outputs.HMACSecret == nil, "hmac-secret output for a credential without secrets")
+}
+
+func TestHMACSecretMC(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	protocol := getPINUVAuthProtocol(2)
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, 2)
+	// Browsers hash WebAuthn PRF inputs into salts, so the output has to match the library's PRF helper
+	prfInput := []byte("encryption key")
+	salt := sha256.Sum256(append([]byte("WebAuthn PRF\x00"), prfInput...))
+	saltEnc := protocol.encrypt(sharedSecret, salt[:])
+	args := makeCredentialArgs{
+		ClientDataHash:   crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+		RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+		User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+		PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions: &makeCredentialExtensions{
+			HMACSecret: true,
+			HMACSecretMC: &hmacSecretInput{
+				KeyAgreement:      keyAgreement,
+				SaltEnc:           saltEnc,
+				SaltAuth:          protocol.authenticate(sharedSecret, saltEnc),
+				PINUVAuthProtocol: 2,
+			},
+		},
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+	var response makeCredentialResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	credentialIDLength := util.FromBE[uint16](response.AuthData[53:55])
+	credentialID := response.AuthData[55 : 55+int(credentialIDLength)]
+
+	// Extension outputs follow the credential public key
+	decoder := cbor.NewDecoder(bytes.NewReader(response.AuthData[55+int(credentialIDLength):]))
+	var publicKey cbor.RawMessage
+	util.CheckErr(decoder.Decode(&publicKey), "Could not decode public key")
+	var outputs makeCredentialExtensionOutputs
+	util.CheckErr(decoder.Decode(&outputs), "Could not decode extension outputs")
+	test.Assert(t, outputs.HMACSecret, "hmac-secret output missing")
+	decrypted, err := protocol.decrypt(sharedSecret, outputs.HMACSecretMC)
+	util.CheckErr(err, "Could not decrypt hmac-secret-mc output")
+
+	credentialSource := ctap.openCredentialID("rp", credentialID)
+	test.AssertArrEqual(t, decrypted, credentialSource.HMACSecret(salt[:], false), "hmac-secret-mc output does not match")
+	test.AssertArrEqual(t, decrypted, credentialSource.PRF(prfInput, false), "PRF output does not match")
+	test.AssertNotEqual(t, string(credentialSource.PRF(prfInput, true)), string(decrypted), "PRF output does not depend on user verification")
+
+	args.Extensions.HMACSecretMC.SaltAuth = make([]byte, 32)
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrPINAuthInvalid, "Invalid saltAuth was accepted")
+}
+
+func TestCredProtect(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	rp := &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"}
+	protections := []webauthn.CredentialProtection{
+		webauthn.CredentialProtectionUserVerificationOptional,
+		webauthn.CredentialProtectionUserVerificationOptionalWithCredentialIDList,
+		webauthn.CredentialProtectionUserVerificationRequired,
+	}
+	sources := make([]*identities.CredentialSource, 0)
+	for i, protection := range protections {
+		source := client.vault.NewIdentity(cose.COSE_ALGORITHM_ID_ES256, rp, &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{byte(i)}, Name: "Alice"})
+		source.Protection = protection
+		sources = append(sources, source)
+	}
+	getAssertion := func(allowList []webauthn.PublicKeyCredentialDescriptor, pinToken []byte) []byte {
+		clientDataHash := crypto.HashSHA256([]byte{0, 1, 2, 3, 4})
+		args := getAssertionArgs{RPID: "rp", ClientDataHash: clientDataHash, AllowList: allowList}
+		if pinToken != nil {
+			args.PINUVAuthParam = getPINUVAuthProtocol(2).authenticate(pinToken, clientDataHash)
+			args.PINUVAuthProtocol = 2
+		}
+		return ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+	}
+	assertionCount := func(responseBytes []byte) int32 {
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Assertion failed")
+		var response getAssertionResponse
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Could not decode assertion")
+		if response.NumberOfCredentials == 0 {
+			return 1
+		}
+		return response.NumberOfCredentials
+	}
+
+	test.AssertEqual(t, assertionCount(getAssertion(nil, nil)), 1, "Protected credentials were discoverable without user verification")
+	allowed := []webauthn.PublicKeyCredentialDescriptor{sources[1].CTAPDescriptor()}
+	test.AssertEqual(t, assertionCount(getAssertion(allowed, nil)), 1, "Credential ID list did not unlock credential")
+	required := []webauthn.PublicKeyCredentialDescriptor{sources[2].CTAPDescriptor()}
+	responseBytes := getAssertion(required, nil)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNoCredentials, "Credential requiring user verification was used without it")
+
+	setPIN(client, "1234")
+	pinToken := getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionGetAssertion, "")
+	test.AssertEqual(t, assertionCount(getAssertion(nil, pinToken)), 3, "Protected credentials were hidden after user verification")
+
+	// Non-resident credentials carry their protection in the credential ID
+	pinToken = getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionMakeCredential, "")
+	clientDataHash := crypto.HashSHA256([]byte{0, 1, 2, 3, 4})
+	args := makeCredentialArgs{
+		ClientDataHash:    clientDataHash,
+		RP:                rp,
+		User:              &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{5}, Name: "Bob"},
+		PubKeyCredParams:  []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+		Extensions:        &makeCredentialExtensions{CredProtect: webauthn.CredentialProtectionUserVerificationRequired},
+		PINUVAuthParam:    getPINUVAuthProtocol(2).authenticate(pinToken, clientDataHash),
+		PINUVAuthProtocol: 2,
+	}
+	responseBytes = ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+	var response makeCredentialResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	test.Assert(t, bytes.HasSuffix(response.AuthData, util.MarshalCBOR(makeCredentialExtensionOutputs{CredProtect: webauthn.CredentialProtectionUserVerificationRequired})), "credProtect output missing")
+	credentialIDLength := util.FromBE[uint16](response.AuthData[53:55])
+	credentialID := response.AuthData[55 : 55+int(credentialIDLength)]
+	client.pinHash = nil
+	responseBytes = getAssertion([]webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: credentialID}}, nil)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrNoCredentials, "Non-resident credential was used without user verification")
+}
+
+func TestCredBlobAndLargeBlobKey(t *testing.T) {
+	client := &dummyCTAPClient{}
+	ctap := NewCTAPServer(client)
+	largeBlobKey := true
+	makeCredential := func(extensions *makeCredentialExtensions, residentKey bool) []byte {
+		args := makeCredentialArgs{
+			ClientDataHash:   crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			RP:               &webauthn.PublicKeyCredentialRPEntity{ID: "rp", Name: "rp"},
+			User:             &webauthn.PublicKeyCrendentialUserEntity{ID: []byte{1}, Name: "Alice"},
+			PubKeyCredParams: []webauthn.PublicKeyCredentialParams{{Type: "public-key", Algorithm: cose.COSE_ALGORITHM_ID_ES256}},
+			Extensions:       extensions,
+			Options:          &makeCredentialOptions{ResidentKey: residentKey},
+		}
+		return ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandMakeCredential)}, util.MarshalCBOR(args)))
+	}
+	getAssertion := func(credentialID []byte) getAssertionResponse {
+		args := getAssertionArgs{
+			RPID:           "rp",
+			ClientDataHash: crypto.HashSHA256([]byte{0, 1, 2, 3, 4}),
+			AllowList:      []webauthn.PublicKeyCredentialDescriptor{{Type: "public-key", ID: credentialID}},
+			Extensions:     &getAssertionExtensions{CredBlob: true, LargeBlobKey: true},
+		}
+		responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandGetAssertion)}, util.MarshalCBOR(args)))
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Assertion failed")
+		var response getAssertionResponse
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Could not decode assertion")
+		return response
+	}
+	blob := []byte("cert:1234")
+
+	for _, residentKey := range []bool{true, false} {
+		extensions := &makeCredentialExtensions{CredBlob: blob}
+		if residentKey {
+			extensions.LargeBlobKey = &largeBlobKey
+		}
+		responseBytes := makeCredential(extensions, residentKey)
+		test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+		var response makeCredentialResponse
+		err := cbor.Unmarshal(responseBytes[1:], &response)
+		util.CheckErr(err, "Could not decode response")
+		stored := true
+		test.Assert(t, bytes.HasSuffix(response.AuthData, util.MarshalCBOR(makeCredentialExtensionOutputs{CredBlob: &stored})), "credBlob output missing")
+		credentialIDLength := util.FromBE[uint16](response.AuthData[53:55])
+		credentialID := response.AuthData[55 : 55+int(credentialIDLength)]
+
+		assertion := getAssertion(credentialID)
+		var outputs getAssertionExtensionOutputs
+		err = cbor.Unmarshal(assertion.AuthenticatorData[37:], &outputs)
+		util.CheckErr(err, "Could not decode extension outputs")
+		test.Assert(t, outputs.CredBlob != nil, "credBlob output missing")
+		test.AssertArrEqual(t, *outputs.CredBlob, blob, "credBlob not returned")
+		if residentKey {
+			test.AssertEqual(t, len(response.LargeBlobKey), 32, "largeBlobKey not generated")
+			test.AssertArrEqual(t, assertion.LargeBlobKey, response.LargeBlobKey, "largeBlobKey not returned")
+			test.AssertArrEqual(t, client.vault.CredentialSources[0].CredBlob, blob, "credBlob not stored")
+		}
+	}
+
+	responseBytes := makeCredential(&makeCredentialExtensions{CredBlob: make([]byte, maxCredBlobLength+1)}, true)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not make credential")
+	var response makeCredentialResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	stored := false
+	test.Assert(t, bytes.HasSuffix(response.AuthData, util.MarshalCBOR(makeCredentialExtensionOutputs{CredBlob: &stored})), "Oversized credBlob was stored")
+	// A credential without a blob still answers a credBlob request, with an empty byte string
+	credentialIDLength := util.FromBE[uint16](response.AuthData[53:55])
+	assertion := getAssertion(response.AuthData[55 : 55+int(credentialIDLength)])
+	test.Assert(t, bytes.HasSuffix(assertion.AuthenticatorData, util.MarshalCBOR(map[string][]byte{"credBlob": {}})), "Empty credBlob output missing")
+
+	responseBytes = makeCredential(&makeCredentialExtensions{LargeBlobKey: &largeBlobKey}, false)
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrInvalidOption, "largeBlobKey allowed for non-resident credential")
+}
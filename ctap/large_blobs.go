@@ -0,0 +1,165 @@
+package ctap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/util"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Largest serialized large blob array that can be stored, including the trailing hash
+const maxSerializedLargeBlobArray = 4096
+
+// Platforms assume a 1024 byte message size when GetInfo doesn't give one, and fragments leave room for the rest of the message
+const largeBlobMaxFragmentLength = 1024 - 64
+
+// Length of the truncated SHA-256 hash at the end of the serialized array
+const largeBlobHashLength = 16
+
+// An empty CBOR array followed by its truncated hash, which is what the array starts as
+var initialLargeBlobArray = []byte{0x80, 0x76, 0xbe, 0x8b, 0x52, 0x8d, 0x00, 0x75, 0xf7, 0xaa, 0xe9, 0x8d, 0x6f, 0xa5, 0x7a, 0x6d, 0x3c}
+
+type largeBlobsArgs struct {
+	Get               *uint32 `cbor:"1,keyasint,omitempty"`
+	Set               []byte  `cbor:"2,keyasint,omitempty"`
+	Offset            *uint32 `cbor:"3,keyasint,omitempty"`
+	Length            *uint32 `cbor:"4,keyasint,omitempty"`
+	PINUVAuthParam    []byte  `cbor:"5,keyasint,omitempty"`
+	PINUVAuthProtocol uint32  `cbor:"6,keyasint,omitempty"`
+}
+
+func (args largeBlobsArgs) String() string {
+	optional := func(value *uint32) string {
+		if value == nil {
+			return "nil"
+		}
+		return fmt.Sprint(*value)
+	}
+	return fmt.Sprintf("ctapLargeBlobsArgs{Get: %s, Set: 0x%s, Offset: %s, Length: %s, PINAuth: 0x%s, PinProtocol: %d}",
+		optional(args.Get),
+		hex.EncodeToString(args.Set),
+		optional(args.Offset),
+		optional(args.Length),
+		hex.EncodeToString(args.PINUVAuthParam),
+		args.PINUVAuthProtocol)
+}
+
+type largeBlobsResponse struct {
+	Config []byte `cbor:"1,keyasint"`
+}
+
+// A serialized array being written in fragments, which only replaces the stored array once it's complete
+type largeBlobWrite struct {
+	data           []byte
+	expectedLength uint32
+}
+
+func (server *CTAPServer) largeBlobArray() []byte {
+	data := server.client.LargeBlobs()
+	if data == nil {
+		return initialLargeBlobArray
+	}
+	return data
+}
+
+func (server *CTAPServer) handleLargeBlobs(data []byte) []byte {
+	var args largeBlobsArgs
+	err := cbor.Unmarshal(data, &args)
+	if err != nil {
+		ctapLogger.Printf("ERROR: %s", err)
+		return []byte{byte(ctap2ErrInvalidCBOR)}
+	}
+	ctapLogger.Printf("LARGE_BLOBS: %v\n\n", args)
+	if args.Offset == nil {
+		return []byte{byte(ctap2ErrMissingParam)}
+	}
+	if (args.Get == nil) == (args.Set == nil) {
+		// Exactly one of get or set has to be given
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	if args.Get != nil {
+		return server.handleLargeBlobsGet(*args.Get, *args.Offset, args.Length)
+	}
+	return server.handleLargeBlobsSet(args)
+}
+
+func (server *CTAPServer) handleLargeBlobsGet(get uint32, offset uint32, length *uint32) []byte {
+	if length != nil {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	if get > largeBlobMaxFragmentLength {
+		return []byte{byte(ctap1ErrInvalidLength)}
+	}
+	array := server.largeBlobArray()
+	if offset > uint32(len(array)) {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	end := offset + get
+	if end > uint32(len(array)) {
+		end = uint32(len(array))
+	}
+	response := largeBlobsResponse{Config: array[offset:end]}
+	return append([]byte{byte(ctap1ErrSuccess)}, util.MarshalCBOR(response)...)
+}
+
+func (server *CTAPServer) handleLargeBlobsSet(args largeBlobsArgs) []byte {
+	if len(args.Set) > largeBlobMaxFragmentLength {
+		return []byte{byte(ctap1ErrInvalidLength)}
+	}
+	offset := *args.Offset
+	if offset == 0 {
+		// The first fragment gives the length of the whole array
+		if args.Length == nil {
+			return []byte{byte(ctap1ErrInvalidParameter)}
+		}
+		if *args.Length > maxSerializedLargeBlobArray {
+			return []byte{byte(ctap2ErrLargeBlobStorageFull)}
+		}
+		if *args.Length <= largeBlobHashLength {
+			return []byte{byte(ctap1ErrInvalidParameter)}
+		}
+		server.largeBlobWrite = &largeBlobWrite{data: make([]byte, 0, *args.Length), expectedLength: *args.Length}
+	} else if args.Length != nil {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	if server.largeBlobWrite == nil || offset != uint32(len(server.largeBlobWrite.data)) {
+		return []byte{byte(ctap1ErrInvalidSequence)}
+	}
+
+	// Any configured way to verify the user, built-in UV included, means writes need a token with lbw
+	protected := server.client.PINHash() != nil || server.userVerificationConfigured() || server.client.AuthenticatorConfig().AlwaysUV
+	if protected || args.PINUVAuthParam != nil {
+		offsetBytes := util.ToLE(offset)
+		setHash := sha256.Sum256(args.Set)
+		message := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandLargeBlobs), 0x00}, offsetBytes, setHash[:])
+		status := server.verifyPINUVAuthParam(args.PINUVAuthProtocol, args.PINUVAuthParam, message, pinUVAuthPermissionLargeBlobWrite)
+		if status != ctap1ErrSuccess {
+			ctapLogger.Printf("ERROR: Large blob write not authorized: %d\n\n", status)
+			return []byte{byte(status)}
+		}
+	}
+
+	write := server.largeBlobWrite
+	if offset+uint32(len(args.Set)) > write.expectedLength {
+		return []byte{byte(ctap1ErrInvalidParameter)}
+	}
+	write.data = append(write.data, args.Set...)
+	if uint32(len(write.data)) < write.expectedLength {
+		return []byte{byte(ctap1ErrSuccess)}
+	}
+
+	server.largeBlobWrite = nil
+	array := write.data[:len(write.data)-largeBlobHashLength]
+	arrayHash := sha256.Sum256(array)
+	if !bytes.Equal(arrayHash[:largeBlobHashLength], write.data[len(array):]) {
+		ctapLogger.Printf("ERROR: Large blob array hash does not match\n\n")
+		return []byte{byte(ctap2ErrIntegrityFailure)}
+	}
+	server.client.SetLargeBlobs(write.data)
+	ctapLogger.Printf("LARGE_BLOBS: Stored %d byte array\n\n", len(write.data))
+	return []byte{byte(ctap1ErrSuccess)}
+}
@@ -0,0 +1,117 @@
+package ctap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+func largeBlobsRequest(ctap *CTAPServer, args largeBlobsArgs) []byte {
+	return ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandLargeBlobs)}, util.MarshalCBOR(args)))
+}
+
+func readLargeBlobArray(t *testing.T, ctap *CTAPServer) []byte {
+	var get uint32 = largeBlobMaxFragmentLength
+	var offset uint32 = 0
+	responseBytes := largeBlobsRequest(ctap, largeBlobsArgs{Get: &get, Offset: &offset})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not read large blobs")
+	var response largeBlobsResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode large blobs response")
+	return response.Config
+}
+
+// Writes the array in two fragments, returning the status of the last one
+func writeLargeBlobArray(ctap *CTAPServer, array []byte, pinToken []byte) ctapStatusCode {
+	length := uint32(len(array))
+	fragments := [][]byte{array[:len(array)/2], array[len(array)/2:]}
+	var offset uint32 = 0
+	for i, fragment := range fragments {
+		fragmentOffset := offset
+		args := largeBlobsArgs{Set: fragment, Offset: &fragmentOffset}
+		if i == 0 {
+			args.Length = &length
+		}
+		if pinToken != nil {
+			fragmentHash := sha256.Sum256(fragment)
+			message := util.Concat(bytes.Repeat([]byte{0xff}, 32), []byte{byte(ctapCommandLargeBlobs), 0x00}, util.ToLE(offset), fragmentHash[:])
+			args.PINUVAuthParam = getPINUVAuthProtocol(2).authenticate(pinToken, message)
+			args.PINUVAuthProtocol = 2
+		}
+		status := ctapStatusCode(largeBlobsRequest(ctap, args)[0])
+		if status != ctap1ErrSuccess {
+			return status
+		}
+		offset += uint32(len(fragment))
+	}
+	return ctap1ErrSuccess
+}
+
+func serializeLargeBlobArray(entries []map[int][]byte) []byte {
+	array := util.MarshalCBOR(entries)
+	hash := sha256.Sum256(array)
+	return util.Concat(array, hash[:largeBlobHashLength])
+}
+
+func TestLargeBlobs(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true}
+	ctap := NewCTAPServer(client)
+	initialHash := sha256.Sum256([]byte{0x80})
+	test.AssertArrEqual(t, readLargeBlobArray(t, ctap), util.Concat([]byte{0x80}, initialHash[:largeBlobHashLength]), "Initial large blob array is wrong")
+
+	array := serializeLargeBlobArray([]map[int][]byte{{1: []byte("ciphertext"), 2: []byte("nonce"), 3: {10}}})
+	test.AssertEqual(t, writeLargeBlobArray(ctap, array, nil), ctap1ErrSuccess, "Could not write large blobs")
+	test.AssertArrEqual(t, readLargeBlobArray(t, ctap), array, "Large blob array was not stored")
+
+	corrupted := append([]byte{}, array...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	test.AssertEqual(t, writeLargeBlobArray(ctap, corrupted, nil), ctap2ErrIntegrityFailure, "Array with bad hash was accepted")
+	test.AssertArrEqual(t, readLargeBlobArray(t, ctap), array, "Array with bad hash was stored")
+
+	var offset uint32 = 5
+	responseBytes := largeBlobsRequest(ctap, largeBlobsArgs{Set: array, Offset: &offset})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrInvalidSequence, "Fragment accepted without a write in progress")
+	offset = 0
+	var length uint32 = maxSerializedLargeBlobArray + 1
+	responseBytes = largeBlobsRequest(ctap, largeBlobsArgs{Set: array, Offset: &offset, Length: &length})
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap2ErrLargeBlobStorageFull, "Oversized array was accepted")
+
+	setPIN(client, "1234")
+	test.AssertEqual(t, writeLargeBlobArray(ctap, array, nil), ctap2ErrPINRequired, "Large blobs written without PIN")
+	pinToken := getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionMakeCredential, "")
+	test.AssertEqual(t, writeLargeBlobArray(ctap, array, pinToken), ctap2ErrPINAuthInvalid, "Large blobs written without the lbw permission")
+	pinToken = getPINToken(t, ctap, 2, "1234", pinUVAuthPermissionLargeBlobWrite, "")
+	updated := serializeLargeBlobArray([]map[int][]byte{})
+	test.AssertEqual(t, writeLargeBlobArray(ctap, updated, pinToken), ctap1ErrSuccess, "Could not write large blobs with PIN token")
+	test.AssertArrEqual(t, readLargeBlobArray(t, ctap), updated, "Large blob array was not updated")
+}
+
+func TestLargeBlobsWithBuiltInUV(t *testing.T) {
+	client := &dummyCTAPClient{supportsPIN: true, verifyUser: func(ctx context.Context, relyingPartyID string) bool { return true }}
+	client.SetUVRetries(uvMaxRetries)
+	ctap := NewCTAPServer(client)
+	array := serializeLargeBlobArray([]map[int][]byte{{1: []byte("ciphertext"), 2: []byte("nonce"), 3: {10}}})
+	test.AssertEqual(t, writeLargeBlobArray(ctap, array, nil), ctap2ErrPINRequired, "Large blobs written without UV")
+
+	keyAgreement, sharedSecret := platformKeyAgreement(t, ctap, 2)
+	args := clientPINArgs{
+		PINUVAuthProtocol: 2,
+		SubCommand:        clientPINSubcommandGetPINUVAuthTokenUsingUVWithPermissions,
+		KeyAgreement:      keyAgreement,
+		Permissions:       pinUVAuthPermissionLargeBlobWrite,
+	}
+	responseBytes := ctap.HandleMessage(context.Background(), 0, util.Concat([]byte{byte(ctapCommandClientPIN)}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, ctapStatusCode(responseBytes[0]), ctap1ErrSuccess, "Could not get token with built-in UV")
+	var response clientPINResponse
+	err := cbor.Unmarshal(responseBytes[1:], &response)
+	util.CheckErr(err, "Could not decode response")
+	pinToken, err := getPINUVAuthProtocol(2).decrypt(sharedSecret, response.PinToken)
+	util.CheckErr(err, "Could not decrypt token")
+	test.AssertEqual(t, writeLargeBlobArray(ctap, array, pinToken), ctap1ErrSuccess, "Could not write large blobs with UV token")
+	test.AssertArrEqual(t, readLargeBlobArray(t, ctap), array, "Large blob array was not stored")
+}
@@ -0,0 +1,93 @@
+package ctap
+
+import (
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+const pinMaxRetries = 8
+
+// Built-in user verification gets its own retries, which a successful PIN entry restores
+const uvMaxRetries = 8
+
+// After this many wrong PINs in a row, PIN entry is blocked until the authenticator is power cycled
+const pinMaxConsecutiveFailures = 3
+
+// Tracks PIN and built-in UV attempts and owns the key agreement key the platform uses to send the PIN.
+// A new policy is created for each boot of the authenticator, so its state is what a power cycle clears.
+type pinPolicy struct {
+	client              CTAPClient
+	keyAgreement        *crypto.ECDHKey
+	consecutiveFailures int
+}
+
+func newPINPolicy(client CTAPClient) *pinPolicy {
+	return &pinPolicy{
+		client:       client,
+		keyAgreement: crypto.GenerateECDHKey(),
+	}
+}
+
+// Returns why the PIN can't be checked right now, or success if it can
+func (policy *pinPolicy) checkAllowed() ctapStatusCode {
+	if policy.client.PINRetries() <= 0 {
+		return ctap2ErrPINBlocked
+	}
+	if policy.consecutiveFailures >= pinMaxConsecutiveFailures {
+		return ctap2ErrPINAuthBlocked
+	}
+	return ctap1ErrSuccess
+}
+
+// Uses up a retry before the PIN is checked, so that interrupting the check doesn't give a free attempt
+func (policy *pinPolicy) beginAttempt() {
+	policy.client.SetPINRetries(policy.client.PINRetries() - 1)
+}
+
+// Returns the status to report for the wrong PIN
+func (policy *pinPolicy) recordFailure() ctapStatusCode {
+	// A new key agreement key means the platform has to start over, instead of replaying the same request
+	policy.keyAgreement = crypto.GenerateECDHKey()
+	policy.consecutiveFailures++
+	if policy.client.PINRetries() <= 0 {
+		return ctap2ErrPINBlocked
+	}
+	if policy.consecutiveFailures >= pinMaxConsecutiveFailures {
+		return ctap2ErrPINAuthBlocked
+	}
+	return ctap2ErrPINInvalid
+}
+
+func (policy *pinPolicy) recordSuccess() {
+	policy.consecutiveFailures = 0
+	policy.client.SetPINRetries(pinMaxRetries)
+	policy.client.SetUVRetries(uvMaxRetries)
+}
+
+func (policy *pinPolicy) checkUVAllowed() ctapStatusCode {
+	if policy.client.UVRetries() <= 0 {
+		return ctap2ErrUVBlocked
+	}
+	return ctap1ErrSuccess
+}
+
+// Returns the status to report for the failed verification
+func (policy *pinPolicy) recordUVFailure() ctapStatusCode {
+	retries := policy.client.UVRetries() - 1
+	policy.client.SetUVRetries(retries)
+	if retries <= 0 {
+		return ctap2ErrUVBlocked
+	}
+	return ctap2ErrUVInvalid
+}
+
+func (policy *pinPolicy) recordUVSuccess() {
+	policy.client.SetUVRetries(uvMaxRetries)
+}
+
+// Called when the authenticator is reset, which clears the PIN along with any lockout
+func (policy *pinPolicy) reset() {
+	policy.keyAgreement = crypto.GenerateECDHKey()
+	policy.consecutiveFailures = 0
+	policy.client.SetPINRetries(pinMaxRetries)
+	policy.client.SetUVRetries(uvMaxRetries)
+}
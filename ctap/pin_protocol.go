@@ -0,0 +1,105 @@
+package ctap
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+// The PIN/UV auth protocols from the CTAP 2.1 spec, which differ in how they derive keys and encrypt and authenticate data
+type pinUVAuthProtocol interface {
+	// Derives the shared secret from the x coordinate of the ECDH shared point
+	kdf(sharedPoint []byte) []byte
+	encrypt(key []byte, plaintext []byte) []byte
+	decrypt(key []byte, ciphertext []byte) ([]byte, error)
+	authenticate(key []byte, message []byte) []byte
+}
+
+// Protocols in the order they're advertised, most preferred first
+var supportedPINUVAuthProtocols = []uint32{2, 1}
+
+// Returns nil if the protocol isn't supported
+func getPINUVAuthProtocol(version uint32) pinUVAuthProtocol {
+	switch version {
+	case 1:
+		return pinUVAuthProtocolOne{}
+	case 2:
+		return pinUVAuthProtocolTwo{}
+	default:
+		return nil
+	}
+}
+
+func verifyPINUVAuth(protocol pinUVAuthProtocol, key []byte, message []byte, signature []byte) bool {
+	return hmac.Equal(protocol.authenticate(key, message), signature)
+}
+
+type pinUVAuthProtocolOne struct{}
+
+func (protocol pinUVAuthProtocolOne) kdf(sharedPoint []byte) []byte {
+	return crypto.HashSHA256(sharedPoint)
+}
+
+func (protocol pinUVAuthProtocolOne) encrypt(key []byte, plaintext []byte) []byte {
+	return crypto.EncryptAESCBC(key, plaintext)
+}
+
+func (protocol pinUVAuthProtocolOne) decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid ciphertext length: %d", len(ciphertext))
+	}
+	return crypto.DecryptAESCBC(key, ciphertext), nil
+}
+
+func (protocol pinUVAuthProtocolOne) authenticate(key []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)[:16]
+}
+
+type pinUVAuthProtocolTwo struct{}
+
+// Shared secrets are an HMAC key followed by an AES key
+func (protocol pinUVAuthProtocolTwo) kdf(sharedPoint []byte) []byte {
+	salt := make([]byte, 32)
+	hmacKey := crypto.HKDFSHA256(sharedPoint, salt, []byte("CTAP2 HMAC key"), 32)
+	aesKey := crypto.HKDFSHA256(sharedPoint, salt, []byte("CTAP2 AES key"), 32)
+	return append(hmacKey, aesKey...)
+}
+
+func (protocol pinUVAuthProtocolTwo) encrypt(key []byte, plaintext []byte) []byte {
+	iv := crypto.RandomBytes(aes.BlockSize)
+	return append(iv, crypto.EncryptAESCBCWithIV(protocol.aesKey(key), iv, plaintext)...)
+}
+
+func (protocol pinUVAuthProtocolTwo) decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid ciphertext length: %d", len(ciphertext))
+	}
+	iv := ciphertext[:aes.BlockSize]
+	return crypto.DecryptAESCBCWithIV(protocol.aesKey(key), iv, ciphertext[aes.BlockSize:]), nil
+}
+
+func (protocol pinUVAuthProtocolTwo) authenticate(key []byte, message []byte) []byte {
+	mac := hmac.New(sha256.New, protocol.hmacKey(key))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// PIN tokens are used whole, while shared secrets hold both keys
+func (protocol pinUVAuthProtocolTwo) hmacKey(key []byte) []byte {
+	if len(key) == 64 {
+		return key[:32]
+	}
+	return key
+}
+
+func (protocol pinUVAuthProtocolTwo) aesKey(key []byte) []byte {
+	if len(key) == 64 {
+		return key[32:]
+	}
+	return key
+}
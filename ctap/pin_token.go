@@ -0,0 +1,96 @@
+package ctap
+
+import (
+	"time"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+)
+
+type pinUVAuthPermission uint8
+
+const (
+	pinUVAuthPermissionMakeCredential       pinUVAuthPermission = 0x01
+	pinUVAuthPermissionGetAssertion         pinUVAuthPermission = 0x02
+	pinUVAuthPermissionCredentialManagement pinUVAuthPermission = 0x04
+	pinUVAuthPermissionBioEnrollment        pinUVAuthPermission = 0x08
+	pinUVAuthPermissionLargeBlobWrite       pinUVAuthPermission = 0x10
+	pinUVAuthPermissionAuthenticatorConfig  pinUVAuthPermission = 0x20
+)
+
+// Permissions given to tokens from the CTAP 2.0 getPINToken subcommand, which can't ask for any
+const legacyPINTokenPermissions = pinUVAuthPermissionMakeCredential | pinUVAuthPermissionGetAssertion
+
+// A token that isn't used within this window after being issued expires
+const pinUVAuthTokenInitialUsageWindow = 30 * time.Second
+
+// Tokens expire this long after being issued, even if they're still being used
+const pinUVAuthTokenMaxUsagePeriod = 10 * time.Minute
+
+// The pinUvAuthToken shared with the platform, along with what it's allowed to be used for
+type pinUVAuthToken struct {
+	value       []byte
+	permissions pinUVAuthPermission
+	// Empty until the token is bound to a single relying party
+	rpID     string
+	inUse    bool
+	used     bool
+	issuedAt time.Time
+}
+
+func newPINUVAuthToken() *pinUVAuthToken {
+	return &pinUVAuthToken{value: crypto.RandomBytes(32)}
+}
+
+// Replaces the token value, so that tokens handed out before can no longer be used
+func (token *pinUVAuthToken) reset() {
+	token.value = crypto.RandomBytes(32)
+	token.stopUsing()
+}
+
+func (token *pinUVAuthToken) beginUsing(permissions pinUVAuthPermission, rpID string) {
+	token.permissions = permissions
+	token.rpID = rpID
+	token.inUse = true
+	token.used = false
+	token.issuedAt = time.Now()
+}
+
+func (token *pinUVAuthToken) stopUsing() {
+	token.permissions = 0
+	token.rpID = ""
+	token.inUse = false
+	token.used = false
+}
+
+func (token *pinUVAuthToken) expired() bool {
+	elapsed := time.Since(token.issuedAt)
+	if elapsed > pinUVAuthTokenMaxUsagePeriod {
+		return true
+	}
+	return !token.used && elapsed > pinUVAuthTokenInitialUsageWindow
+}
+
+// Returns false, and stops using the token, if it has timed out or lacks the permission
+func (token *pinUVAuthToken) hasPermission(permission pinUVAuthPermission) bool {
+	if !token.inUse {
+		return false
+	}
+	if token.expired() {
+		token.stopUsing()
+		return false
+	}
+	return token.permissions&permission == permission
+}
+
+// Tokens bound to a relying party can only be used for that relying party
+func (token *pinUVAuthToken) permitsRelyingParty(rpID string) bool {
+	return token.rpID == "" || token.rpID == rpID
+}
+
+// Called when the token authorizes a MakeCredential or GetAssertion, which binds it to that relying party
+func (token *pinUVAuthToken) useForRelyingParty(rpID string) {
+	token.rpID = rpID
+	token.used = true
+	// Each token authorizes a single credential operation, but can still be used to write a large blob
+	token.permissions &= pinUVAuthPermissionLargeBlobWrite
+}
@@ -1,7 +1,7 @@
 package ctap_hid
 
 import (
-	"fmt"
+	"context"
 	"sync"
 
 	"github.com/bulwarkid/virtual-fido/util"
@@ -12,6 +12,8 @@ type ctapHIDChannel struct {
 	channelId   ctapHIDChannelID
 	messageLock sync.Locker
 	transaction *ctapHIDTransaction
+	// Cancels the request being handled, or nil if the channel is idle
+	cancelRequest context.CancelFunc
 }
 
 func newCTAPHIDChannel(server *CTAPHIDServer, channelId ctapHIDChannelID) *ctapHIDChannel {
@@ -24,6 +26,20 @@ func newCTAPHIDChannel(server *CTAPHIDServer, channelId ctapHIDChannelID) *ctapH
 }
 
 func (channel *ctapHIDChannel) handleMessage(message []byte) {
+	request, ctx := channel.receiveMessage(message)
+	if request == nil {
+		return
+	}
+	channel.handleFinalizedMessage(ctx, request.header, request.payload)
+	channel.messageLock.Lock()
+	defer channel.messageLock.Unlock()
+	channel.cancelRequest()
+	channel.cancelRequest = nil
+}
+
+// Adds the message to the channel's transaction, returning the request once all of it has arrived.
+// The lock isn't held while the request is handled, so that a cancel can interrupt a request waiting on the user.
+func (channel *ctapHIDChannel) receiveMessage(message []byte) (*transactionResult, context.Context) {
 	channel.messageLock.Lock()
 	defer channel.messageLock.Unlock()
 	if channel.transaction == nil {
@@ -31,22 +47,36 @@ func (channel *ctapHIDChannel) handleMessage(message []byte) {
 	} else {
 		channel.transaction.addMessage(message)
 	}
-	if channel.transaction.done {
-		if channel.transaction.errorCode != 0 {
-			channel.server.sendError(channel.channelId, channel.transaction.errorCode)
-		} else if !channel.transaction.cancelled {
-			channel.handleFinalizedMessage(channel.transaction.result.header, channel.transaction.result.payload)
+	if !channel.transaction.done {
+		return nil, nil
+	}
+	transaction := channel.transaction
+	channel.transaction = nil
+	if transaction.errorCode != 0 {
+		channel.server.sendError(channel.channelId, transaction.errorCode)
+		return nil, nil
+	}
+	if transaction.cancelled {
+		if channel.cancelRequest != nil {
+			channel.cancelRequest()
 		}
-		channel.transaction = nil
+		return nil, nil
+	}
+	if channel.cancelRequest != nil {
+		channel.server.sendError(channel.channelId, ctapHIDErrorChannelBusy)
+		return nil, nil
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	channel.cancelRequest = cancel
+	return transaction.result, ctx
 }
 
-func (channel *ctapHIDChannel) handleFinalizedMessage(header ctapHIDMessageHeader, payload []byte) {
+func (channel *ctapHIDChannel) handleFinalizedMessage(ctx context.Context, header ctapHIDMessageHeader, payload []byte) {
 	ctapHIDLogger.Printf("CTAPHID FINALIZED MESSAGE: %s %#v\n\n", header, payload)
 	if channel.channelId == ctapHIDBroadcastChannel {
 		channel.handleBroadcastMessage(header, payload)
 	} else {
-		channel.handleDataMessage(header, payload)
+		channel.handleDataMessage(ctx, header, payload)
 	}
 }
 
@@ -63,15 +93,23 @@ type ctapHIDInitResponse struct {
 func (channel *ctapHIDChannel) handleBroadcastMessage(header ctapHIDMessageHeader, payload []byte) {
 	switch header.Command {
 	case ctapHIDCommandInit:
+		if len(payload) != 8 {
+			channel.server.sendError(ctapHIDBroadcastChannel, ctapHIDErrorInvalidLength)
+			return
+		}
 		newChannel := channel.server.newChannel()
 		nonce := payload[:8]
+		capabilities := ctapHIDCapabilityCBOR
+		if channel.server.winkHandler != nil {
+			capabilities |= ctapHIDCapabilityWink
+		}
 		response := ctapHIDInitResponse{
 			NewChannelID:       newChannel.channelId,
 			ProtocolVersion:    2,
 			DeviceVersionMajor: 0,
 			DeviceVersionMinor: 0,
 			DeviceVersionBuild: 1,
-			CapabilitiesFlags:  ctapHIDCapabilityCBOR,
+			CapabilitiesFlags:  capabilities,
 		}
 		copy(response.Nonce[:], nonce)
 		ctapHIDLogger.Printf("CTAPHID INIT RESPONSE: %#v\n\n", response)
@@ -79,26 +117,35 @@ func (channel *ctapHIDChannel) handleBroadcastMessage(header ctapHIDMessageHeade
 	case ctapHIDCommandPing:
 		channel.server.sendResponse(ctapHIDBroadcastChannel, ctapHIDCommandPing, payload)
 	default:
-		util.Panic(fmt.Sprintf("Invalid CTAPHID Broadcast command: %#v", header))
+		ctapHIDLogger.Printf("ERROR: Invalid CTAPHID Broadcast command: %s\n\n", header)
+		channel.server.sendError(ctapHIDBroadcastChannel, ctapHIDErrorInvalidCommand)
 	}
 }
 
-func (channel *ctapHIDChannel) handleDataMessage(header ctapHIDMessageHeader, payload []byte) {
+func (channel *ctapHIDChannel) handleDataMessage(ctx context.Context, header ctapHIDMessageHeader, payload []byte) {
 	switch header.Command {
 	case ctapHIDCommandMsg:
-		responsePayload := channel.server.u2fServer.HandleMessage(payload)
+		responsePayload := channel.server.u2fServer.HandleMessage(ctx, uint32(channel.channelId), payload)
 		ctapHIDLogger.Printf("CTAPHID MSG RESPONSE: %d %#v\n\n", len(responsePayload), responsePayload)
 		channel.server.sendResponse(header.ChannelID, ctapHIDCommandMsg, responsePayload)
 	case ctapHIDCommandCBOR:
 		stop := util.StartRecurringFunction(keepConnectionAlive(channel.server, channel.channelId, ctapHIDStatusUpneeded), 50)
-		responsePayload := channel.server.ctapServer.HandleMessage(payload)
+		responsePayload := channel.server.ctapServer.HandleMessage(ctx, uint32(channel.channelId), payload)
 		stop <- 0
 		ctapHIDLogger.Printf("CTAPHID CBOR RESPONSE: %#v\n\n", responsePayload)
 		channel.server.sendResponse(header.ChannelID, ctapHIDCommandCBOR, responsePayload)
 	case ctapHIDCommandPing:
 		channel.server.sendResponse(header.ChannelID, ctapHIDCommandPing, payload)
+	case ctapHIDCommandWink:
+		if channel.server.winkHandler == nil {
+			channel.server.sendError(header.ChannelID, ctapHIDErrorInvalidCommand)
+			return
+		}
+		channel.server.winkHandler()
+		channel.server.sendResponse(header.ChannelID, ctapHIDCommandWink, []byte{})
 	default:
-		panic(fmt.Sprintf("Invalid CTAPHID Channel command: %s", header))
+		ctapHIDLogger.Printf("ERROR: Invalid CTAPHID Channel command: %s\n\n", header)
+		channel.server.sendError(header.ChannelID, ctapHIDErrorInvalidCommand)
 	}
 }
 
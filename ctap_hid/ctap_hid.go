@@ -2,6 +2,7 @@ package ctap_hid
 
 import (
 	"bytes"
+	"context"
 	"sync"
 
 	"github.com/bulwarkid/virtual-fido/util"
@@ -10,7 +11,10 @@ import (
 var ctapHIDLogger = util.NewLogger("[CTAPHID] ", util.LogLevelDebug)
 
 type CTAPHIDClient interface {
-	HandleMessage(data []byte) []byte
+	// channelID identifies the CTAPHID channel the message arrived on, so that clients
+	// can keep state (such as pending assertions) separate between channels.
+	// ctx is cancelled when the platform sends CTAPHID_CANCEL on that channel.
+	HandleMessage(ctx context.Context, channelID uint32, data []byte) []byte
 }
 
 type CTAPHIDServer struct {
@@ -20,6 +24,8 @@ type CTAPHIDServer struct {
 	channels        map[ctapHIDChannelID]*ctapHIDChannel
 	responsesLock   sync.Locker
 	responseHandler func(response []byte)
+	// Nil unless the device can show the user which authenticator it is, e.g. by blinking
+	winkHandler func()
 }
 
 func NewCTAPHIDServer(ctapServer CTAPHIDClient, u2fServer CTAPHIDClient) *CTAPHIDServer {
@@ -30,6 +36,7 @@ func NewCTAPHIDServer(ctapServer CTAPHIDClient, u2fServer CTAPHIDClient) *CTAPHI
 		channels:        make(map[ctapHIDChannelID]*ctapHIDChannel),
 		responsesLock:   &sync.Mutex{},
 		responseHandler: nil,
+		winkHandler:     nil,
 	}
 	server.channels[ctapHIDBroadcastChannel] = newCTAPHIDChannel(server, ctapHIDBroadcastChannel)
 	return server
@@ -39,6 +46,10 @@ func (server *CTAPHIDServer) SetResponseHandler(handler func(response []byte)) {
 	server.responseHandler = handler
 }
 
+func (server *CTAPHIDServer) SetWinkHandler(handler func()) {
+	server.winkHandler = handler
+}
+
 func (server *CTAPHIDServer) sendResponsePackets(packets [][]byte) {
 	// Packets should be sequential and continuous per transaction
 	server.responsesLock.Lock()
@@ -52,6 +63,11 @@ func (server *CTAPHIDServer) sendResponsePackets(packets [][]byte) {
 }
 
 func (server *CTAPHIDServer) HandleMessage(message []byte) {
+	if len(message) < int(util.SizeOf[ctapHIDChannelID]()) {
+		// Without a channel ID there's nowhere to send an error
+		ctapHIDLogger.Printf("CTAPHID: Dropping %d byte packet\n\n", len(message))
+		return
+	}
 	buffer := bytes.NewBuffer(message)
 	channelId := util.ReadLE[ctapHIDChannelID](buffer)
 	channel, exists := server.channels[channelId]
@@ -82,7 +98,8 @@ func (server *CTAPHIDServer) sendError(channelID ctapHIDChannelID, errorCode cta
 func createResponsePackets(channelId ctapHIDChannelID, command ctapHIDCommand, payload []byte) [][]byte {
 	packets := [][]byte{}
 	sequence := -1
-	for len(payload) > 0 {
+	// Empty payloads still need an initialization packet
+	for sequence < 0 || len(payload) > 0 {
 		packet := []byte{}
 		if sequence < 0 {
 			packet = append(packet, util.ToLE(channelId)...)
@@ -2,7 +2,10 @@ package ctap_hid
 
 import (
 	"bytes"
+	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bulwarkid/virtual-fido/crypto"
 	"github.com/bulwarkid/virtual-fido/util"
@@ -10,10 +13,21 @@ import (
 
 type dummyHandler struct{}
 
-func (server *dummyHandler) HandleMessage(data []byte) []byte {
+func (server *dummyHandler) HandleMessage(ctx context.Context, channelID uint32, data []byte) []byte {
 	return nil
 }
 
+// Waits for the platform to cancel the request, like an approver that is still prompting the user
+type blockingHandler struct {
+	started chan struct{}
+}
+
+func (server *blockingHandler) HandleMessage(ctx context.Context, channelID uint32, data []byte) []byte {
+	close(server.started)
+	<-ctx.Done()
+	return []byte{0x2D}
+}
+
 func TestOpenChannel(t *testing.T) {
 	dummyCTAP := dummyHandler{}
 	dummyU2F := dummyHandler{}
@@ -42,3 +56,114 @@ func TestOpenChannel(t *testing.T) {
 	server.SetResponseHandler(responseHandler)
 	server.HandleMessage(initializationMessage)
 }
+
+func TestWink(t *testing.T) {
+	dummyCTAP := dummyHandler{}
+	dummyU2F := dummyHandler{}
+	server := NewCTAPHIDServer(&dummyCTAP, &dummyU2F)
+	winked := false
+	server.SetWinkHandler(func() { winked = true })
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	initCmd := byte((1 << 7) | 0x06)
+	server.HandleMessage(util.Concat(
+		util.ToLE[uint32](0xFFFFFFFF),
+		[]byte{initCmd},
+		util.ToBE[uint16](8),
+		crypto.RandomBytes(8)))
+	if len(responses) != 1 || responses[0][23]&0b00000001 == 0 {
+		t.Fatalf("Wink capability was not advertised: %#v", responses)
+	}
+	winkCmd := byte((1 << 7) | 0x08)
+	server.HandleMessage(util.Concat(util.ToLE[uint32](1), []byte{winkCmd}, util.ToBE[uint16](0)))
+	if !winked {
+		t.Errorf("Wink handler was not called")
+	}
+	correctResponse := util.Pad(util.Concat(util.ToLE[uint32](1), []byte{winkCmd}, util.ToBE[uint16](0)), 64)
+	if len(responses) != 2 || !bytes.Equal(responses[1], correctResponse) {
+		t.Errorf("Wink returned incorrect response: %#v", responses)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	blockingCTAP := blockingHandler{started: make(chan struct{})}
+	dummyU2F := dummyHandler{}
+	server := NewCTAPHIDServer(&blockingCTAP, &dummyU2F)
+	server.newChannel()
+	responsesLock := sync.Mutex{}
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		responsesLock.Lock()
+		defer responsesLock.Unlock()
+		responses = append(responses, response)
+	})
+	cborCmd := byte((1 << 7) | 0x10)
+	finished := make(chan struct{})
+	go func() {
+		server.HandleMessage(util.Concat(util.ToLE[uint32](1), []byte{cborCmd}, util.ToBE[uint16](1), []byte{0x01}))
+		close(finished)
+	}()
+	<-blockingCTAP.started
+	pingCmd := byte((1 << 7) | 0x01)
+	server.HandleMessage(util.Concat(util.ToLE[uint32](1), []byte{pingCmd}, util.ToBE[uint16](0)))
+	cancelCmd := byte((1 << 7) | 0x11)
+	server.HandleMessage(util.Concat(util.ToLE[uint32](1), []byte{cancelCmd}, util.ToBE[uint16](0)))
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatalf("Cancel did not interrupt the request")
+	}
+	responsesLock.Lock()
+	defer responsesLock.Unlock()
+	errorCmd := byte((1 << 7) | 0x3F)
+	busyResponse := util.Pad(util.Concat(util.ToLE[uint32](1), []byte{errorCmd}, util.ToBE[uint16](1), []byte{0x06}), 64)
+	cancelledResponse := util.Pad(util.Concat(util.ToLE[uint32](1), []byte{cborCmd}, util.ToBE[uint16](1), []byte{0x2D}), 64)
+	foundBusy, foundCancelled := false, false
+	for _, response := range responses {
+		foundBusy = foundBusy || bytes.Equal(response, busyResponse)
+		foundCancelled = foundCancelled || bytes.Equal(response, cancelledResponse)
+	}
+	if !foundBusy {
+		t.Errorf("Ping during a request did not return a busy error: %#v", responses)
+	}
+	if !foundCancelled {
+		t.Errorf("Cancelled request was not answered: %#v", responses)
+	}
+}
+
+func TestMalformedPackets(t *testing.T) {
+	dummyCTAP := dummyHandler{}
+	dummyU2F := dummyHandler{}
+	server := NewCTAPHIDServer(&dummyCTAP, &dummyU2F)
+	server.newChannel()
+	responses := [][]byte{}
+	server.SetResponseHandler(func(response []byte) {
+		responses = append(responses, response)
+	})
+	expectError := func(message []byte, channelId uint32, errorCode ctapHIDErrorCode, description string) {
+		responses = [][]byte{}
+		server.HandleMessage(message)
+		errorCmd := byte(ctapHIDCommandError)
+		correctResponse := util.Pad(util.Concat(util.ToLE(channelId), []byte{errorCmd}, util.ToBE[uint16](1), []byte{byte(errorCode)}), 64)
+		if len(responses) != 1 || !bytes.Equal(responses[0], correctResponse) {
+			t.Errorf("Incorrect response for %s: %#v", description, responses)
+		}
+	}
+	server.HandleMessage([]byte{0xFF, 0xFF})
+	if len(responses) != 0 {
+		t.Errorf("Packet without a channel ID was answered: %#v", responses)
+	}
+	broadcast := util.ToLE[uint32](0xFFFFFFFF)
+	initCmd := byte(ctapHIDCommandInit)
+	expectError(util.Concat(broadcast, []byte{initCmd}), 0xFFFFFFFF, ctapHIDErrorInvalidLength, "truncated header")
+	expectError(util.Concat(broadcast, []byte{initCmd}, util.ToBE[uint16](4), crypto.RandomBytes(4)), 0xFFFFFFFF, ctapHIDErrorInvalidLength, "short nonce")
+	expectError(util.Concat(broadcast, []byte{0xBA}, util.ToBE[uint16](0)), 0xFFFFFFFF, ctapHIDErrorInvalidCommand, "unknown broadcast command")
+	channel := util.ToLE[uint32](1)
+	cborCmd := byte(ctapHIDCommandCBOR)
+	expectError(util.Concat(channel, []byte{cborCmd}, util.ToBE[uint16](0xFFFF)), 1, ctapHIDErrorInvalidLength, "oversized payload")
+	expectError(util.Concat(channel, []byte{0, 0}), 1, ctapHIDErrorInvalidCommand, "unexpected continuation packet")
+	expectError(util.Concat(channel, []byte{0xC2}, util.ToBE[uint16](0)), 1, ctapHIDErrorInvalidCommand, "unknown channel command")
+	expectError(util.Concat(util.ToLE[uint32](7), []byte{cborCmd}, util.ToBE[uint16](0)), 7, ctapHIDErrorInvalidChannel, "unknown channel")
+}
@@ -6,6 +6,12 @@ import (
 
 const (
 	ctapHIDMaxPacketSize int = 64
+	// Channel ID, command and payload length
+	ctapHIDInitializationHeaderSize int = 7
+	// Channel ID and sequence number
+	ctapHIDContinuationHeaderSize int = 5
+	// One initialization packet followed by up to 128 continuation packets
+	ctapHIDMaxPayloadSize int = ctapHIDMaxPacketSize - ctapHIDInitializationHeaderSize + 128*(ctapHIDMaxPacketSize-ctapHIDContinuationHeaderSize)
 )
 
 const ctapHIDStatusUpneeded uint8 = 2
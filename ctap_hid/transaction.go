@@ -22,6 +22,10 @@ type ctapHIDTransaction struct {
 
 func newCTAPHIDTransaction(message []byte) *ctapHIDTransaction {
 	transaction := ctapHIDTransaction{}
+	if len(message) < ctapHIDContinuationHeaderSize {
+		transaction.error(ctapHIDErrorInvalidLength)
+		return &transaction
+	}
 	buffer := bytes.NewBuffer(message)
 	channelId := util.ReadLE[ctapHIDChannelID](buffer)
 	command := util.ReadLE[ctapHIDCommand](buffer)
@@ -35,7 +39,16 @@ func newCTAPHIDTransaction(message []byte) *ctapHIDTransaction {
 		transaction.cancel() // No response to cancel message
 		return &transaction
 	}
+	if len(message) < ctapHIDInitializationHeaderSize {
+		transaction.error(ctapHIDErrorInvalidLength)
+		return &transaction
+	}
 	payloadLength := util.ReadBE[uint16](buffer)
+	if int(payloadLength) > ctapHIDMaxPayloadSize {
+		ctapHIDLogger.Printf("CTAPHID: Payload of %d bytes can't fit in one transaction\n\n", payloadLength)
+		transaction.error(ctapHIDErrorInvalidLength)
+		return &transaction
+	}
 	result := transactionResult{
 		header: ctapHIDMessageHeader{
 			ChannelID:     channelId,
@@ -63,6 +76,10 @@ func (transaction *ctapHIDTransaction) addMessage(message []byte) {
 		transaction.error(ctapHIDErrorOther)
 		return
 	}
+	if len(message) < ctapHIDContinuationHeaderSize {
+		transaction.error(ctapHIDErrorInvalidLength)
+		return
+	}
 	buffer := bytes.NewBuffer(message)
 	channelId := util.ReadLE[ctapHIDChannelID](buffer)
 	if channelId != transaction.result.header.ChannelID {
@@ -0,0 +1,61 @@
+package fido_client
+
+import (
+	"context"
+	"sync"
+
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+)
+
+// A fingerprint sensor with no hardware behind it, where what each touch does is scripted ahead of time.
+// The queues can be filled from another goroutine while the authenticator is running.
+type SimulatedBioSensor struct {
+	lock              sync.Mutex
+	enrollmentSamples []ctap.BioEnrollmentSampleStatus
+	touches           [][]byte
+}
+
+func NewSimulatedBioSensor() *SimulatedBioSensor {
+	return &SimulatedBioSensor{}
+}
+
+// Queues the statuses of the next enrollment samples. Once the queue runs out, every sample is good.
+func (sensor *SimulatedBioSensor) QueueEnrollmentSamples(statuses ...ctap.BioEnrollmentSampleStatus) {
+	sensor.lock.Lock()
+	defer sensor.lock.Unlock()
+	sensor.enrollmentSamples = append(sensor.enrollmentSamples, statuses...)
+}
+
+// Queues the finger that next touches the sensor to verify the user, by its template ID, or nil for a finger that isn't enrolled.
+// Once the queue runs out, every touch matches the first enrolled finger.
+func (sensor *SimulatedBioSensor) QueueTouch(templateID []byte) {
+	sensor.lock.Lock()
+	defer sensor.lock.Unlock()
+	sensor.touches = append(sensor.touches, templateID)
+}
+
+func (sensor *SimulatedBioSensor) CaptureEnrollmentSample(ctx context.Context) ctap.BioEnrollmentSampleStatus {
+	sensor.lock.Lock()
+	defer sensor.lock.Unlock()
+	if len(sensor.enrollmentSamples) == 0 {
+		return ctap.BioEnrollmentSampleGood
+	}
+	status := sensor.enrollmentSamples[0]
+	sensor.enrollmentSamples = sensor.enrollmentSamples[1:]
+	return status
+}
+
+func (sensor *SimulatedBioSensor) MatchFingerprint(ctx context.Context, enrollments []identities.BioEnrollment) []byte {
+	sensor.lock.Lock()
+	defer sensor.lock.Unlock()
+	if len(sensor.touches) == 0 {
+		if len(enrollments) == 0 {
+			return nil
+		}
+		return enrollments[0].TemplateID
+	}
+	templateID := sensor.touches[0]
+	sensor.touches = sensor.touches[1:]
+	return templateID
+}
@@ -1,12 +1,15 @@
 package fido_client
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
 	"log"
+	"unicode/utf8"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
 	"github.com/bulwarkid/virtual-fido/identities"
 	"github.com/bulwarkid/virtual-fido/util"
 	"github.com/bulwarkid/virtual-fido/webauthn"
@@ -24,12 +27,21 @@ const (
 	ClientActionU2FAuthenticate    ClientAction = 1
 	ClientActionFIDOMakeCredential ClientAction = 2
 	ClientActionFIDOGetAssertion   ClientAction = 3
+	ClientActionFIDOReset          ClientAction = 4
+	ClientActionFIDOSelection      ClientAction = 5
 )
 
 var clientLogger *log.Logger = util.NewLogger("[CLIENT] ", util.LogLevelDebug)
 
 type ClientRequestApprover interface {
-	ApproveClientAction(action ClientAction, params ClientActionRequestParams) bool
+	// ctx is cancelled when the platform cancels the request, so the prompt should be dismissed
+	ApproveClientAction(ctx context.Context, action ClientAction, params ClientActionRequestParams) bool
+}
+
+// Verifies the user without a PIN, like a passphrase prompt or an OS-level check
+type ClientUserVerifier interface {
+	// Like ApproveClientAction, ctx is cancelled when the platform cancels the request
+	VerifyUser(ctx context.Context, relyingParty string) bool
 }
 
 type ClientDataSaver interface {
@@ -39,16 +51,33 @@ type ClientDataSaver interface {
 }
 
 type DefaultFIDOClient struct {
-	deviceEncryptionKey   []byte
+	deviceEncryptionKey []byte
+	// Seals non-resident credential IDs and U2F key handles, and is replaced on reset so that they stop working
+	sealingKey            []byte
 	certificateAuthority  *x509.Certificate
 	certPrivateKey        *cose.SupportedCOSEPrivateKey
 	authenticationCounter uint32
 
-	pinEnabled      bool
-	pinToken        []byte
-	pinKeyAgreement *crypto.ECDHKey
-	pinRetries      int32
-	pinHash         []byte
+	pinEnabled bool
+	pinRetries int32
+	pinHash    []byte
+	pinLength  uint32
+
+	// Nil unless built-in user verification has been set up
+	userVerifier ClientUserVerifier
+	uvRetries    int32
+	// Nil unless a fingerprint sensor has been attached
+	bioSensor      ctap.BioSensor
+	bioEnrollments []identities.BioEnrollment
+
+	largeBlobs []byte
+	config     identities.AuthenticatorConfig
+
+	// Configured by the device's owner, so these aren't cleared on reset
+	enterpriseAttestationRPIDs     []string
+	batchAttestationKey            *cose.SupportedCOSEPrivateKey
+	attestationFormat              identities.AttestationFormat
+	relyingPartyAttestationFormats map[string]identities.AttestationFormat
 
 	vault           *identities.IdentityVault
 	requestApprover ClientRequestApprover
@@ -68,15 +97,23 @@ func NewDefaultClient(
 		certificateAuthority:  rootAttestationCertificate,
 		certPrivateKey:        rootAttestationCertPrivateKey,
 		authenticationCounter: 1,
-		pinToken:              crypto.RandomBytes(16),
-		pinKeyAgreement:       crypto.GenerateECDHKey(),
 		pinRetries:            8,
+		uvRetries:             8,
 		pinHash:               nil,
 		vault:                 identities.NewIdentityVault(),
 		requestApprover:       requestApprover,
 		dataSaver:             dataSaver,
 	}
 	client.loadData()
+	if client.sealingKey == nil {
+		// Credentials sealed before reset could replace the key were sealed with the device key
+		client.sealingKey = client.deviceEncryptionKey
+	}
+	if client.batchAttestationKey == nil {
+		// Saved states from before batch attestation don't have a key yet
+		client.batchAttestationKey = &cose.SupportedCOSEPrivateKey{ECDSA: crypto.GenerateECDSAKey()}
+		client.saveData()
+	}
 	return client
 }
 
@@ -84,53 +121,64 @@ func (client *DefaultFIDOClient) SupportsResidentKey() bool {
 	return true
 }
 
-func (client *DefaultFIDOClient) NewCredentialSource(
-	PubKeyCredParams []webauthn.PublicKeyCredentialParams,
-	ExcludeList []webauthn.PublicKeyCredentialDescriptor,
-	relyingParty *webauthn.PublicKeyCredentialRPEntity,
-	user *webauthn.PublicKeyCrendentialUserEntity) *identities.CredentialSource {
-	supported := false
-	for _, param := range PubKeyCredParams {
-		if param.Algorithm == cose.COSE_ALGORITHM_ID_ES256 && param.Type == "public-key" {
-			supported = true
-			break
-		}
-	}
-	if !supported {
-		return nil
-	}
-	newSource := client.vault.NewIdentity(relyingParty, user)
+func (client *DefaultFIDOClient) AddCredentialSource(source *identities.CredentialSource) {
+	client.vault.AddIdentity(source)
 	client.saveData()
-	return newSource
 }
 
-func (client *DefaultFIDOClient) GetAssertionSource(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) *identities.CredentialSource {
-	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList)
+func (client *DefaultFIDOClient) GetAssertionSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor, userVerified bool) []*identities.CredentialSource {
+	sources := client.vault.GetMatchingCredentialSources(relyingPartyID, allowList, userVerified)
 	if len(sources) == 0 {
 		clientLogger.Printf("ERROR: No Credentials\n\n")
-		return nil
 	}
+	return sources
+}
 
-	// TODO: Allow user to choose credential source
-	credentialSource := sources[0]
+func (client *DefaultFIDOClient) IncrementSignatureCounter(credentialSource *identities.CredentialSource) {
 	credentialSource.SignatureCounter++
 	client.saveData()
-	return credentialSource
 }
 
-func (client DefaultFIDOClient) ApproveAccountCreation(relyingParty string) bool {
+func (client DefaultFIDOClient) ApproveAccountCreation(ctx context.Context, relyingParty string) bool {
 	params := ClientActionRequestParams{
 		RelyingParty: relyingParty,
 	}
-	return client.requestApprover.ApproveClientAction(ClientActionFIDOMakeCredential, params)
+	return client.requestApprover.ApproveClientAction(ctx, ClientActionFIDOMakeCredential, params)
 }
 
-func (client DefaultFIDOClient) ApproveAccountLogin(credentialSource *identities.CredentialSource) bool {
+func (client DefaultFIDOClient) ApproveAccountLogin(ctx context.Context, credentialSource *identities.CredentialSource) bool {
 	params := ClientActionRequestParams{
 		RelyingParty: credentialSource.RelyingParty.Name,
 		UserName:     credentialSource.User.Name,
 	}
-	return client.requestApprover.ApproveClientAction(ClientActionFIDOGetAssertion, params)
+	return client.requestApprover.ApproveClientAction(ctx, ClientActionFIDOGetAssertion, params)
+}
+
+func (client DefaultFIDOClient) ApproveReset(ctx context.Context) bool {
+	params := ClientActionRequestParams{}
+	return client.requestApprover.ApproveClientAction(ctx, ClientActionFIDOReset, params)
+}
+
+func (client DefaultFIDOClient) ApproveSelection(ctx context.Context) bool {
+	params := ClientActionRequestParams{}
+	return client.requestApprover.ApproveClientAction(ctx, ClientActionFIDOSelection, params)
+}
+
+// Called when the platform asks the device to identify itself among several authenticators.
+// Apps that can show this, e.g. by blinking a tray icon, can wrap the client with their own Wink.
+func (client *DefaultFIDOClient) Wink() {
+	clientLogger.Printf("WINK\n\n")
+}
+
+func (client *DefaultFIDOClient) Reset() {
+	client.vault = identities.NewIdentityVault()
+	client.sealingKey = crypto.GenerateSymmetricKey()
+	client.pinHash = nil
+	client.pinLength = 0
+	client.largeBlobs = nil
+	client.bioEnrollments = nil
+	client.config = identities.AuthenticatorConfig{}
+	client.saveData()
 }
 
 // -----------------------
@@ -157,6 +205,7 @@ func (client *DefaultFIDOClient) PINHash() []byte {
 
 func (client *DefaultFIDOClient) SetPIN(pin []byte) {
 	pinHash := crypto.HashSHA256(pin)[:16]
+	client.pinLength = uint32(utf8.RuneCount(pin))
 	client.SetPINHash(pinHash)
 }
 
@@ -166,20 +215,88 @@ func (client *DefaultFIDOClient) SetPINHash(newHash []byte) {
 }
 
 func (client *DefaultFIDOClient) PINRetries() int32 {
-	util.Assert(client.pinRetries > 0 && client.pinRetries <= 8, "Invalid PIN Retries")
+	util.Assert(client.pinRetries >= 0 && client.pinRetries <= 8, "Invalid PIN Retries")
 	return client.pinRetries
 }
 
 func (client *DefaultFIDOClient) SetPINRetries(retries int32) {
 	client.pinRetries = retries
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) PINLength() uint32 {
+	return client.pinLength
+}
+
+func (client *DefaultFIDOClient) SetPINLength(length uint32) {
+	client.pinLength = length
+	client.saveData()
+}
+
+// -----------------------------
+// Large Blob Methods
+// -----------------------------
+
+func (client *DefaultFIDOClient) LargeBlobs() []byte {
+	return client.largeBlobs
+}
+
+func (client *DefaultFIDOClient) SetLargeBlobs(data []byte) {
+	client.largeBlobs = data
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) AuthenticatorConfig() identities.AuthenticatorConfig {
+	return client.config
+}
+
+func (client *DefaultFIDOClient) SetAuthenticatorConfig(config identities.AuthenticatorConfig) {
+	client.config = config
+	client.saveData()
+}
+
+// -----------------------------
+// User Verification Methods
+// -----------------------------
+
+// Sets up built-in user verification, which lets credentials be verified without a PIN
+func (client *DefaultFIDOClient) SetUserVerifier(verifier ClientUserVerifier) {
+	client.userVerifier = verifier
+}
+
+func (client *DefaultFIDOClient) SupportsUserVerification() bool {
+	return client.userVerifier != nil
+}
+
+func (client *DefaultFIDOClient) VerifyUser(ctx context.Context, relyingPartyID string) bool {
+	return client.userVerifier.VerifyUser(ctx, relyingPartyID)
+}
+
+func (client *DefaultFIDOClient) UVRetries() int32 {
+	return client.uvRetries
+}
+
+func (client *DefaultFIDOClient) SetUVRetries(retries int32) {
+	client.uvRetries = retries
+	client.saveData()
+}
+
+// Attaches a fingerprint sensor, which platforms can enroll fingers on once a PIN is set
+func (client *DefaultFIDOClient) SetBioSensor(sensor ctap.BioSensor) {
+	client.bioSensor = sensor
 }
 
-func (client *DefaultFIDOClient) PINKeyAgreement() *crypto.ECDHKey {
-	return client.pinKeyAgreement
+func (client *DefaultFIDOClient) BioSensor() ctap.BioSensor {
+	return client.bioSensor
 }
 
-func (client *DefaultFIDOClient) PINToken() []byte {
-	return client.pinToken
+func (client *DefaultFIDOClient) BioEnrollments() []identities.BioEnrollment {
+	return client.bioEnrollments
+}
+
+func (client *DefaultFIDOClient) SetBioEnrollments(enrollments []identities.BioEnrollment) {
+	client.bioEnrollments = enrollments
+	client.saveData()
 }
 
 // -----------------------------
@@ -187,7 +304,7 @@ func (client *DefaultFIDOClient) PINToken() []byte {
 // -----------------------------
 
 func (client DefaultFIDOClient) SealingEncryptionKey() []byte {
-	return client.deviceEncryptionKey
+	return client.sealingKey
 }
 
 func (client *DefaultFIDOClient) NewPrivateKey() *ecdsa.PrivateKey {
@@ -206,27 +323,86 @@ func (client *DefaultFIDOClient) CreateAttestationCertificiate(privateKey *cose.
 	return cert.Raw
 }
 
-func (client DefaultFIDOClient) ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool {
+func (client *DefaultFIDOClient) EnterpriseAttestationRPIDs() []string {
+	return client.enterpriseAttestationRPIDs
+}
+
+// Sets the relying parties that get enterprise attestations, once the platform turns enterprise attestation on
+func (client *DefaultFIDOClient) SetEnterpriseAttestationRPIDs(rpIDs []string) {
+	client.enterpriseAttestationRPIDs = rpIDs
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) CreateEnterpriseAttestationCertificate(privateKey *cose.SupportedCOSEPrivateKey) []byte {
+	cert, err := identities.CreateEnterpriseAttestationCertificate(client.certificateAuthority, client.certPrivateKey, privateKey, client.deviceSerialNumber())
+	util.CheckErr(err, "Could not create enterprise attestation certificate")
+	return cert.Raw
+}
+
+func (client *DefaultFIDOClient) AttestationPrivateKey() *cose.SupportedCOSEPrivateKey {
+	return client.batchAttestationKey
+}
+
+func (client *DefaultFIDOClient) AttestationFormat(relyingPartyID string) identities.AttestationFormat {
+	if format, ok := client.relyingPartyAttestationFormats[relyingPartyID]; ok {
+		return format
+	}
+	return client.attestationFormat
+}
+
+// Sets the attestation format for relying parties without their own format
+func (client *DefaultFIDOClient) SetAttestationFormat(format identities.AttestationFormat) {
+	client.attestationFormat = format
+	client.saveData()
+}
+
+func (client *DefaultFIDOClient) SetRelyingPartyAttestationFormat(relyingPartyID string, format identities.AttestationFormat) {
+	if client.relyingPartyAttestationFormats == nil {
+		client.relyingPartyAttestationFormats = make(map[string]identities.AttestationFormat)
+	}
+	client.relyingPartyAttestationFormats[relyingPartyID] = format
+	client.saveData()
+}
+
+// Derived from the device's secret key, so that it stays the same for as long as the device does
+func (client *DefaultFIDOClient) deviceSerialNumber() []byte {
+	return crypto.HashSHA256(util.Concat([]byte("serial number"), client.deviceEncryptionKey))[:8]
+}
+
+func (client DefaultFIDOClient) ApproveU2FRegistration(ctx context.Context, keyHandle *webauthn.KeyHandle) bool {
 	params := ClientActionRequestParams{}
-	return client.requestApprover.ApproveClientAction(ClientActionU2FRegister, params)
+	return client.requestApprover.ApproveClientAction(ctx, ClientActionU2FRegister, params)
 }
 
-func (client DefaultFIDOClient) ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool {
+func (client DefaultFIDOClient) ApproveU2FAuthentication(ctx context.Context, keyHandle *webauthn.KeyHandle) bool {
 	params := ClientActionRequestParams{}
-	return client.requestApprover.ApproveClientAction(ClientActionU2FAuthenticate, params)
+	return client.requestApprover.ApproveClientAction(ctx, ClientActionU2FAuthenticate, params)
 }
 
 func (client *DefaultFIDOClient) exportData(passphrase string) []byte {
 	privKeyBytes := cose.MarshalCOSEPrivateKey(client.certPrivateKey)
 	identityData := client.vault.Export()
 	state := identities.FIDODeviceConfig{
-		EncryptionKey:          client.deviceEncryptionKey,
-		AttestationCertificate: client.certificateAuthority.Raw,
-		AttestationPrivateKey:  privKeyBytes,
-		AuthenticationCounter:  client.authenticationCounter,
-		PINEnabled:             client.pinEnabled,
-		PINHash:                client.pinHash,
-		Sources:                identityData,
+		EncryptionKey:                  client.deviceEncryptionKey,
+		SealingKey:                     client.sealingKey,
+		AttestationCertificate:         client.certificateAuthority.Raw,
+		AttestationPrivateKey:          privKeyBytes,
+		AuthenticationCounter:          client.authenticationCounter,
+		PINEnabled:                     client.pinEnabled,
+		PINHash:                        client.pinHash,
+		PINRetries:                     &client.pinRetries,
+		UVRetries:                      &client.uvRetries,
+		PINLength:                      client.pinLength,
+		LargeBlobs:                     client.largeBlobs,
+		AuthenticatorConfig:            client.config,
+		BioEnrollments:                 client.bioEnrollments,
+		EnterpriseAttestationRPIDs:     client.enterpriseAttestationRPIDs,
+		AttestationFormat:              client.attestationFormat,
+		RelyingPartyAttestationFormats: client.relyingPartyAttestationFormats,
+		Sources:                        identityData,
+	}
+	if client.batchAttestationKey != nil {
+		state.BatchAttestationPrivateKey = cose.MarshalCOSEPrivateKey(client.batchAttestationKey)
 	}
 	savedBytes, err := identities.EncryptFIDOState(state, passphrase)
 	util.CheckErr(err, "Could not encode saved state")
@@ -245,11 +421,29 @@ func (client *DefaultFIDOClient) importData(data []byte, passphrase string) erro
 		privateKey = &cose.SupportedCOSEPrivateKey{ECDSA: privateKeyECDSA}
 	}
 	client.deviceEncryptionKey = state.EncryptionKey
+	client.sealingKey = state.SealingKey
 	client.certificateAuthority = cert
 	client.certPrivateKey = privateKey
 	client.authenticationCounter = state.AuthenticationCounter
 	client.pinEnabled = state.PINEnabled
 	client.pinHash = state.PINHash
+	if state.PINRetries != nil {
+		client.pinRetries = *state.PINRetries
+	}
+	if state.UVRetries != nil {
+		client.uvRetries = *state.UVRetries
+	}
+	client.pinLength = state.PINLength
+	client.largeBlobs = state.LargeBlobs
+	client.config = state.AuthenticatorConfig
+	client.bioEnrollments = state.BioEnrollments
+	client.enterpriseAttestationRPIDs = state.EnterpriseAttestationRPIDs
+	if state.BatchAttestationPrivateKey != nil {
+		client.batchAttestationKey, err = cose.UnmarshalCOSEPrivateKey(state.BatchAttestationPrivateKey)
+		util.CheckErr(err, "Could not parse batch attestation key")
+	}
+	client.attestationFormat = state.AttestationFormat
+	client.relyingPartyAttestationFormats = state.RelyingPartyAttestationFormats
 	client.vault = identities.NewIdentityVault()
 	client.vault.Import(state.Sources)
 	return nil
@@ -282,3 +476,11 @@ func (client *DefaultFIDOClient) DeleteIdentity(id []byte) bool {
 	}
 	return success
 }
+
+func (client *DefaultFIDOClient) UpdateIdentityUser(id []byte, user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	success := client.vault.UpdateUser(id, user)
+	if success {
+		client.saveData()
+	}
+	return success
+}
@@ -0,0 +1,118 @@
+package fido_client
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/bulwarkid/virtual-fido/crypto"
+	"github.com/bulwarkid/virtual-fido/ctap"
+	"github.com/bulwarkid/virtual-fido/identities"
+	"github.com/bulwarkid/virtual-fido/test"
+	"github.com/bulwarkid/virtual-fido/util"
+	"github.com/fxamacker/cbor/v2"
+)
+
+type dummyClientSupport struct {
+	data []byte
+}
+
+func (support *dummyClientSupport) ApproveClientAction(ctx context.Context, action ClientAction, params ClientActionRequestParams) bool {
+	return true
+}
+
+func (support *dummyClientSupport) SaveData(data []byte) {
+	support.data = data
+}
+
+func (support *dummyClientSupport) RetrieveData() []byte {
+	return support.data
+}
+
+func (support *dummyClientSupport) Passphrase() string {
+	return "passphrase"
+}
+
+func newTestClient(t *testing.T, support *dummyClientSupport) *DefaultFIDOClient {
+	caPrivateKey, err := identities.CreateCAPrivateKey()
+	util.CheckErr(err, "Could not create CA private key")
+	certificateAuthority, err := identities.CreateSelfSignedCA(caPrivateKey)
+	util.CheckErr(err, "Could not create CA")
+	var encryptionKey [32]byte
+	copy(encryptionKey[:], crypto.RandomBytes(32))
+	return NewDefaultClient(certificateAuthority, caPrivateKey, encryptionKey, false, support, support)
+}
+
+// Messages are built by hand, since the CTAP argument structs aren't exported
+func makeNonResidentCredential(t *testing.T, server *ctap.CTAPServer) []byte {
+	args := map[int]interface{}{
+		1: crypto.HashSHA256([]byte("makeCredential")),
+		2: map[string]string{"id": "example.com", "name": "Example"},
+		3: map[string]interface{}{"id": []byte{1, 2, 3}, "name": "Alice"},
+		4: []map[string]interface{}{{"type": "public-key", "alg": -7}},
+	}
+	response := server.HandleMessage(context.Background(), 0, util.Concat([]byte{0x01}, util.MarshalCBOR(args)))
+	test.AssertEqual(t, response[0], byte(0x00), "Could not make credential")
+	var attestationObject map[int]cbor.RawMessage
+	err := cbor.Unmarshal(response[1:], &attestationObject)
+	util.CheckErr(err, "Could not decode attestation object")
+	var authData []byte
+	err = cbor.Unmarshal(attestationObject[2], &authData)
+	util.CheckErr(err, "Could not decode authenticator data")
+	// RP ID hash, flags, counter and AAGUID come before the credential ID's length
+	idLength := int(authData[53])<<8 | int(authData[54])
+	return authData[55 : 55+idLength]
+}
+
+func getAssertionStatus(server *ctap.CTAPServer, credentialID []byte) byte {
+	args := map[int]interface{}{
+		1: "example.com",
+		2: crypto.HashSHA256([]byte("getAssertion")),
+		3: []map[string]interface{}{{"type": "public-key", "id": credentialID}},
+	}
+	return server.HandleMessage(context.Background(), 0, util.Concat([]byte{0x02}, util.MarshalCBOR(args)))[0]
+}
+
+func TestResetRevokesNonResidentCredentials(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClient(t, support)
+	server := ctap.NewCTAPServer(client)
+	credentialID := makeNonResidentCredential(t, server)
+	test.AssertEqual(t, getAssertionStatus(server, credentialID), byte(0x00), "Sealed credential was not usable")
+
+	response := server.HandleMessage(context.Background(), 0, []byte{0x07})
+	test.AssertEqual(t, response[0], byte(0x00), "Could not reset")
+	test.AssertEqual(t, getAssertionStatus(server, credentialID), byte(0x2E), "Sealed credential was usable after reset")
+
+	// The new key has to survive a restart, or credentials made after the reset would be lost
+	newCredentialID := makeNonResidentCredential(t, server)
+	restarted := ctap.NewCTAPServer(newTestClient(t, support))
+	test.AssertEqual(t, getAssertionStatus(restarted, newCredentialID), byte(0x00), "Sealing key was not saved")
+	test.AssertEqual(t, getAssertionStatus(restarted, credentialID), byte(0x2E), "Old sealing key was restored")
+}
+
+func TestEnterpriseAttestationCertificateIdentifiesDevice(t *testing.T) {
+	support := &dummyClientSupport{}
+	client := newTestClient(t, support)
+	parse := func(client *DefaultFIDOClient, enterprise bool) *x509.Certificate {
+		certBytes := client.CreateAttestationCertificiate(client.AttestationPrivateKey())
+		if enterprise {
+			certBytes = client.CreateEnterpriseAttestationCertificate(client.AttestationPrivateKey())
+		}
+		cert, err := x509.ParseCertificate(certBytes)
+		util.CheckErr(err, "Could not parse certificate")
+		return cert
+	}
+	cert := parse(client, true)
+	test.Assert(t, cert.SerialNumber.Sign() > 0, "Enterprise certificate has no serial number")
+	test.Assert(t, cert.SerialNumber.Cmp(parse(client, false).SerialNumber) != 0, "Enterprise certificate has the batch serial number")
+	test.AssertEqual(t, cert.Subject.SerialNumber, hex.EncodeToString(client.deviceSerialNumber()), "Subject serial number doesn't name the device")
+	test.AssertEqual(t, cert.SerialNumber.Cmp(new(big.Int).SetBytes(client.deviceSerialNumber())), 0, "Certificate serial number doesn't name the device")
+
+	restarted := newTestClient(t, support)
+	test.AssertEqual(t, parse(restarted, true).SerialNumber.Cmp(cert.SerialNumber), 0, "Serial number changed after a restart")
+	other := newTestClient(t, &dummyClientSupport{})
+	test.Assert(t, parse(other, true).SerialNumber.Cmp(cert.SerialNumber) != 0, "Different devices share a serial number")
+}
@@ -6,12 +6,31 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"math/big"
 	"time"
 
 	"github.com/bulwarkid/virtual-fido/cose"
 )
 
+// How new credentials are attested to relying parties
+type AttestationFormat uint8
+
+const (
+	// "packed", signed by a key shared by a batch of authenticators and given with that key's certificate
+	AttestationFormatPackedBatch AttestationFormat = 0
+	// "packed", signed by the credential's own key, which says nothing about the authenticator
+	AttestationFormatPackedSelf AttestationFormat = 1
+	// "none", for relying parties that don't need an attestation
+	AttestationFormatNone AttestationFormat = 2
+	// "fido-u2f", for legacy relying parties that only verify U2F attestations
+	AttestationFormatFIDOU2F AttestationFormat = 3
+	// "none" with a zeroed AAGUID, so relying parties can't tell which kind of authenticator made the credential
+	AttestationFormatAnonymized AttestationFormat = 4
+	// "packed", signed by a new key for each credential that the attestation CA certifies, so attestations can't link credentials
+	AttestationFormatPrivacyCA AttestationFormat = 5
+)
+
 // We need two functions here because Go's type system isn't enough to support this
 func extractPublicKey(key *cose.SupportedCOSEPublicKey) any {
 	if key.ECDSA != nil {
@@ -43,7 +62,24 @@ func CreateSelfSignedAttestationCertificate(
 	certificateAuthorityPrivateKey *cose.SupportedCOSEPrivateKey,
 	targetPrivateKey *cose.SupportedCOSEPrivateKey) (*x509.Certificate, error) {
 	// TODO: Fill in fields like SerialNumber and SubjectKeyIdentifier
-	templateCert := &x509.Certificate{
+	return createAttestationCertificate(attestationCertificateTemplate(), certificateAuthority, certificateAuthorityPrivateKey, targetPrivateKey)
+}
+
+// Creates a certificate naming this specific authenticator, which is only given to relying parties allowed an enterprise attestation
+func CreateEnterpriseAttestationCertificate(
+	certificateAuthority *x509.Certificate,
+	certificateAuthorityPrivateKey *cose.SupportedCOSEPrivateKey,
+	targetPrivateKey *cose.SupportedCOSEPrivateKey,
+	deviceSerialNumber []byte) (*x509.Certificate, error) {
+	templateCert := attestationCertificateTemplate()
+	// Both serials carry the device's, since batch certificates all share serial 0
+	templateCert.SerialNumber = new(big.Int).SetBytes(deviceSerialNumber)
+	templateCert.Subject.SerialNumber = hex.EncodeToString(deviceSerialNumber)
+	return createAttestationCertificate(templateCert, certificateAuthority, certificateAuthorityPrivateKey, targetPrivateKey)
+}
+
+func attestationCertificateTemplate() *x509.Certificate {
+	return &x509.Certificate{
 		Version:      2,
 		SerialNumber: big.NewInt(0),
 		Subject: pkix.Name{
@@ -59,6 +95,13 @@ func CreateSelfSignedAttestationCertificate(
 		IsCA:                  false,
 		BasicConstraintsValid: true,
 	}
+}
+
+func createAttestationCertificate(
+	templateCert *x509.Certificate,
+	certificateAuthority *x509.Certificate,
+	certificateAuthorityPrivateKey *cose.SupportedCOSEPrivateKey,
+	targetPrivateKey *cose.SupportedCOSEPrivateKey) (*x509.Certificate, error) {
 	certBytes, err := x509.CreateCertificate(
 		rand.Reader,
 		templateCert,
@@ -17,6 +17,17 @@ type CredentialSource struct {
 	RelyingParty     *webauthn.PublicKeyCredentialRPEntity
 	User             *webauthn.PublicKeyCrendentialUserEntity
 	SignatureCounter int32
+	// Secrets for the hmac-secret extension, which differ based on whether the user was verified
+	CredRandomWithUV    []byte
+	CredRandomWithoutUV []byte
+	// Zero for credentials made without credProtect, which are treated as userVerificationOptional
+	Protection webauthn.CredentialProtection
+	// Set by the credBlob extension and returned with assertions
+	CredBlob []byte
+	// Set by the largeBlobKey extension, to find the credential's entry in the large blob array
+	LargeBlobKey []byte
+	// Set for stored credentials that weren't made resident, which only the RP's allow list can find
+	NonDiscoverable bool
 }
 
 func (source *CredentialSource) CTAPDescriptor() webauthn.PublicKeyCredentialDescriptor {
@@ -27,6 +38,21 @@ func (source *CredentialSource) CTAPDescriptor() webauthn.PublicKeyCredentialDes
 	}
 }
 
+// Returns whether the credProtect level lets the credential be used, where allowListed is whether the RP already gave its ID
+func (source *CredentialSource) Usable(userVerified bool, allowListed bool) bool {
+	if source.NonDiscoverable && !allowListed {
+		return false
+	}
+	switch source.Protection {
+	case webauthn.CredentialProtectionUserVerificationRequired:
+		return userVerified
+	case webauthn.CredentialProtectionUserVerificationOptionalWithCredentialIDList:
+		return userVerified || allowListed
+	default:
+		return true
+	}
+}
+
 type IdentityVault struct {
 	CredentialSources []*CredentialSource
 }
@@ -36,22 +62,34 @@ func NewIdentityVault() *IdentityVault {
 	return &IdentityVault{CredentialSources: sources}
 }
 
-func (vault *IdentityVault) NewIdentity(relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
+// Creates a credential source with a fresh key, without storing it in a vault.
+// Returns nil if the algorithm isn't supported.
+func NewCredentialSource(algorithm cose.COSEAlgorithmID, relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
+	privateKey := cose.GeneratePrivateKey(algorithm)
+	if privateKey == nil {
+		return nil
+	}
 	credentialID := crypto.RandomBytes(16)
-	privateKey := crypto.GenerateECDSAKey()
-	cosePrivateKey := &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}
 	credentialSource := CredentialSource{
 		Type:             "public-key",
 		ID:               credentialID,
-		PrivateKey:       cosePrivateKey,
+		PrivateKey:       privateKey,
 		RelyingParty:     relyingParty,
 		User:             user,
 		SignatureCounter: 0,
 	}
-	vault.AddIdentity(&credentialSource)
 	return &credentialSource
 }
 
+func (vault *IdentityVault) NewIdentity(algorithm cose.COSEAlgorithmID, relyingParty *webauthn.PublicKeyCredentialRPEntity, user *webauthn.PublicKeyCrendentialUserEntity) *CredentialSource {
+	credentialSource := NewCredentialSource(algorithm, relyingParty, user)
+	if credentialSource == nil {
+		return nil
+	}
+	vault.AddIdentity(credentialSource)
+	return credentialSource
+}
+
 func (vault *IdentityVault) AddIdentity(source *CredentialSource) {
 	vault.CredentialSources = append(vault.CredentialSources, source)
 }
@@ -59,17 +97,37 @@ func (vault *IdentityVault) AddIdentity(source *CredentialSource) {
 func (vault *IdentityVault) DeleteIdentity(id []byte) bool {
 	for i, source := range vault.CredentialSources {
 		if bytes.Equal(source.ID, id) {
-			vault.CredentialSources[i] = vault.CredentialSources[len(vault.CredentialSources)-1]
-			vault.CredentialSources = vault.CredentialSources[:len(vault.CredentialSources)-1]
+			// Keep sources in creation order so that the newest credentials can be found first
+			vault.CredentialSources = append(vault.CredentialSources[:i], vault.CredentialSources[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the user information stored with a credential, keeping the user ID
+func (vault *IdentityVault) UpdateUser(id []byte, user *webauthn.PublicKeyCrendentialUserEntity) bool {
+	for _, source := range vault.CredentialSources {
+		if bytes.Equal(source.ID, id) {
+			source.User = &webauthn.PublicKeyCrendentialUserEntity{
+				ID:          source.User.ID,
+				DisplayName: user.DisplayName,
+				Name:        user.Name,
+			}
 			return true
 		}
 	}
 	return false
 }
 
-func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor) []*CredentialSource {
+// Returns matching credential sources that the user's verification allows, most recently created first
+func (vault *IdentityVault) GetMatchingCredentialSources(relyingPartyID string, allowList []webauthn.PublicKeyCredentialDescriptor, userVerified bool) []*CredentialSource {
 	sources := make([]*CredentialSource, 0)
-	for _, credentialSource := range vault.CredentialSources {
+	for i := len(vault.CredentialSources) - 1; i >= 0; i-- {
+		credentialSource := vault.CredentialSources[i]
+		if !credentialSource.Usable(userVerified, len(allowList) > 0) {
+			continue
+		}
 		if credentialSource.RelyingParty.ID == relyingPartyID {
 			if allowList != nil {
 				for _, allowedSource := range allowList {
@@ -91,12 +149,18 @@ func (vault *IdentityVault) Export() []SavedCredentialSource {
 	for _, source := range vault.CredentialSources {
 		key := cose.MarshalCOSEPrivateKey(source.PrivateKey)
 		savedSource := SavedCredentialSource{
-			Type:             source.Type,
-			ID:               source.ID,
-			PrivateKey:       key,
-			RelyingParty:     *source.RelyingParty,
-			User:             *source.User,
-			SignatureCounter: source.SignatureCounter,
+			Type:                source.Type,
+			ID:                  source.ID,
+			PrivateKey:          key,
+			RelyingParty:        *source.RelyingParty,
+			User:                *source.User,
+			SignatureCounter:    source.SignatureCounter,
+			CredRandomWithUV:    source.CredRandomWithUV,
+			CredRandomWithoutUV: source.CredRandomWithoutUV,
+			Protection:          source.Protection,
+			CredBlob:            source.CredBlob,
+			LargeBlobKey:        source.LargeBlobKey,
+			NonDiscoverable:     source.NonDiscoverable,
 		}
 		sources = append(sources, savedSource)
 	}
@@ -114,12 +178,18 @@ func (vault *IdentityVault) Import(sources []SavedCredentialSource) error {
 			key = &cose.SupportedCOSEPrivateKey{ECDSA: oldFormatKey}
 		}
 		decodedSource := CredentialSource{
-			Type:             source.Type,
-			ID:               source.ID,
-			PrivateKey:       key,
-			RelyingParty:     &source.RelyingParty,
-			User:             &source.User,
-			SignatureCounter: source.SignatureCounter,
+			Type:                source.Type,
+			ID:                  source.ID,
+			PrivateKey:          key,
+			RelyingParty:        &source.RelyingParty,
+			User:                &source.User,
+			SignatureCounter:    source.SignatureCounter,
+			CredRandomWithUV:    source.CredRandomWithUV,
+			CredRandomWithoutUV: source.CredRandomWithoutUV,
+			Protection:          source.Protection,
+			CredBlob:            source.CredBlob,
+			LargeBlobKey:        source.LargeBlobKey,
+			NonDiscoverable:     source.NonDiscoverable,
 		}
 		vault.AddIdentity(&decodedSource)
 	}
@@ -0,0 +1,27 @@
+package identities
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// Returns the hmac-secret output for a salt, or nil if the credential has no secrets
+func (source *CredentialSource) HMACSecret(salt []byte, userVerified bool) []byte {
+	// Verified and unverified logins get different secrets, so a secret can't be had without the PIN once it's been used with it
+	credRandom := source.CredRandomWithoutUV
+	if userVerified {
+		credRandom = source.CredRandomWithUV
+	}
+	if credRandom == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, credRandom)
+	mac.Write(salt)
+	return mac.Sum(nil)
+}
+
+// Returns what the WebAuthn PRF extension gives an RP for the input, which browsers turn into an hmac-secret salt
+func (source *CredentialSource) PRF(input []byte, userVerified bool) []byte {
+	salt := sha256.Sum256(append([]byte("WebAuthn PRF\x00"), input...))
+	return source.HMACSecret(salt[:], userVerified)
+}
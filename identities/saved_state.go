@@ -12,22 +12,55 @@ import (
 )
 
 type SavedCredentialSource struct {
-	Type             string                                  `json:"type"`
-	ID               []byte                                  `json:"id"`
-	PrivateKey       []byte                                  `json:"private_key"`
-	RelyingParty     webauthn.PublicKeyCredentialRPEntity    `json:"relying_party"`
-	User             webauthn.PublicKeyCrendentialUserEntity `json:"user"`
-	SignatureCounter int32                                   `json:"signature_counter"`
+	Type                string                                  `json:"type"`
+	ID                  []byte                                  `json:"id"`
+	PrivateKey          []byte                                  `json:"private_key"`
+	RelyingParty        webauthn.PublicKeyCredentialRPEntity    `json:"relying_party"`
+	User                webauthn.PublicKeyCrendentialUserEntity `json:"user"`
+	SignatureCounter    int32                                   `json:"signature_counter"`
+	CredRandomWithUV    []byte                                  `json:"cred_random_with_uv,omitempty"`
+	CredRandomWithoutUV []byte                                  `json:"cred_random_without_uv,omitempty"`
+	Protection          webauthn.CredentialProtection           `json:"cred_protect,omitempty"`
+	CredBlob            []byte                                  `json:"cred_blob,omitempty"`
+	LargeBlobKey        []byte                                  `json:"large_blob_key,omitempty"`
+	NonDiscoverable     bool                                    `json:"non_discoverable,omitempty"`
+}
+
+// Settings changed through authenticatorConfig, which go back to their defaults when the authenticator is reset
+type AuthenticatorConfig struct {
+	EnterpriseAttestation bool `json:"enterprise_attestation,omitempty"`
+	AlwaysUV              bool `json:"always_uv,omitempty"`
+	// Zero until a minimum is set, meaning the authenticator's default
+	MinPINLength      uint32   `json:"min_pin_length,omitempty"`
+	MinPINLengthRPIDs []string `json:"min_pin_length_rp_ids,omitempty"`
+	ForcePINChange    bool     `json:"force_pin_change,omitempty"`
+}
+
+// A fingerprint enrolled on a simulated sensor, which only keeps what platforms can see of it
+type BioEnrollment struct {
+	TemplateID   []byte `json:"template_id"`
+	FriendlyName string `json:"friendly_name,omitempty"`
 }
 
 type FIDODeviceConfig struct {
-	EncryptionKey          []byte                  `json:"encryption_key"`
-	AttestationCertificate []byte                  `json:"attestation_certificate"`
-	AttestationPrivateKey  []byte                  `json:"attestation_private_key"`
-	AuthenticationCounter  uint32                  `json:"authentication_counter"`
-	PINEnabled             bool                    `json:"pin_enabled,omitempty"`
-	PINHash                []byte                  `json:"pin_hash,omitempty"`
-	Sources                []SavedCredentialSource `json:"sources"`
+	EncryptionKey                  []byte                       `json:"encryption_key"`
+	SealingKey                     []byte                       `json:"sealing_key,omitempty"`
+	AttestationCertificate         []byte                       `json:"attestation_certificate"`
+	AttestationPrivateKey          []byte                       `json:"attestation_private_key"`
+	AuthenticationCounter          uint32                       `json:"authentication_counter"`
+	PINEnabled                     bool                         `json:"pin_enabled,omitempty"`
+	PINHash                        []byte                       `json:"pin_hash,omitempty"`
+	PINRetries                     *int32                       `json:"pin_retries,omitempty"`
+	UVRetries                      *int32                       `json:"uv_retries,omitempty"`
+	PINLength                      uint32                       `json:"pin_length,omitempty"`
+	LargeBlobs                     []byte                       `json:"large_blobs,omitempty"`
+	AuthenticatorConfig            AuthenticatorConfig          `json:"authenticator_config"`
+	BioEnrollments                 []BioEnrollment              `json:"bio_enrollments,omitempty"`
+	EnterpriseAttestationRPIDs     []string                     `json:"enterprise_attestation_rp_ids,omitempty"`
+	BatchAttestationPrivateKey     []byte                       `json:"batch_attestation_private_key,omitempty"`
+	AttestationFormat              AttestationFormat            `json:"attestation_format,omitempty"`
+	RelyingPartyAttestationFormats map[string]AttestationFormat `json:"relying_party_attestation_formats,omitempty"`
+	Sources                        []SavedCredentialSource      `json:"sources"`
 }
 
 type PassphraseEncryptedBlob struct {
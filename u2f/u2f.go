@@ -2,6 +2,7 @@ package u2f
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/x509"
@@ -69,8 +70,8 @@ type U2FClient interface {
 	NewPrivateKey() *ecdsa.PrivateKey
 	NewAuthenticationCounterId() uint32
 	CreateAttestationCertificiate(privateKey *cose.SupportedCOSEPrivateKey) []byte
-	ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool
-	ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool
+	ApproveU2FRegistration(ctx context.Context, keyHandle *webauthn.KeyHandle) bool
+	ApproveU2FAuthentication(ctx context.Context, keyHandle *webauthn.KeyHandle) bool
 }
 
 type U2FServer struct {
@@ -81,45 +82,64 @@ func NewU2FServer(client U2FClient) *U2FServer {
 	return &U2FServer{client: client}
 }
 
-func decodeU2FMessage(messageBytes []byte) (U2FMessageHeader, []byte, uint16) {
+// Returns u2f_SW_WRONG_LENGTH if the lengths don't match the message, rather than reading past its end
+func decodeU2FMessage(messageBytes []byte) (U2FMessageHeader, []byte, uint16, U2FStatusWord) {
 	buffer := bytes.NewBuffer(messageBytes)
+	if buffer.Len() < int(util.SizeOf[U2FMessageHeader]()) {
+		return U2FMessageHeader{}, nil, 0, u2f_SW_WRONG_LENGTH
+	}
 	header := util.ReadBE[U2FMessageHeader](buffer)
 	if buffer.Len() == 0 {
 		// No request length, no response length
-		return header, []byte{}, 0
+		return header, []byte{}, 0, u2f_SW_NO_ERROR
 	}
 	// We should either have a request length or response length, so we have at least
 	// one '0' byte at the start
-	if util.Read(buffer, 1)[0] != 0 {
-		panic(fmt.Sprintf("Invalid U2F Payload length: %s %#v", header, messageBytes))
+	if buffer.Len() < 3 || util.Read(buffer, 1)[0] != 0 {
+		return header, nil, 0, u2f_SW_WRONG_LENGTH
 	}
 	length := util.ReadBE[uint16](buffer)
 	if buffer.Len() == 0 {
 		// No payload, so length must be the response length
-		return header, []byte{}, length
+		return header, []byte{}, length, u2f_SW_NO_ERROR
 	}
 	// length is the request length
-	request := util.Read(buffer, uint(length))
+	if buffer.Len() < int(length) {
+		return header, nil, 0, u2f_SW_WRONG_LENGTH
+	}
+	request := buffer.Next(int(length))
 	if buffer.Len() == 0 {
-		return header, request, 0
+		return header, request, 0, u2f_SW_NO_ERROR
+	}
+	if buffer.Len() != 2 {
+		return header, nil, 0, u2f_SW_WRONG_LENGTH
 	}
 	responseLength := util.ReadBE[uint16](buffer)
-	return header, request, responseLength
+	return header, request, responseLength, u2f_SW_NO_ERROR
 }
 
-func (server *U2FServer) HandleMessage(message []byte) []byte {
-	header, request, responseLength := decodeU2FMessage(message)
+func (server *U2FServer) HandleMessage(ctx context.Context, channelID uint32, message []byte) []byte {
+	header, request, responseLength, status := decodeU2FMessage(message)
+	if status != u2f_SW_NO_ERROR {
+		u2fLogger.Printf("ERROR: Invalid message length: %#v\n\n", message)
+		return util.ToBE(status)
+	}
 	u2fLogger.Printf("MESSAGE: Header: %s Request: %#v Response Length: %d\n\n", header, request, responseLength)
+	if header.Cla != 0 {
+		u2fLogger.Printf("ERROR: Unsupported class: %s\n\n", header)
+		return util.ToBE(u2f_SW_CLA_NOT_SUPPORTED)
+	}
 	var response []byte
 	switch header.Command {
 	case u2f_COMMAND_VERSION:
 		response = append([]byte("U2F_V2"), util.ToBE(u2f_SW_NO_ERROR)...)
 	case u2f_COMMAND_REGISTER:
-		response = server.handleU2FRegister(header, request)
+		response = server.handleU2FRegister(ctx, header, request)
 	case u2f_COMMAND_AUTHENTICATE:
-		response = server.handleU2FAuthenticate(header, request)
+		response = server.handleU2FAuthenticate(ctx, header, request)
 	default:
-		panic(fmt.Sprintf("Invalid U2F Command: %#v", header))
+		u2fLogger.Printf("ERROR: Unsupported command: %s\n\n", header)
+		response = util.ToBE(u2f_SW_INS_NOT_SUPPORTED)
 	}
 	u2fLogger.Printf("RESPONSE: %#v\n\n", response)
 	return response
@@ -145,11 +165,13 @@ func (server *U2FServer) openKeyHandle(boxBytes []byte) (*webauthn.KeyHandle, er
 	return &keyHandle, nil
 }
 
-func (server *U2FServer) handleU2FRegister(header U2FMessageHeader, request []byte) []byte {
+func (server *U2FServer) handleU2FRegister(ctx context.Context, header U2FMessageHeader, request []byte) []byte {
+	if len(request) != 64 {
+		u2fLogger.Printf("U2F REGISTER: Request is %d bytes, not 64\n\n", len(request))
+		return util.ToBE(u2f_SW_WRONG_LENGTH)
+	}
 	challenge := request[:32]
 	application := request[32:]
-	util.Assert(len(challenge) == 32, "Challenge is not 32 bytes")
-	util.Assert(len(application) == 32, "Application is not 32 bytes")
 
 	privateKey := server.client.NewPrivateKey()
 	encodedPublicKey := elliptic.Marshal(elliptic.P256(), privateKey.PublicKey.X, privateKey.PublicKey.Y)
@@ -160,7 +182,7 @@ func (server *U2FServer) handleU2FRegister(header U2FMessageHeader, request []by
 	keyHandle := server.sealKeyHandle(&unencryptedKeyHandle)
 	u2fLogger.Printf("KEY HANDLE: %d %#v\n\n", len(keyHandle), keyHandle)
 
-	if !server.client.ApproveU2FRegistration(&unencryptedKeyHandle) {
+	if !server.client.ApproveU2FRegistration(ctx, &unencryptedKeyHandle) {
 		return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 	}
 
@@ -173,7 +195,12 @@ func (server *U2FServer) handleU2FRegister(header U2FMessageHeader, request []by
 	return util.Concat([]byte{0x05}, encodedPublicKey, []byte{uint8(len(keyHandle))}, keyHandle, cert, signature, util.ToBE(u2f_SW_NO_ERROR))
 }
 
-func (server *U2FServer) handleU2FAuthenticate(header U2FMessageHeader, request []byte) []byte {
+func (server *U2FServer) handleU2FAuthenticate(ctx context.Context, header U2FMessageHeader, request []byte) []byte {
+	// Challenge, application and key handle length, followed by the key handle
+	if len(request) < 65 || len(request) != 65+int(request[64]) {
+		u2fLogger.Printf("U2F AUTHENTICATE: Invalid request length %d\n\n", len(request))
+		return util.ToBE(u2f_SW_WRONG_LENGTH)
+	}
 	requestReader := bytes.NewBuffer(request)
 	control := U2FAuthenticateControl(header.Param1)
 	challenge := util.Read(requestReader, 32)
@@ -190,15 +217,23 @@ func (server *U2FServer) handleU2FAuthenticate(header U2FMessageHeader, request
 		u2fLogger.Printf("U2F AUTHENTICATE: Invalid input data %#v\n\n", keyHandle)
 		return util.ToBE(u2f_SW_WRONG_DATA)
 	}
-	privateKey, err := x509.ParseECPrivateKey(keyHandle.PrivateKey)
-	util.CheckErr(err, "Could not decode private key")
-	cosePrivateKey := &cose.SupportedCOSEPrivateKey{ECDSA: privateKey}
+	cosePrivateKey, err := keyHandle.DecodePrivateKey()
+	if err != nil || cosePrivateKey.ECDSA == nil {
+		// Key handles from CTAP credentials may hold keys that U2F can't use
+		u2fLogger.Printf("U2F AUTHENTICATE: Unusable private key in key handle - %v\n\n", err)
+		return util.ToBE(u2f_SW_WRONG_DATA)
+	}
+	if keyHandle.Protection == webauthn.CredentialProtectionUserVerificationRequired {
+		// U2F can't verify the user, so these credentials have to act like they don't exist
+		u2fLogger.Printf("U2F AUTHENTICATE: Key handle requires user verification\n\n")
+		return util.ToBE(u2f_SW_WRONG_DATA)
+	}
 
 	if control == u2f_AUTH_CONTROL_CHECK_ONLY {
 		return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 	} else if control == u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN || control == u2f_AUTH_CONTROL_SIGN {
 		if control == u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN {
-			if !server.client.ApproveU2FAuthentication(keyHandle) {
+			if !server.client.ApproveU2FAuthentication(ctx, keyHandle) {
 				return util.ToBE(u2f_SW_CONDITIONS_NOT_SATISFIED)
 			}
 		}
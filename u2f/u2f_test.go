@@ -2,6 +2,7 @@ package u2f
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -102,11 +103,11 @@ func (client *DummyU2FClient) CreateAttestationCertificiate(cosePrivateKey *cose
 	return certBytes
 }
 
-func (client *DummyU2FClient) ApproveU2FRegistration(keyHandle *webauthn.KeyHandle) bool {
+func (client *DummyU2FClient) ApproveU2FRegistration(ctx context.Context, keyHandle *webauthn.KeyHandle) bool {
 	return true
 }
 
-func (client *DummyU2FClient) ApproveU2FAuthentication(keyHandle *webauthn.KeyHandle) bool {
+func (client *DummyU2FClient) ApproveU2FAuthentication(ctx context.Context, keyHandle *webauthn.KeyHandle) bool {
 	return true
 }
 
@@ -142,7 +143,7 @@ func TestU2FRegistration(t *testing.T) {
 	challenge := crypto.RandomBytes(32)
 	application := crypto.RandomBytes(32)
 	registration := util.Concat(u2fHeader(u2f_COMMAND_REGISTER, 0, 0), []byte{0, 0, 64}, util.ToBE(512), challenge, application)
-	response := server.HandleMessage(registration)
+	response := server.HandleMessage(context.Background(), 0, registration)
 	code, publicKey, keyHandle, certificate, signature, returnCode := parseRegistrationResponse(response, t)
 	if code != 0x05 {
 		t.Fatalf("Incorrect response code for registration: %d", code)
@@ -161,3 +162,26 @@ func TestU2FRegistration(t *testing.T) {
 		t.Fatalf("Could not verify signature returned by Authenticate")
 	}
 }
+
+func TestMalformedMessages(t *testing.T) {
+	server := NewU2FServer(newDummyU2FClient())
+	register := u2fHeader(u2f_COMMAND_REGISTER, 0, 0)
+	authenticate := u2fHeader(u2f_COMMAND_AUTHENTICATE, byte(u2f_AUTH_CONTROL_ENFORCE_USER_PRESENCE_AND_SIGN), 0)
+	expectStatus := func(message []byte, expected U2FStatusWord, description string) {
+		response := server.HandleMessage(context.Background(), 0, message)
+		if !bytes.Equal(response, util.ToBE(expected)) {
+			t.Errorf("Incorrect response for %s: %#v", description, response)
+		}
+	}
+	expectStatus([]byte{}, u2f_SW_WRONG_LENGTH, "empty message")
+	expectStatus(register[:3], u2f_SW_WRONG_LENGTH, "truncated header")
+	expectStatus(util.Concat(register, []byte{0, 0}), u2f_SW_WRONG_LENGTH, "short length")
+	expectStatus(util.Concat(register, []byte{64, 0, 0}), u2f_SW_WRONG_LENGTH, "non-extended length")
+	expectStatus(util.Concat(register, []byte{0, 0, 64}, crypto.RandomBytes(32)), u2f_SW_WRONG_LENGTH, "truncated request")
+	expectStatus(util.Concat(register, []byte{0, 0, 64}, crypto.RandomBytes(64), []byte{0, 0, 0}), u2f_SW_WRONG_LENGTH, "trailing data")
+	expectStatus(util.ToLE(U2FMessageHeader{Cla: 1, Command: u2f_COMMAND_VERSION}), u2f_SW_CLA_NOT_SUPPORTED, "unsupported class")
+	expectStatus(u2fHeader(0x42, 0, 0), u2f_SW_INS_NOT_SUPPORTED, "unknown command")
+	expectStatus(util.Concat(register, []byte{0, 0, 32}, crypto.RandomBytes(32)), u2f_SW_WRONG_LENGTH, "short registration")
+	expectStatus(util.Concat(authenticate, []byte{0, 0, 64}, crypto.RandomBytes(64)), u2f_SW_WRONG_LENGTH, "short authentication")
+	expectStatus(util.Concat(authenticate, []byte{0, 0, 66}, crypto.RandomBytes(64), []byte{16, 0}), u2f_SW_WRONG_LENGTH, "truncated key handle")
+}
@@ -8,11 +8,20 @@ import (
 	"github.com/bulwarkid/virtual-fido/util"
 )
 
+// Clients can also have a Wink() method, which shows the user which device is theirs when the platform has several to pick from
 type FIDOClient interface {
 	u2f.U2FClient
 	ctap.CTAPClient
 }
 
+// Returns the client's Wink method, or nil so that wink isn't advertised for clients without one
+func winkHandler(client FIDOClient) func() {
+	if winker, ok := client.(interface{ Wink() }); ok {
+		return winker.Wink
+	}
+	return nil
+}
+
 func Start(client FIDOClient) {
 	// Calls either the Mac or USB/IP client, based on system
 	startClient(client)
@@ -1,6 +1,7 @@
 package webauthn
 
 import (
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 
@@ -19,8 +20,8 @@ func (rp PublicKeyCredentialRPEntity) String() string {
 
 type PublicKeyCrendentialUserEntity struct {
 	ID          []byte `cbor:"id" json:"id"`
-	DisplayName string `cbor:"displayName" json:"display_name"`
-	Name        string `cbor:"name" json:"name"`
+	DisplayName string `cbor:"displayName,omitempty" json:"display_name"`
+	Name        string `cbor:"name,omitempty" json:"name"`
 }
 
 func (user PublicKeyCrendentialUserEntity) String() string {
@@ -36,6 +37,15 @@ type PublicKeyCredentialDescriptor struct {
 	Transports []string `cbor:"transports,omitempty"`
 }
 
+// Levels of the credProtect extension, for how much a credential is hidden from users who haven't been verified
+type CredentialProtection uint8
+
+const (
+	CredentialProtectionUserVerificationOptional                     CredentialProtection = 0x01
+	CredentialProtectionUserVerificationOptionalWithCredentialIDList CredentialProtection = 0x02
+	CredentialProtectionUserVerificationRequired                     CredentialProtection = 0x03
+)
+
 type PublicKeyCredentialParams struct {
 	Type      string               `cbor:"type"`
 	Algorithm cose.COSEAlgorithmID `cbor:"alg"`
@@ -44,4 +54,22 @@ type PublicKeyCredentialParams struct {
 type KeyHandle struct {
 	PrivateKey    []byte `cbor:"1,keyasint"`
 	ApplicationID []byte `cbor:"2,keyasint"`
+	// Only set for CTAP credentials, which carry their extension state with them
+	CredRandomWithUV    []byte               `cbor:"3,keyasint,omitempty"`
+	CredRandomWithoutUV []byte               `cbor:"4,keyasint,omitempty"`
+	Protection          CredentialProtection `cbor:"5,keyasint,omitempty"`
+	CredBlob            []byte               `cbor:"6,keyasint,omitempty"`
+}
+
+// U2F key handles hold an x509 encoded ECDSA key, while CTAP credential IDs hold a COSE key
+func (keyHandle *KeyHandle) DecodePrivateKey() (*cose.SupportedCOSEPrivateKey, error) {
+	privateKey, err := cose.UnmarshalCOSEPrivateKey(keyHandle.PrivateKey)
+	if err != nil {
+		ecdsaPrivateKey, err := x509.ParseECPrivateKey(keyHandle.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid private key in key handle: %w", err)
+		}
+		privateKey = &cose.SupportedCOSEPrivateKey{ECDSA: ecdsaPrivateKey}
+	}
+	return privateKey, nil
 }